@@ -7,6 +7,7 @@ package backend
 import (
 	"context"
 	"errors"
+	"io"
 	"time"
 
 	"github.com/hashicorp/terraform/config/module"
@@ -110,8 +111,19 @@ type Operation struct {
 	PlanId         string
 	PlanRefresh    bool   // PlanRefresh will do a refresh before a plan
 	PlanOutPath    string // PlanOutPath is the path to save the plan
+	PlanOnly       bool   // PlanOnly will stop an apply after the plan is saved to PlanOutPath, which is required
 	PlanOutBackend *terraform.BackendState
 
+	// ReportDrift, if true, reports any resources that were changed
+	// outside of Terraform when refreshing before an apply. These are
+	// set on RunningOperation.DriftedResources.
+	ReportDrift bool
+
+	// ShowPostApplyDiff, if true, outputs the attributes of each resource
+	// that an apply changed once it completes, found by comparing the state
+	// before and after the apply.
+	ShowPostApplyDiff bool
+
 	// Module settings specify the root module to use for operations.
 	Module *module.Tree
 
@@ -119,16 +131,159 @@ type Operation struct {
 	// plan and apply arguments but may not work for all backends.
 	Plan *terraform.Plan
 
+	// AllowStalePlan, if true, allows applying a Plan that wasn't made from
+	// the current state, such as from a different lineage or an older serial.
+	AllowStalePlan bool
+
 	// The options below are more self-explanatory and affect the runtime
 	// behavior of the operation.
 	Destroy   bool
 	Targets   []string
 	Variables map[string]interface{}
 
+	// PrePlanApply, if non-nil, is called with the plan for an apply
+	// before it is applied. If it returns an error then the apply is
+	// cancelled with that error. The plan must not be modified.
+	PrePlanApply func(*terraform.Plan) error
+
+	// ApprovedPlanHash, if set, is the hash of the only plan that an apply
+	// may apply, as returned by local.PlanHash for the local backend. If the
+	// plan, whether saved or not, has a different hash then the apply fails
+	// without applying anything.
+	ApprovedPlanHash string
+
+	// GeneratePlanApprovalToken, if true, sets the PlanApprovalToken of
+	// the running operation once an apply has its plan, so that the plan
+	// can be approved out of band.
+	GeneratePlanApprovalToken bool
+
+	// IgnoreConcurrentChanges, if true, applies even if the State was
+	// written by someone else while the apply was planning. Otherwise the
+	// apply fails with nothing applied.
+	IgnoreConcurrentChanges bool
+
+	// CostEstimate, if non-nil, is called with the plan for an apply before
+	// it is applied. The estimate it returns is output, colorized, before
+	// applying. If it returns an error then the apply is cancelled.
+	CostEstimate func(plan *terraform.Plan) (string, error)
+
+	// DestroyConfirm, if non-nil, is called with the current state after
+	// planning a destroy but before anything is destroyed. If it returns an
+	// error then the destroy is cancelled with that error.
+	DestroyConfirm func(*terraform.State) error
+
+	// DestroyWarnThreshold, if non-zero, is the number of resources that
+	// can be destroyed by an apply or destroy without a warning. If the
+	// plan destroys more, including resources that are replaced, then
+	// DestroyGate, if non-nil, is called with the number to be destroyed
+	// after planning. If it returns an error then the apply is cancelled
+	// with that error.
+	DestroyWarnThreshold int
+	DestroyGate          func(count int) error
+
+	// ErrorOnEmptyDestroy, if true, makes a destroy fail if the state was
+	// already empty so there was nothing to destroy. This usually means
+	// that the wrong state was selected.
+	ErrorOnEmptyDestroy bool
+
+	// OnApplyFailure, if non-nil, is called when applying fails, after the
+	// partial state has been persisted, with that state and the error. This
+	// lets the caller take compensating action. It doesn't change the error
+	// that the operation completes with.
+	OnApplyFailure func(*terraform.State, error)
+
+	// PostApplyVerify, if non-nil, is called with the final state after a
+	// successful apply has been persisted. If it returns an error then the
+	// operation fails with that error, but the state is left as persisted.
+	PostApplyVerify func(*terraform.State) error
+
+	// RequireIdempotent, if true, makes an apply fail if it changed any
+	// resources. This verifies that the infrastructure has converged with
+	// the configuration.
+	RequireIdempotent bool
+
+	// StopGracePeriod, if non-zero, is how long to wait for an apply to
+	// stop after it is interrupted. If it hasn't stopped by then, the
+	// operation completes with an error without waiting any longer.
+	StopGracePeriod time.Duration
+
+	// MaxDuration, if non-zero, is the longest an apply may run. Reaching
+	// it interrupts the apply the same as cancelling it, and the operation
+	// fails once the apply has stopped and the state is persisted.
+	MaxDuration time.Duration
+
+	// StopOnError, if true, stops an apply as soon as any resource fails
+	// to apply rather than continuing with independent resources. Resources
+	// that have already started applying will still run to completion.
+	StopOnError bool
+
+	// NonFatalResourceErrors, if non-nil, is called with the address and
+	// error of each resource that fails to apply. Errors for which it
+	// returns true are reported as warnings rather than failing the apply.
+	NonFatalResourceErrors func(addr string, err error) bool
+
+	// ResourceRetries is the number of times a resource that fails to
+	// apply with an error for which RetryableError returns true is applied
+	// again. Only resources that nothing else left to apply depends on are
+	// retried: if anything else wasn't applied then nothing is retried.
+	ResourceRetries int
+	RetryableError  func(error) bool
+
+	// ApplyFilter, if non-nil, is called with the address of each resource
+	// about to be applied. Resources for which it returns false are skipped
+	// and reported as deferred, allowing a plan to be applied in stages.
+	ApplyFilter func(addr string) bool
+
 	// Input/output/control options.
 	UIIn  terraform.UIInput
 	UIOut terraform.UIOutput
 
+	// ProgressFunc, if non-nil, is called during an apply each time a
+	// resource finishes applying, with the number of resources applied so
+	// far and the total number planned. If nothing is planned then it is
+	// called once with both as zero.
+	ProgressFunc func(done, total int)
+
+	// Metrics, if non-nil, collects metrics about each resource applied
+	// and the apply as a whole.
+	Metrics MetricsCollector
+
+	// ResumeTokenOut, if set, is a path where a resume token is written if
+	// an apply is interrupted. The token records the resources that were
+	// completed.
+	//
+	// ResumeToken, if set, is the path to a resume token from an earlier
+	// interrupted apply. The resources it records as completed are skipped.
+	// This is only safe if applying those resources again would do
+	// nothing, since they're skipped even if they have planned changes.
+	ResumeTokenOut string
+	ResumeToken    string
+
+	// ExtraHooks are hooks to use for just this operation, in addition to
+	// any hooks configured on the backend. With the local backend, hooks
+	// that implement local.StoppingHook are also told when an apply is
+	// being stopped.
+	ExtraHooks []terraform.Hook
+
+	// EventStream, if non-nil, receives a line of JSON describing each
+	// event during an operation, such as a resource starting or finishing
+	// being applied.
+	EventStream io.Writer
+
+	// DiffWriter, if non-nil, receives the diff of each resource in a
+	// human-readable format just before the resource is applied.
+	DiffWriter io.Writer
+
+	// JSONUI, if true, replaces the human-readable summary output at the
+	// end of an operation with a single machine-readable JSON object.
+	JSONUI bool
+
+	// JSONStream, if non-nil, receives the same machine-readable JSON
+	// summary as JSONUI at the end of an apply, followed by a newline. This
+	// is independent of the output to the UI, so the human-readable summary
+	// is still output unless JSONUI is also set.
+	JSONStream io.Writer
+
 	// If LockState is true, the Operation must Lock any
 	// state.Lockers for its duration, and Unlock when complete.
 	LockState bool
@@ -136,6 +291,154 @@ type Operation struct {
 	// The duration to retry obtaining a State lock.
 	StateLockTimeout time.Duration
 
+	// LockProgress, if non-nil, is called periodically with the time spent
+	// so far while waiting to obtain a State lock.
+	LockProgress func(elapsed time.Duration)
+
+	// CheckLockEvenWhenUnlocked, if true, checks whether the State is
+	// locked by someone else before applying even though LockState is
+	// false, warning if it is. The check briefly obtains and releases the
+	// lock. If FailOnExistingLock is also true, the apply fails instead.
+	CheckLockEvenWhenUnlocked bool
+	FailOnExistingLock        bool
+
+	// OnLockAcquired, if non-nil, is called with the lock ID as soon as the
+	// State lock is obtained. It is only called if LockState is true.
+	OnLockAcquired func(lockID string)
+
+	// StatePersistRetries is the number of times to retry writing and
+	// persisting the state after an apply if it fails. Each retry waits
+	// twice as long as the previous one, starting at
+	// StatePersistRetryInterval.
+	StatePersistRetries       int
+	StatePersistRetryInterval time.Duration
+
+	// Preflight, if true, checks that the state can be read from the
+	// backend before an apply does anything else, failing fast if the
+	// backend is unreachable rather than after planning.
+	Preflight bool
+
+	// StatePersistInterval, if non-zero, is the minimum interval at which
+	// the state is persisted while an apply is running, rather than only
+	// once the apply completes. Failing to persist it in between is only
+	// logged, since the state is still persisted once the apply completes.
+	StatePersistInterval time.Duration
+
+	// Ephemeral, if true, applies to an in-memory copy of the state that is
+	// discarded once the operation completes. The state is never locked or
+	// persisted. The final state is still available as RunningOperation.State.
+	Ephemeral bool
+
+	// SandboxApply, if true, applies to an in-memory copy of the state like
+	// Ephemeral, and reports the diff that was applied and the resulting
+	// counts as RunningOperation.Sandbox before discarding the copy.
+	SandboxApply bool
+
+	// SkipStatePersist, if true, applies using the real state but never
+	// writes the result to it, or anywhere else, such as a backup. Unlike
+	// Ephemeral, the real state is still locked while applying. The final
+	// state is still available as RunningOperation.State.
+	SkipStatePersist bool
+
+	// StrictVersionCheck, if true, fails an apply to a state that was
+	// written by a newer version of Terraform, rather than only warning
+	// that applying may corrupt the state.
+	StrictVersionCheck bool
+
+	// LogFile, if set, is the path of a file that the log lines of an
+	// apply are appended to as well as the standard log, so that the log
+	// of a single apply can be kept. Only the log lines of the backend are
+	// included, not those of Terraform core or the providers.
+	LogFile string
+
+	// ExpectedProviderHashes, if set, is the expected lowercase hex SHA-256
+	// checksum of the plugin binary of each provider, keyed by the provider
+	// name. An apply verifies each before doing anything else, and fails if
+	// any doesn't match. Providers that aren't listed aren't verified.
+	ExpectedProviderHashes map[string]string
+
+	// OnComplete, if set, is called once an apply completes, whether it
+	// succeeded or not, with the outcome of the apply.
+	OnComplete func(result ApplyResult)
+
+	// ChangeDetector, if set, decides whether an apply changed the state,
+	// given the state before and after the apply, rather than comparing
+	// them exactly. This is used for RunningOperation.StateChanged and to
+	// decide whether to output that there were no changes.
+	ChangeDetector func(before, after *terraform.State) bool
+
+	// AckTargeting acknowledges that an apply with Targets may leave the
+	// state inconsistent with the configuration. Unless it is set, such an
+	// apply warns about it, or with RefuseTargeting set, fails instead.
+	AckTargeting    bool
+	RefuseTargeting bool
+
+	// Webhook, if set, is notified once an apply completes by POSTing the
+	// same JSON summary as is written to SummaryPath. The operation waits
+	// for the post, for at most the webhook's Timeout, even if the apply
+	// was interrupted. A failed post never fails the apply.
+	Webhook *Webhook
+
+	// Breakpoints are the addresses of resources to pause an apply at.
+	// Before each is applied, OnBreakpoint is called with its address and
+	// the current state, and applying it waits until OnBreakpoint returns.
+	// If OnBreakpoint returns an error, the resource fails to apply and
+	// the apply is stopped.
+	Breakpoints  map[string]bool
+	OnBreakpoint func(addr string, state *terraform.State) error
+
+	// SimulateStateWriteError, if true, treats persisting the state after
+	// an apply as having failed without writing to the backend at all, so
+	// that the procedure for recovering from that can be tested.
+	SimulateStateWriteError bool
+
+	// WriteStateToStdout, if true, writes the final state of an apply as
+	// JSON to StateStdout once it's persisted so that it can be piped to
+	// other tools. StateStdout defaults to os.Stdout.
+	WriteStateToStdout bool
+	StateStdout        io.Writer
+
+	// StateSigner, if set, is called after an apply persists the state
+	// with the state serialized as it's written, and the signature it
+	// returns is written next to the state output path with a ".sig"
+	// extension. Failing to sign the state, or there being no local state
+	// output path to sign it next to, is only a warning.
+	StateSigner func(state []byte) ([]byte, error)
+
+	// StateTransform, if non-nil, is called with the final state of an
+	// apply before it's persisted, and the state it returns is persisted
+	// instead. If it returns an error then the untransformed state is
+	// backed up as if persisting it had failed.
+	StateTransform func(*terraform.State) (*terraform.State, error)
+
+	// SecondaryState, if non-nil, is written and persisted with the final
+	// state of an apply after the primary state is persisted. This is a
+	// best-effort backup: failing to persist it is only a warning.
+	SecondaryState state.State
+
+	// RemainingPlanPath, if set, is where a plan of the changes that
+	// weren't applied is saved if an apply fails, so that the apply can
+	// be resumed by applying it.
+	RemainingPlanPath string
+
+	// SummaryPath, if set, is where a JSON summary of the outcome of an
+	// apply is written once it completes, whether it succeeded or not.
+	SummaryPath string
+
+	// StateOutPath, if set, overrides the backend's configured state output
+	// path for this operation, such as the path reported once an apply
+	// completes.
+	StateOutPath string
+
+	// Meta is arbitrary metadata about who or what is running the
+	// operation, such as the user or CI job. An apply records it along with
+	// the time and Terraform version in the provenance of the state.
+	Meta map[string]string
+
+	// AuditDir, if set, is a directory where JSON snapshots of the state
+	// immediately before and after an apply are written.
+	AuditDir string
+
 	// Environment is the named state that should be loaded from the Backend.
 	Environment string
 }
@@ -163,4 +466,134 @@ type RunningOperation struct {
 	// this state is managed by the backend. This should only be read
 	// after the operation completes to avoid read/write races.
 	State *terraform.State
+
+	// ResourceResults is populated after an Apply operation with the
+	// outcome of applying each resource, keyed by the resource address.
+	// Resources that applied successfully have a nil error.
+	ResourceResults map[string]error
+
+	// ProvisionerOutput is populated after an Apply operation with the
+	// output of the provisioners of each resource, keyed by the resource
+	// address, with each message on its own line.
+	ProvisionerOutput map[string]string
+
+	// FailedDestroys is populated after a destroy with the sorted addresses
+	// of the resources that failed to be destroyed, and so may still exist.
+	FailedDestroys []string
+
+	// DriftedResources is populated after an Apply operation with
+	// Operation.ReportDrift set with the addresses of the resources that
+	// were found to have changed outside of Terraform while refreshing.
+	DriftedResources []string
+
+	// UnexpectedResources is populated after an Apply operation with the
+	// sorted addresses of the resources that were added even though the
+	// plan didn't add them, which usually means a provider bug.
+	UnexpectedResources []string
+
+	// PeakParallelism is populated after an Apply operation completes with
+	// the largest number of resources that were applied concurrently.
+	PeakParallelism int
+
+	// PhaseTimings is populated after an Apply operation with how long
+	// each phase that ran took, keyed by the phase: "refresh", "plan",
+	// "apply" and "persist". Phases that were skipped, such as refreshing
+	// and planning when applying a saved plan, aren't included.
+	PhaseTimings map[string]time.Duration
+
+	// CancelReason is populated after an Apply operation is cancelled with
+	// why it was cancelled. It is empty if the operation wasn't cancelled.
+	CancelReason CancelReason
+
+	// PlanApprovalToken is populated after an Apply operation with
+	// Operation.GeneratePlanApprovalToken set has its plan. It describes
+	// the plan, including its hash, for an approval system to sign.
+	PlanApprovalToken string
+
+	// StateChanged is populated after an Apply operation with whether the
+	// state that was persisted differs from the state before the apply.
+	StateChanged bool
+
+	// PriorSerial and NewSerial are populated after an Apply operation
+	// with the serial of the state before and after the apply. If the
+	// apply changed the state then NewSerial is greater than PriorSerial.
+	PriorSerial int64
+	NewSerial   int64
+
+	// Sandbox is populated after an Apply operation with
+	// Operation.SandboxApply set with what the apply did to the discarded
+	// copy of the state.
+	Sandbox *SandboxResult
+
+	// Warnings are any non-fatal problems encountered during the
+	// operation. This is populated after the operation has completed.
+	Warnings []string
+}
+
+// CancelReason is why an operation was cancelled.
+type CancelReason string
+
+const (
+	// CancelReasonCanceled is when the context of the operation was
+	// cancelled, such as by the user interrupting it.
+	CancelReasonCanceled CancelReason = "canceled"
+
+	// CancelReasonDeadline is when the deadline of the context of the
+	// operation was reached.
+	CancelReasonDeadline CancelReason = "deadline"
+
+	// CancelReasonMaxDuration is when the operation ran for longer than
+	// its Operation.MaxDuration.
+	CancelReasonMaxDuration CancelReason = "max_duration"
+)
+
+// SandboxResult is what a sandbox apply did to the copy of the state.
+type SandboxResult struct {
+	// Diff is the diff that was applied.
+	Diff *terraform.Diff
+
+	// Added, Changed and Removed are the number of resources that were
+	// applied with each kind of change.
+	Added   int
+	Changed int
+	Removed int
+}
+
+// ApplyResult is the outcome of an apply, given to Operation.OnComplete.
+type ApplyResult struct {
+	// Success is true if the apply completed without error, and Err is
+	// the error if it didn't.
+	Success bool
+	Err     error
+
+	// Destroy is true if the apply was a destroy.
+	Destroy bool
+
+	// Added, Changed and Removed are the number of resources that were
+	// applied with each kind of change.
+	Added   int
+	Changed int
+	Removed int
+
+	// PhaseTimings is how long each phase of the apply that ran took, as
+	// in RunningOperation.PhaseTimings.
+	PhaseTimings map[string]time.Duration
+
+	// PriorSerial and NewSerial are the serial of the state before and
+	// after the apply, as in RunningOperation.
+	PriorSerial int64
+	NewSerial   int64
+}
+
+// Webhook is where to notify of the outcome of an operation.
+type Webhook struct {
+	// URL is the URL to POST the outcome to.
+	URL string
+
+	// Headers are any additional headers to send, such as for auth.
+	Headers map[string]string
+
+	// Timeout is how long posting can take. If this is zero, a default
+	// timeout is used.
+	Timeout time.Duration
 }
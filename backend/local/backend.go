@@ -4,12 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/terraform/backend"
 	"github.com/hashicorp/terraform/helper/schema"
@@ -25,8 +27,16 @@ const (
 	DefaultStateFilename   = "terraform.tfstate"
 	DefaultDataDir         = ".terraform"
 	DefaultBackupExtension = ".backup"
+
+	DefaultErroredStateFilename = "errored.tfstate"
 )
 
+// Logger is the interface for Local.Logger. It's implemented by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 // Local is an implementation of EnhancedBackend that performs all operations
 // locally. This is the "default" backend and implements normal Terraform
 // behavior as it is well known.
@@ -36,6 +46,30 @@ type Local struct {
 	CLI      cli.Ui
 	CLIColor *colorstring.Colorize
 
+	// ForcePlainOutput disables coloring the output of an apply even if
+	// CLIColor enables it, for when the output is logged somewhere that
+	// doesn't handle color codes.
+	ForcePlainOutput bool
+
+	// ApplyStoppingMessage is output when an apply is interrupted, after
+	// being colorized. If this is empty, a default message is used. Set
+	// this to "-" to disable the message.
+	ApplyStoppingMessage string
+
+	// ApplySuccessTemplate and DestroySuccessTemplate replace the message
+	// output when an apply or destroy completes. They're rendered with
+	// text/template against an ApplySummary and then colorized. If these
+	// are empty or fail to render, the default messages are used.
+	ApplySuccessTemplate   string
+	DestroySuccessTemplate string
+
+	// StatePathMessage replaces the message output after an apply saves
+	// the state. It's rendered with text/template against a
+	// StatePathSummary and then colorized. Set this to "-" to disable the
+	// message. If this is empty or fails to render, the default message is
+	// used, which only describes the state as a local file if it is one.
+	StatePathMessage string
+
 	// The State* paths are set from the CLI options, and may be left blank to
 	// use the defaults. If the actual paths for the local backend state are
 	// needed, use the StatePaths method.
@@ -55,6 +89,53 @@ type Local struct {
 	StateBackupPath string
 	StateEnvDir     string
 
+	// StateHistoryDir, if set, is a directory where the state is written
+	// before each apply, in a file named for the time of the apply. This
+	// keeps a local history of the state to roll back to.
+	StateHistoryDir string
+
+	// ErroredStatePath is the local path where the state will be written
+	// if it can't be persisted after an apply, so that it can be recovered.
+	// This defaults to DefaultErroredStateFilename if not set.
+	ErroredStatePath string
+
+	// ErroredStateWriter, if set, is written the state as JSON if it can't
+	// be persisted after an apply, instead of writing it to
+	// ErroredStatePath. This is for when there is no writable filesystem,
+	// and it's up to the writer to keep the state so it can be recovered.
+	ErroredStateWriter io.Writer
+
+	// CompressErroredState writes the state to ErroredStatePath with a
+	// ".gz" extension as gzip-compressed JSON, since a large state can be
+	// much larger uncompressed.
+	CompressErroredState bool
+
+	// SuppressStateConsoleFallback disables printing the state to the CLI
+	// as a last resort if it can't be written to ErroredStatePath. Set this
+	// if the CLI output may be logged somewhere that the state, which may
+	// contain secrets, shouldn't be.
+	SuppressStateConsoleFallback bool
+
+	// StateJSONIndent is the indentation used when printing the state to
+	// the CLI as a last resort. This defaults to two spaces if nil. If it
+	// is empty, the state is printed compactly on a single line.
+	StateJSONIndent *string
+
+	// Quiet suppresses the informational output of an apply, such as the
+	// summary and state path once it succeeds. Errors and the message
+	// output when an apply is interrupted are still output.
+	Quiet bool
+
+	// Logger, if non-nil, is where an apply's messages such as its summary
+	// are logged to if CLI is nil, so that they aren't lost when Terraform
+	// is embedded without a UI.
+	Logger Logger
+
+	// OutputFilter, if non-nil, is called with everything an apply outputs
+	// to the CLI and the result is output instead. This can be used to
+	// redact secrets from the output.
+	OutputFilter func(string) string
+
 	// We only want to create a single instance of a local state, so store them
 	// here as they're loaded.
 	states map[string]state.State
@@ -71,6 +152,34 @@ type Local struct {
 	OpInput      bool
 	OpValidation bool
 
+	// DisableRefresh skips the refresh before an apply even if the
+	// operation requests one. This is for when refreshing is managed
+	// separately from the local backend.
+	DisableRefresh bool
+
+	// RecordShadowErrors adds any errors from the shadow graph during an
+	// apply to the warnings of the operation. Shadow errors never cause
+	// the operation itself to fail.
+	RecordShadowErrors bool
+
+	// TerseErrors leaves out the explanation of how to recover that is
+	// normally included when an apply fails, such as for CI where the
+	// same explanation would be repeated in every failed job.
+	TerseErrors bool
+
+	// ReadOnly makes the backend refuse to apply or destroy. Operations that
+	// don't modify anything, such as plan, are still allowed.
+	ReadOnly bool
+
+	// LockTimeouts overrides the duration to retry obtaining a state lock
+	// for each operation, keyed by its name: "apply", "destroy", "plan" or
+	// "refresh". Operations not in the map use the operation's
+	// StateLockTimeout. This is keyed by name rather than by
+	// backend.OperationType since a destroy is an apply operation, and
+	// it's often the one that should wait longer. Configure fails if there
+	// are any other keys.
+	LockTimeouts map[string]time.Duration
+
 	// Backend, if non-nil, will use this backend for non-enhanced behavior.
 	// This allows local behavior with remote state storage. It is a way to
 	// "upgrade" a non-enhanced backend to an enhanced backend with typical
@@ -110,6 +219,14 @@ func (b *Local) Validate(c *terraform.ResourceConfig) ([]string, []error) {
 func (b *Local) Configure(c *terraform.ResourceConfig) error {
 	b.once.Do(b.init)
 
+	for name := range b.LockTimeouts {
+		if !lockTimeoutOperations[name] {
+			return fmt.Errorf(
+				"unknown operation %q in LockTimeouts: must be one of "+
+					"\"apply\", \"destroy\", \"plan\" or \"refresh\"", name)
+		}
+	}
+
 	f := b.schema.Configure
 	if b.Backend != nil {
 		f = b.Backend.Configure
@@ -392,6 +509,35 @@ func (b *Local) stateEnvDir() string {
 	return DefaultEnvDir
 }
 
+// erroredStatePath returns the path where the state is backed up to if it
+// can't be persisted.
+func (b *Local) erroredStatePath() string {
+	if b.ErroredStatePath != "" {
+		return b.ErroredStatePath
+	}
+
+	return DefaultErroredStateFilename
+}
+
+// lockTimeoutOperations are the operation names that LockTimeouts can be
+// keyed by, as returned by operationName.
+var lockTimeoutOperations = map[string]bool{
+	"apply":   true,
+	"destroy": true,
+	"plan":    true,
+	"refresh": true,
+}
+
+// lockTimeout returns the duration to retry obtaining a state lock for the
+// operation.
+func (b *Local) lockTimeout(op *backend.Operation) time.Duration {
+	if d, ok := b.LockTimeouts[operationName(op)]; ok {
+		return d
+	}
+
+	return op.StateLockTimeout
+}
+
 // currentStateName returns the name of the current named state as set in the
 // configuration files.
 // If there are no configured environments, currentStateName returns "default"
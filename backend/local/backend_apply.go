@@ -1,25 +1,127 @@
 package local
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-version"
 	"github.com/hashicorp/terraform/backend"
 	"github.com/hashicorp/terraform/command/clistate"
 	"github.com/hashicorp/terraform/config/module"
 	"github.com/hashicorp/terraform/state"
 	"github.com/hashicorp/terraform/terraform"
+	"github.com/mitchellh/cli"
+	"github.com/mitchellh/colorstring"
 )
 
 func (b *Local) opApply(
 	ctx context.Context,
 	op *backend.Operation,
 	runningOp *backend.RunningOperation) {
-	log.Printf("[INFO] backend/local: starting Apply operation")
+	// Setup our count hook that keeps track of resource changes
+	countHook := new(CountHook)
+
+	// If we're only applying some resources, setup the hook to skip the
+	// others. It's added to the hooks below.
+	var filterHook *ApplyFilterHook
+	if op.ApplyFilter != nil {
+		filterHook = &ApplyFilterHook{Filter: op.ApplyFilter}
+	}
+
+	// Once we're done, tell the caller the outcome if asked to. This comes
+	// first so that the caller is told however the apply ends.
+	if op.OnComplete != nil {
+		defer func() {
+			op.OnComplete(applyResult(op, runningOp, countHook))
+		}()
+	}
+
+	// Once we're done, write the summary of the outcome if asked to. Like
+	// the above, this comes first so that a failed apply has a summary.
+	start := time.Now()
+	if op.SummaryPath != "" {
+		defer func() {
+			b.writeApplySummary(ctx, op, runningOp, countHook, filterHook, start)
+		}()
+	}
+
+	// Once we're done, notify the webhook of the outcome if there is one.
+	// This waits for the post, bounded by the webhook's timeout, so that
+	// it's sent before the operation is done even if it was interrupted.
+	if op.Webhook != nil && op.Webhook.URL != "" {
+		defer func() {
+			postWebhook(ctx, op.Webhook,
+				applySummaryFile(op, runningOp, countHook, filterHook, start))
+		}()
+	}
+
+	// If we're keeping a log of just this operation, open it first so that
+	// it has every log line
+	if op.LogFile != "" {
+		f, err := os.OpenFile(op.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			runningOp.Err = errwrap.Wrapf("Error opening log file: {{err}}", err)
+			return
+		}
+		defer f.Close()
+
+		ctx = contextWithOperationLogger(ctx, log.New(f, "", log.LstdFlags))
+	}
+
+	logWithContext(ctx, "[INFO] backend/local: starting Apply operation")
+
+	// A read-only backend never modifies anything, so stop before we even
+	// look at the state
+	if b.ReadOnly {
+		runningOp.Err = &ReadOnlyBackendError{Operation: operationName(op)}
+		return
+	}
+
+	// Stopping after the plan without saving it would silently discard it
+	if op.PlanOnly && op.PlanOutPath == "" {
+		runningOp.Err = errors.New(
+			"An apply that stops after the plan needs a path to save the plan to")
+		return
+	}
+
+	// Check that the backend is reachable before doing anything that takes
+	// long, since the result couldn't be persisted otherwise
+	if op.Preflight {
+		if err := b.preflight(ctx, op); err != nil {
+			runningOp.Err = err
+			return
+		}
+	}
+
+	// If the apply has a deadline then reaching it interrupts the apply
+	// the same as cancelling it. Keep the original context to tell why
+	// we were cancelled.
+	parentCtx := ctx
+	if op.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, op.MaxDuration)
+		defer cancel()
+	}
 
 	// If we have a nil module at this point, then set it to an empty tree
 	// to avoid any potential crashes.
@@ -29,168 +131,2538 @@ func (b *Local) opApply(
 	}
 
 	// If we have a nil module at this point, then set it to an empty tree
-	// to avoid any potential crashes.
+	// to avoid any potential crashes. A saved plan is applied with its own
+	// module, but unless we're destroying, applying without any is
+	// probably not what was intended so warn about it.
 	if op.Module == nil {
+		if !op.Destroy && (op.Plan == nil || op.Plan.Module == nil) {
+			logWithContext(ctx, "[WARN] backend/local: %s", applyWarnEmptyModule)
+			runningOp.Warnings = append(runningOp.Warnings, applyWarnEmptyModule)
+		}
+
 		op.Module = module.NewEmptyTree()
 	}
 
-	// Setup our count hook that keeps track of resource changes
-	countHook := new(CountHook)
+	// Targeting only some resources can leave the state inconsistent with
+	// the configuration, so it must be acknowledged
+	targets := op.Targets
+	if op.Plan != nil && len(targets) == 0 {
+		targets = op.Plan.Targets
+	}
+	if len(targets) > 0 && !op.AckTargeting {
+		if op.RefuseTargeting {
+			runningOp.Err = &UnacknowledgedTargetingError{Targets: targets}
+			return
+		}
+
+		logWithContext(ctx, "[WARN] backend/local: applying with unacknowledged targets: %s",
+			strings.Join(targets, ", "))
+		msg := fmt.Sprintf(applyTargetingWarning, strings.Join(targets, ", "))
+		runningOp.Warnings = append(runningOp.Warnings, msg)
+		if b.canOutput() {
+			b.applyError(b.applyColorize().Color("[reset][bold][yellow]Warning: " + msg))
+		}
+	}
+
+	// Setup our hooks
 	stateHook := new(StateHook)
-	if b.ContextOpts == nil {
-		b.ContextOpts = new(terraform.ContextOpts)
+	parallelismHook := new(ParallelismHook)
+	resultsHook := new(ResultsHook)
+	provisionerOutputHook := new(ProvisionerOutputHook)
+
+	// The hooks for this operation are built up separately from the
+	// backend's so that concurrent operations don't see each other's hooks
+	var hooks []terraform.Hook
+	if b.ContextOpts != nil {
+		hooks = append(hooks, b.ContextOpts.Hooks...)
+	}
+	hooks = append(hooks, countHook, stateHook, resultsHook, provisionerOutputHook)
+
+	// If we're only applying some resources, the filter goes first so that
+	// other hooks don't see the skipped resources at all
+	if filterHook != nil {
+		hooks = append([]terraform.Hook{filterHook}, hooks...)
+	}
+
+	// If we're resuming an interrupted apply, setup the hook to skip what
+	// it already completed. Like the filter, this goes first.
+	var resumeHook *ResumeHook
+	var resumeLineage string
+	if op.ResumeToken != "" {
+		token, err := readResumeToken(op.ResumeToken)
+		if err != nil {
+			runningOp.Err = err
+			return
+		}
+
+		resumeLineage = token.Lineage
+		resumeHook = &ResumeHook{Completed: make(map[string]bool)}
+		for _, addr := range token.Completed {
+			resumeHook.Completed[addr] = true
+		}
+		hooks = append([]terraform.Hook{resumeHook}, hooks...)
+	}
+
+	// If we're streaming events, setup the hook to write them
+	if op.EventStream != nil {
+		hooks = append(hooks, &EventStreamHook{Writer: op.EventStream})
+	}
+
+	// If we're writing diffs, setup the hook to write each before applying
+	if op.DiffWriter != nil {
+		hooks = append(hooks, &DiffWriterHook{Writer: op.DiffWriter})
+	}
+
+	// If we're stopping on the first error, setup the hook to do that
+	var stopOnErrorHook *StopOnErrorHook
+	if op.StopOnError {
+		stopOnErrorHook = &StopOnErrorHook{NonFatal: op.NonFatalResourceErrors}
+		hooks = append(hooks, stopOnErrorHook)
+	}
+
+	// If we're reporting progress, setup the hook to do that. The total
+	// is set once we have the plan.
+	var progressHook *ProgressHook
+	if op.ProgressFunc != nil {
+		progressHook = &ProgressHook{Func: op.ProgressFunc}
+		hooks = append(hooks, progressHook)
+	}
+
+	// If we're pausing at breakpoints, setup the hook to do that
+	var breakpointHook *BreakpointHook
+	if len(op.Breakpoints) > 0 && op.OnBreakpoint != nil {
+		breakpointHook = &BreakpointHook{
+			Breakpoints: op.Breakpoints,
+			Func:        op.OnBreakpoint,
+		}
+		hooks = append(hooks, breakpointHook)
+	}
+
+	// If we're collecting metrics, setup the hook to report resources
+	if op.Metrics != nil {
+		hooks = append(hooks, &MetricsHook{Collector: op.Metrics})
+	}
+
+	// Add any hooks for just this operation
+	hooks = append(hooks, op.ExtraHooks...)
+
+	// A resource that any hook halts or fails in PreApply is never applied,
+	// so the parallelism is counted after all the others
+	hooks = append(hooks, parallelismHook)
+
+	// Stopping goes through a ContextStopper that stops whichever context
+	// is applying, since retries apply with a new one. As a hook it runs
+	// first so that no other hook sees a resource it halts.
+	stopper := new(ContextStopper)
+	hooks = append([]terraform.Hook{stopper}, hooks...)
+
+	// Verify the provider plugins are the ones we expect before using them
+	if err := b.checkProviderHashes(op.ExpectedProviderHashes); err != nil {
+		runningOp.Err = err
+		return
 	}
-	old := b.ContextOpts.Hooks
-	defer func() { b.ContextOpts.Hooks = old }()
-	b.ContextOpts.Hooks = append(b.ContextOpts.Hooks, countHook, stateHook)
 
 	// Get our context
-	tfCtx, opState, err := b.context(op)
+	tfCtx, opState, err := b.contextWithHooks(op, hooks)
 	if err != nil {
 		runningOp.Err = err
 		return
 	}
 
-	if op.LockState {
-		lockCtx, cancel := context.WithTimeout(ctx, op.StateLockTimeout)
+	// Applying to a state written by a newer Terraform can corrupt it
+	if s := opState.State(); s != nil && s.FromFutureTerraform() {
+		if op.StrictVersionCheck {
+			runningOp.Err = &FutureStateError{
+				StateVersion: s.TFVersion,
+				Version:      terraform.Version,
+			}
+			return
+		}
+
+		logWithContext(ctx, "[WARN] backend/local: state was written by Terraform %s, running %s",
+			s.TFVersion, terraform.Version)
+		msg := fmt.Sprintf(applyFutureStateWarning, s.TFVersion, terraform.Version)
+		runningOp.Warnings = append(runningOp.Warnings, msg)
+		if b.canOutput() {
+			b.applyError(b.applyColorize().Color("[reset][bold][yellow]Warning: " + msg))
+		}
+	}
+
+	// A sandbox apply is ephemeral, and reports what it did afterwards
+	ephemeral := op.Ephemeral || op.SandboxApply
+
+	// An ephemeral apply only updates an in-memory copy of the state that
+	// is discarded afterwards, so the real state is never locked or written.
+	if ephemeral {
+		inmem := new(state.InmemState)
+		if err := inmem.WriteState(opState.State().DeepCopy()); err != nil {
+			runningOp.Err = err
+			return
+		}
+		opState = inmem
+	}
+
+	// This is set if the apply is abandoned while it's still running
+	var abandonedCh <-chan struct{}
+	if op.LockState && !ephemeral {
+		lockCtx, cancel := context.WithTimeout(ctx, b.lockTimeout(op))
 		defer cancel()
 
 		lockInfo := state.NewLockInfo()
 		lockInfo.Operation = op.Type.String()
-		lockID, err := clistate.Lock(lockCtx, opState, lockInfo, b.CLI, b.Colorize())
+		lockInfo.Info = b.applyLockMetadata(ctx, op)
+		lockID, err := b.lockWithProgress(lockCtx, op, opState, lockInfo)
 		if err != nil {
 			runningOp.Err = errwrap.Wrapf("Error locking state: {{err}}", err)
 			return
 		}
 
+		if op.OnLockAcquired != nil {
+			op.OnLockAcquired(lockID)
+		}
+
 		defer func() {
-			if err := clistate.Unlock(opState, lockID, b.CLI, b.Colorize()); err != nil {
-				runningOp.Err = multierror.Append(runningOp.Err, err)
+			// An apply that didn't stop within the grace period is still
+			// running, so keep the state locked until it completes
+			if abandonedCh != nil {
+				go func() {
+					<-abandonedCh
+					if err := opState.Unlock(lockID); err != nil {
+						logWithContext(ctx, "[ERROR] backend/local: failed to unlock the state after the apply stopped: %s", err)
+					}
+				}()
+				return
+			}
+
+			// Keep an apply error as it is so that callers can still
+			// check for it, with the unlock error attached
+			if err := b.unlockState(opState, lockID); err != nil {
+				if applyErr, ok := runningOp.Err.(*ApplyError); ok {
+					applyErr.UnlockErr = err
+				} else {
+					runningOp.Err = multierror.Append(runningOp.Err, err)
+				}
 			}
 		}()
 	}
 
-	// Setup the state
+	// Even if we aren't locking the state, check nobody else has it locked
+	if !op.LockState && op.CheckLockEvenWhenUnlocked && !ephemeral {
+		if lockErr := checkStateUnlocked(ctx, opState); lockErr != nil {
+			if op.FailOnExistingLock {
+				runningOp.Err = lockErr
+				return
+			}
+
+			logWithContext(ctx, "[WARN] backend/local: state is locked by another operation: %s",
+				lockErr.Err)
+			runningOp.Warnings = append(runningOp.Warnings, fmt.Sprintf(
+				"State is locked by another operation, applying anyway: %s", lockErr.Err))
+		}
+	}
+
+	// A resume token only applies to the state it was written for
+	if resumeHook != nil {
+		if s := opState.State(); s != nil && resumeLineage != "" &&
+			s.Lineage != "" && s.Lineage != resumeLineage {
+			runningOp.Err = fmt.Errorf(
+				"Resume token %s is for a state with lineage %q, but the "+
+					"current state has lineage %q",
+				op.ResumeToken, resumeLineage, s.Lineage)
+			return
+		}
+	}
+
+	// Make sure a saved plan was made from the current state so that we
+	// don't apply it over changes made since
+	if op.Plan != nil && !op.AllowStalePlan {
+		if err := checkPlanState(op.Plan, opState.State()); err != nil {
+			runningOp.Err = err
+			return
+		}
+	}
+
+	// Record the serial of the state before we write anything to it
+	var priorLineage string
+	if s := opState.State(); s != nil {
+		runningOp.PriorSerial = s.Serial
+		priorLineage = s.Lineage
+	}
+
+	// Record how long each phase takes, logging them once we're done
+	phaseTimings := make(map[string]time.Duration)
+	runningOp.PhaseTimings = phaseTimings
+	defer logPhaseTimings(ctx, phaseTimings)
+
+	// Setup the state, keeping a copy of the prior state so that we can
+	// tell if anything changed.
+	priorState := tfCtx.State()
 	runningOp.State = tfCtx.State()
 
 	// If we weren't given a plan, then we refresh/plan
-	if op.Plan == nil {
+	plan := op.Plan
+	if plan == nil {
 		// If we're refreshing before apply, perform that
-		if op.PlanRefresh {
-			log.Printf("[INFO] backend/local: apply calling Refresh")
-			_, err := tfCtx.Refresh()
+		if op.PlanRefresh && b.DisableRefresh {
+			logWithContext(ctx, "[INFO] backend/local: refresh disabled on the backend, skipping")
+		} else if op.PlanRefresh {
+			refreshPrior := tfCtx.State()
+
+			logWithContext(ctx, "[INFO] backend/local: apply calling Refresh")
+			_, span := backend.StartSpan(ctx, "refresh")
+			refreshStart := time.Now()
+			refreshState, err := tfCtx.Refresh()
+			phaseTimings["refresh"] = time.Since(refreshStart)
+			endSpan(span, err)
 			if err != nil {
 				runningOp.Err = errwrap.Wrapf("Error refreshing state: {{err}}", err)
 				return
 			}
+
+			if b.canOutputInfo() && !op.JSONUI {
+				b.applyOutput(b.applyColorize().Color(fmt.Sprintf(
+					"[reset][bold]Refreshed %d resources.", countHook.Refreshed)))
+			}
+
+			// Report anything that changed outside of Terraform
+			if op.ReportDrift {
+				runningOp.DriftedResources = driftedResources(refreshPrior, refreshState)
+				b.outputDrift(ctx, op, runningOp.DriftedResources)
+			}
 		}
 
 		// Perform the plan
-		log.Printf("[INFO] backend/local: apply calling Plan")
-		if _, err := tfCtx.Plan(); err != nil {
+		logWithContext(ctx, "[INFO] backend/local: apply calling Plan")
+		_, span := backend.StartSpan(ctx, "plan")
+		planStart := time.Now()
+		plan, err = tfCtx.Plan()
+		phaseTimings["plan"] = time.Since(planStart)
+		endSpan(span, err)
+		if err != nil {
 			runningOp.Err = errwrap.Wrapf("Error running plan: {{err}}", err)
 			return
 		}
 	}
 
-	// Setup our hook for continuous state updates
-	stateHook.State = opState
+	// Describe the plan so that it can be approved out of band
+	if op.GeneratePlanApprovalToken {
+		token, err := planApprovalToken(plan, time.Now())
+		if err != nil {
+			runningOp.Err = err
+			return
+		}
+		runningOp.PlanApprovalToken = token
+	}
+
+	// If we only want the plan then save it and stop before applying
+	if op.PlanOnly {
+		logWithContext(ctx, "[INFO] backend/local: apply stopping after Plan")
+		runningOp.PlanEmpty = plan.Diff.Empty()
+		if err := writePlan(op, op.PlanOutPath, plan); err != nil {
+			runningOp.Err = err
+		}
+		return
+	}
+
+	// Only apply the plan that was approved, if one was
+	if op.ApprovedPlanHash != "" {
+		if hash := PlanHash(plan); hash != op.ApprovedPlanHash {
+			runningOp.Err = &UnapprovedPlanError{
+				Approved: op.ApprovedPlanHash,
+				Actual:   hash,
+			}
+			return
+		}
+	}
+
+	// Let the caller check the plan before it's applied
+	if op.PrePlanApply != nil {
+		if err := op.PrePlanApply(plan); err != nil {
+			runningOp.Err = errwrap.Wrapf("Plan rejected: {{err}}", err)
+			return
+		}
+	}
+
+	// Estimate the cost of the plan before it's applied
+	if op.CostEstimate != nil {
+		estimate, err := op.CostEstimate(plan)
+		if err != nil {
+			runningOp.Err = errwrap.Wrapf("Error estimating cost: {{err}}", err)
+			return
+		}
+
+		if b.canOutputInfo() && !op.JSONUI && estimate != "" {
+			b.applyOutput(b.applyColorize().Color(estimate))
+		}
+	}
+
+	// Give the caller a last chance to cancel a destroy before it starts
+	if op.Destroy && op.DestroyConfirm != nil {
+		if err := op.DestroyConfirm(tfCtx.State()); err != nil {
+			runningOp.Err = errwrap.Wrapf("Destroy cancelled: {{err}}", err)
+			return
+		}
+	}
+
+	// Check that we aren't destroying more than expected
+	if op.DestroyWarnThreshold > 0 {
+		h := countDiff(plan.Diff)
+		if count := h.ToRemove + h.ToRemoveAndAdd; count > op.DestroyWarnThreshold {
+			logWithContext(ctx, "[WARN] backend/local: plan destroys %d resources, more than the threshold of %d",
+				count, op.DestroyWarnThreshold)
+			runningOp.Warnings = append(runningOp.Warnings, fmt.Sprintf(
+				"The plan destroys %d resources, more than the threshold of %d",
+				count, op.DestroyWarnThreshold))
+
+			if op.DestroyGate != nil {
+				if err := op.DestroyGate(count); err != nil {
+					runningOp.Err = errwrap.Wrapf("Destroy cancelled: {{err}}", err)
+					return
+				}
+			}
+		}
+	}
+
+	// We didn't plan so summarize the saved plan instead to show what is
+	// about to change
+	if op.Plan != nil && b.canOutputInfo() && !op.JSONUI {
+		h := countDiff(plan.Diff)
+		b.applyOutput(b.applyColorize().Color(fmt.Sprintf(
+			"[reset][bold]Applying saved plan:[reset] "+
+				"%d to add, %d to change, %d to destroy.",
+			h.ToAdd+h.ToRemoveAndAdd,
+			h.ToChange,
+			h.ToRemove+h.ToRemoveAndAdd)))
+	}
+
+	// Make sure nobody else wrote the state while we were planning, since
+	// we'd overwrite their changes
+	if !op.IgnoreConcurrentChanges && !ephemeral {
+		if err := opState.RefreshState(); err != nil {
+			runningOp.Err = errwrap.Wrapf("Error loading state: {{err}}", err)
+			return
+		}
+
+		if s := opState.State(); s != nil &&
+			(s.Serial != runningOp.PriorSerial || s.Lineage != priorLineage) {
+			runningOp.Err = &ConcurrentModificationError{
+				PlannedSerial: runningOp.PriorSerial,
+				CurrentSerial: s.Serial,
+			}
+			return
+		}
+	}
+
+	// Setup our hook for continuous state updates. If we're simulating a
+	// state write error or skipping persistence then we never write to the
+	// real state.
+	if !op.SimulateStateWriteError && !op.SkipStatePersist {
+		stateHook.State = opState
+		stateHook.PersistInterval = op.StatePersistInterval
+	}
+	if stopOnErrorHook != nil {
+		stopOnErrorHook.Stop = stopper.Stop
+	}
+	if breakpointHook != nil {
+		breakpointHook.State = tfCtx.State()
+		breakpointHook.Stop = stopper.Stop
+	}
+	if progressHook != nil {
+		progressHook.Total = countPlannedResources(plan.Diff)
+
+		// With nothing to apply we're already done
+		if progressHook.Total == 0 {
+			op.ProgressFunc(0, 0)
+		}
+	}
+
+	// The diff is modified as it's applied, so keep a copy of it if we
+	// need to know what wasn't applied
+	var plannedDiff *terraform.Diff
+	if (op.RemainingPlanPath != "" || op.ResourceRetries > 0 || op.SandboxApply) &&
+		plan.Diff != nil {
+		plannedDiff = plan.Diff.DeepCopy()
+	}
+
+	// Remember what's planned to be added to catch anything else that is
+	plannedAdds := plannedAdditions(plan.Diff)
+
+	// Remember which attributes are sensitive so their values are hidden
+	// when showing what the apply changed
+	sensitive := sensitiveAttributes(plan.Diff)
+
+	// Snapshot the state before applying for the audit log and history
+	applyTime := time.Now()
+	stateBeforeApply := tfCtx.State()
+	writeAuditSnapshot(ctx, op, applyTime, "before", tfCtx.State())
+	if !ephemeral && !op.SkipStatePersist {
+		b.writeStateHistory(ctx, applyTime, tfCtx.State())
+	}
 
 	// Start the apply in a goroutine so that we can be interrupted.
 	var applyState *terraform.State
 	var applyErr error
+	var shadowErr *multierror.Error
 	doneCh := make(chan struct{})
+	stopper.Run(tfCtx)
 	go func() {
 		defer close(doneCh)
+		_, span := backend.StartSpan(ctx, "apply")
 		_, applyErr = tfCtx.Apply()
+		endSpan(span, applyErr)
 		// we always want the state, even if apply failed
 		applyState = tfCtx.State()
 
-		/*
-			// Record any shadow errors for later
-			if err := ctx.ShadowError(); err != nil {
+		// Record any shadow errors for later
+		if b.RecordShadowErrors {
+			if err := shadowError(tfCtx); err != nil {
 				shadowErr = multierror.Append(shadowErr, multierror.Prefix(
 					err, "apply operation:"))
 			}
-		*/
+		}
+
+		// Retry any resources that failed with a retryable error, unless
+		// we were interrupted or asked to stop on the first error. This
+		// runs here so that stopping the apply stops the retries too.
+		if applyErr != nil && op.ResourceRetries > 0 && op.RetryableError != nil &&
+			ctx.Err() == nil && (stopOnErrorHook == nil || !stopOnErrorHook.Stopped()) {
+			applyState, applyErr = b.retryResources(ctx, op, hooks, stopper,
+				plan, plannedDiff, countHook, resultsHook, applyState, applyErr)
+		}
 	}()
 
 	// Wait for the apply to finish or for us to be interrupted so
 	// we can handle it properly.
 	err = nil
+	deadlineExceeded := false
 	select {
 	case <-ctx.Done():
-		if b.CLI != nil {
-			b.CLI.Output("stopping apply operation...")
+		runningOp.CancelReason = cancelReason(parentCtx, ctx)
+		deadlineExceeded = runningOp.CancelReason == backend.CancelReasonMaxDuration
+		if deadlineExceeded {
+			logWithContext(ctx, "[WARN] backend/local: apply exceeded its maximum duration of %s",
+				op.MaxDuration)
+		}
+
+		// Once we're done, record what was completed so that applying
+		// again can resume from here
+		defer b.writeResumeToken(ctx, op, opState, countHook, resumeHook)
+
+		if msg := b.applyStoppingMessage(); b.canOutput() && msg != "" {
+			b.applyOutput(b.applyColorize().Color(msg))
+		}
+
+		// Let the hooks that want to know that we're stopping
+		for _, h := range hooks {
+			if h, ok := h.(StoppingHook); ok {
+				h.Stopping()
+			}
+		}
+
+		// Stop execution, keeping any errors the providers and
+		// provisioners return so we can warn about them
+		stopErrCh := make(chan error, 1)
+		go func() {
+			stopper.Stop()
+			stopErrCh <- stopper.StopError()
+		}()
+
+		// Wait for completion still, unless we have a grace period and
+		// it takes longer than that
+		var timeoutCh <-chan time.Time
+		if op.StopGracePeriod > 0 {
+			timer := time.NewTimer(op.StopGracePeriod)
+			defer timer.Stop()
+			timeoutCh = timer.C
 		}
 
-		// Stop execution
-		go tfCtx.Stop()
+		select {
+		case <-doneCh:
+			// Stop returns as soon as the apply has completed
+			if err := <-stopErrCh; err != nil {
+				errs := []error{err}
+				if merr, ok := err.(*multierror.Error); ok {
+					errs = merr.Errors
+				}
+				for _, err := range errs {
+					logWithContext(ctx, "[WARN] backend/local: failed to stop %s", err)
+					runningOp.Warnings = append(runningOp.Warnings, fmt.Sprintf(
+						"Failed to stop %s", err))
+				}
+			}
+		case <-timeoutCh:
+			logWithContext(ctx, "[ERROR] backend/local: apply didn't stop within %s",
+				op.StopGracePeriod)
+			runningOp.Err = fmt.Errorf(
+				strings.TrimSpace(applyForcedTermination), op.StopGracePeriod)
+			abandonedCh = doneCh
 
-		// Wait for completion still
-		<-doneCh
+			// Persist whatever state we have so far. The apply is still
+			// running so detach it from the state first.
+			if err := stateHook.PersistAndDetach(); err != nil {
+				runningOp.Err = multierror.Append(runningOp.Err,
+					b.backupStateForError(ctx, opState.State(), err))
+			}
+			runningOp.State = opState.State()
+			runningOp.ResourceResults = resultsHook.Results()
+			runningOp.ProvisionerOutput = provisionerOutputHook.Output()
+			if op.Destroy {
+				runningOp.FailedDestroys = failedResources(runningOp.ResourceResults)
+			}
+			return
+		}
 	case <-doneCh:
 	}
 
-	// Store the final state
+	phaseTimings["apply"] = time.Since(applyTime)
+
+	// Store the final state and the outcome for each resource
 	runningOp.State = applyState
+	runningOp.ResourceResults = resultsHook.Results()
+	runningOp.ProvisionerOutput = provisionerOutputHook.Output()
+	if op.Destroy {
+		runningOp.FailedDestroys = failedResources(runningOp.ResourceResults)
+	}
 
-	// Persist the state
-	if err := opState.WriteState(applyState); err != nil {
-		runningOp.Err = fmt.Errorf("Failed to save state: %s", err)
-		return
+	if op.Metrics != nil {
+		op.Metrics.ApplyFinished(countHook.Added, countHook.Changed,
+			countHook.Removed, time.Since(applyTime))
+	}
+
+	// Demote any resource errors that the operation says aren't fatal to
+	// warnings. What was applied is still persisted below either way.
+	if applyErr != nil && op.NonFatalResourceErrors != nil {
+		var warnings []string
+		applyErr, warnings = demoteResourceErrors(applyErr,
+			resultsHook.Results(), resultsHook.Addresses(), op.NonFatalResourceErrors)
+		for _, w := range warnings {
+			logWithContext(ctx, "[WARN] backend/local: %s", w)
+		}
+		runningOp.Warnings = append(runningOp.Warnings, warnings...)
+	}
+
+	// Shadow errors never affect the real apply so they're only warnings
+	if shadowErr != nil {
+		for _, err := range shadowErr.Errors {
+			runningOp.Warnings = append(runningOp.Warnings, err.Error())
+		}
+	}
+	writeAuditSnapshot(ctx, op, applyTime, "after", applyState)
+
+	// Log the slowest resources to help with performance debugging
+	logSlowestResources(ctx, countHook.Durations(), applySlowestResourcesCount)
+
+	// Report how many resources were applied concurrently so that the
+	// parallelism can be tuned
+	runningOp.PeakParallelism = parallelismHook.Peak()
+	logWithContext(ctx, "[INFO] backend/local: peak apply parallelism: %d",
+		runningOp.PeakParallelism)
+
+	// Catch providers adding resources that weren't planned
+	if unexpected := unexpectedResources(plannedAdds, countHook); len(unexpected) > 0 {
+		runningOp.UnexpectedResources = unexpected
+		logWithContext(ctx, "[WARN] backend/local: unplanned resources added: %s",
+			strings.Join(unexpected, ", "))
+		runningOp.Warnings = append(runningOp.Warnings, fmt.Sprintf(
+			"%d resource(s) were added that weren't in the plan: %s",
+			len(unexpected), strings.Join(unexpected, ", ")))
+	}
+
+	// Persist the state, unless it's discarded after the apply anyway
+	if ephemeral {
+		logWithContext(ctx, "[INFO] backend/local: ephemeral apply, not persisting state")
+
+		if op.SandboxApply {
+			runningOp.Sandbox = &backend.SandboxResult{
+				Diff:    plannedDiff,
+				Added:   countHook.Added,
+				Changed: countHook.Changed,
+				Removed: countHook.Removed,
+			}
+		}
+	} else if op.SkipStatePersist {
+		logWithContext(ctx, "[INFO] backend/local: skipping state persistence")
+	} else {
+		// Record where the state came from before persisting it. This is
+		// only done if the apply changed anything, since otherwise a new
+		// provenance would rewrite the state on every run.
+		if applyState != nil && stateChanged(op, priorState, applyState) {
+			applyState.Provenance = &terraform.ProvenanceState{
+				Meta:      op.Meta,
+				Time:      applyTime.UTC().Format(time.RFC3339),
+				TFVersion: terraform.Version,
+			}
+		}
+
+		// Let the caller rewrite the state before it's persisted
+		if op.StateTransform != nil {
+			transformed, err := op.StateTransform(applyState)
+			if err != nil {
+				runningOp.Err = b.backupStateForError(ctx, applyState,
+					errwrap.Wrapf("Error transforming state: {{err}}", err))
+				b.outputApplyJSON(ctx, op, countHook, filterHook, false)
+				return
+			}
+
+			applyState = transformed
+			runningOp.State = applyState
+		}
+
+		persistStart := time.Now()
+		err := persistState(ctx, op, opState, applyState)
+		phaseTimings["persist"] = time.Since(persistStart)
+		if err != nil {
+			runningOp.Err = b.backupStateForError(ctx, applyState, err)
+			b.outputApplyJSON(ctx, op, countHook, filterHook, false)
+			return
+		}
+
+		runningOp.StateChanged = stateChanged(op, priorState, applyState)
+	}
+
+	// Writing the state increments its serial if anything changed
+	if applyState != nil {
+		runningOp.NewSerial = applyState.Serial
+	}
+	logWithContext(ctx, "[INFO] backend/local: state serial before apply: %d, after: %d",
+		runningOp.PriorSerial, runningOp.NewSerial)
+
+	// Write the state for piping to other tools if asked to
+	if op.WriteStateToStdout && applyState != nil {
+		w := op.StateStdout
+		if w == nil {
+			w = os.Stdout
+		}
+
+		if err := terraform.WriteState(applyState, w); err != nil {
+			logWithContext(ctx, "[WARN] backend/local: failed to write state to stdout: %s", err)
+			runningOp.Warnings = append(runningOp.Warnings,
+				fmt.Sprintf("Failed to write state to stdout: %s", err))
+		}
+	}
+
+	// Sign the state that was persisted so tampering can be detected
+	if op.StateSigner != nil && applyState != nil && !ephemeral && !op.SkipStatePersist {
+		b.signState(ctx, op, runningOp, applyState)
 	}
-	if err := opState.PersistState(); err != nil {
-		runningOp.Err = fmt.Errorf("Failed to save state: %s", err)
+
+	// Mirror the state to the secondary state once the primary state is
+	// persisted. This is only a backup so failing to do so never fails the
+	// apply.
+	if s := op.SecondaryState; s != nil && applyState != nil && !ephemeral && !op.SkipStatePersist {
+		err := s.WriteState(applyState)
+		if err == nil {
+			err = s.PersistState()
+		}
+		if err != nil {
+			logWithContext(ctx, "[WARN] backend/local: failed to persist secondary state: %s", err)
+			runningOp.Warnings = append(runningOp.Warnings,
+				fmt.Sprintf("Failed to persist secondary state: %s", err))
+		}
+	}
+
+	// Reaching the deadline fails the apply even though what was applied
+	// before it was reached has been saved
+	if deadlineExceeded {
+		b.outputApplyJSON(ctx, op, countHook, filterHook, false)
+		runningOp.Err = &DeadlineExceededError{MaxDuration: op.MaxDuration}
 		return
 	}
 
 	if applyErr != nil {
-		runningOp.Err = fmt.Errorf(
-			"Error applying plan:\n\n"+
-				"%s\n\n"+
-				"Terraform does not automatically rollback in the face of errors.\n"+
-				"Instead, your Terraform state file has been partially updated with\n"+
-				"any resources that successfully completed. Please address the error\n"+
-				"above and apply again to incrementally change your infrastructure.",
-			multierror.Flatten(applyErr))
+		// Save what is left to apply so that the apply can be resumed
+		if op.RemainingPlanPath != "" {
+			remaining := &terraform.Plan{
+				Diff:    remainingDiff(plannedDiff, countHook.Applied()),
+				Module:  plan.Module,
+				State:   applyState,
+				Vars:    plan.Vars,
+				Targets: plan.Targets,
+			}
+			err := writePlan(op, op.RemainingPlanPath, remaining)
+			if err != nil {
+				logWithContext(ctx, "[WARN] backend/local: %s", err)
+				runningOp.Warnings = append(runningOp.Warnings, fmt.Sprintf(
+					"Failed to save the remaining plan: %s", err))
+			}
+		}
+
+		b.outputApplyJSON(ctx, op, countHook, filterHook, false)
+		runningOp.Err = &ApplyError{Err: applyErr, Terse: b.TerseErrors}
+
+		// Now that the partial state is persisted, let the caller react
+		if op.OnApplyFailure != nil {
+			op.OnApplyFailure(applyState, runningOp.Err)
+		}
 		return
 	}
 
-	// If we have a UI, output the results
-	if b.CLI != nil {
-		if op.Destroy {
-			b.CLI.Output(b.Colorize().Color(fmt.Sprintf(
-				"[reset][bold][green]\n"+
-					"Destroy complete! Resources: %d destroyed.",
-				countHook.Removed)))
-		} else {
-			b.CLI.Output(b.Colorize().Color(fmt.Sprintf(
-				"[reset][bold][green]\n"+
-					"Apply complete! Resources: %d added, %d changed, %d destroyed.",
-				countHook.Added,
-				countHook.Changed,
-				countHook.Removed)))
+	// Verify the final state now that it's safely persisted
+	if op.PostApplyVerify != nil {
+		if err := op.PostApplyVerify(applyState); err != nil {
+			b.outputApplyJSON(ctx, op, countHook, filterHook, false)
+			runningOp.Err = &VerificationError{Err: err}
+			return
 		}
+	}
 
-		if countHook.Added > 0 || countHook.Changed > 0 {
-			b.CLI.Output(b.Colorize().Color(fmt.Sprintf(
-				"[reset]\n"+
-					"The state of your infrastructure has been saved to the path\n"+
-					"below. This state is required to modify and destroy your\n"+
-					"infrastructure, so keep it safe. To inspect the complete state\n"+
-					"use the `terraform show` command.\n\n"+
-					"State path: %s",
-				b.StateOutPath)))
+	// If we require the apply to be idempotent then it shouldn't have
+	// changed anything
+	if op.RequireIdempotent &&
+		(countHook.Added > 0 || countHook.Changed > 0 || countHook.Removed > 0) {
+		b.outputApplyJSON(ctx, op, countHook, filterHook, false)
+		runningOp.Err = &NonIdempotentError{
+			Added:   countHook.Added,
+			Changed: countHook.Changed,
+			Removed: countHook.Removed,
 		}
+		return
 	}
-}
-
-const applyErrNoConfig = `
-No configuration files found!
+
+	// A destroy of an empty state usually means the wrong state was
+	// selected, so fail if asked to rather than silently doing nothing
+	if op.Destroy && op.ErrorOnEmptyDestroy &&
+		countHook.Removed == 0 && !priorState.HasResources() {
+		b.outputApplyJSON(ctx, op, countHook, filterHook, false)
+		runningOp.Err = &EmptyDestroyError{Environment: op.Environment}
+		return
+	}
+
+	// If we're outputting JSON, that replaces the human-readable summary,
+	// but JSON written to its own stream doesn't
+	b.outputApplyJSON(ctx, op, countHook, filterHook, true)
+	if op.JSONUI {
+		return
+	}
+
+	// If we have a UI, output the results
+	if b.canOutputInfo() {
+		// Even if no resources changed, a refresh may have updated the state
+		changed := stateChanged(op, priorState, applyState)
+
+		// A change detector decides whether anything changed rather than
+		// the counts, since it may ignore changes to some resources
+		deferred := len(filterHook.Deferred())
+		noChanges := countHook.Added == 0 && countHook.Changed == 0 &&
+			countHook.Removed == 0 && deferred == 0
+		if op.ChangeDetector != nil {
+			noChanges = !changed && deferred == 0
+		}
+
+		deferredSuffix := ""
+		if deferred > 0 {
+			deferredSuffix = fmt.Sprintf(", %d deferred", deferred)
+		}
+
+		summary := &ApplySummary{
+			Added:         countHook.Added,
+			Changed:       countHook.Changed,
+			Removed:       countHook.Removed,
+			Deferred:      deferred,
+			RemovedByType: countHook.RemovedByType(),
+		}
+
+		if op.Destroy {
+			b.applyOutput(b.applyColorize().Color(successMessage(
+				ctx,
+				b.DestroySuccessTemplate,
+				fmt.Sprintf(
+					"[reset][bold][green]\n"+
+						"Destroy complete! Resources: %d destroyed%s%s.",
+					countHook.Removed,
+					formatRemovedByType(summary.RemovedByType),
+					deferredSuffix),
+				summary)))
+		} else if noChanges {
+			b.applyOutput(b.applyColorize().Color(strings.TrimSpace(applyNoChanges)))
+		} else {
+			b.applyOutput(b.applyColorize().Color(successMessage(
+				ctx,
+				b.ApplySuccessTemplate,
+				fmt.Sprintf(
+					"[reset][bold][green]\n"+
+						"Apply complete! Resources: %d added, %d changed, %d destroyed%s.",
+					countHook.Added,
+					countHook.Changed,
+					countHook.Removed,
+					deferredSuffix),
+				summary)))
+		}
+
+		if !ephemeral && !op.SkipStatePersist && (countHook.Added > 0 || countHook.Changed > 0 || changed) {
+			if msg := b.statePathMessage(ctx, op); msg != "" {
+				b.applyOutput(b.applyColorize().Color(msg))
+			}
+		}
+
+		if op.ShowPostApplyDiff {
+			if diff := stateAttributeDiff(stateBeforeApply, applyState, sensitive); diff != "" {
+				b.applyOutput(b.applyColorize().Color(diff))
+			}
+		}
+
+		if op.SandboxApply {
+			b.applyOutput(b.applyColorize().Color(applySandboxDiscarded))
+		}
+	}
+}
+
+// preflight checks that the state for the operation can be read from the
+// backend, returning a BackendUnavailableError if it can't.
+func (b *Local) preflight(ctx context.Context, op *backend.Operation) error {
+	s, err := b.State(op.Environment)
+	if err == nil {
+		err = s.RefreshState()
+	}
+	if err != nil {
+		logWithContext(ctx, "[ERROR] backend/local: preflight failed to read the state: %s", err)
+		return &BackendUnavailableError{Err: err}
+	}
+
+	return nil
+}
+
+// checkProviderHashes verifies that the plugin binary of each provider
+// has the expected SHA-256 checksum, returning a ProviderChecksumError for
+// the first, by name, that doesn't.
+func (b *Local) checkProviderHashes(expected map[string]string) error {
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The paths come from the same discovery that the provider factories
+	// were built from, so they're the binaries that are actually run
+	var paths map[string]string
+	if b.ContextOpts != nil {
+		paths = b.ContextOpts.ProviderPaths
+	}
+
+	for _, name := range names {
+		path, ok := paths[name]
+		if !ok {
+			return &ProviderChecksumError{
+				Provider: name,
+				Expected: expected[name],
+			}
+		}
+
+		actual, err := fileSHA256(path)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf(
+				"Error verifying provider %q: {{err}}", name), err)
+		}
+		if actual != expected[name] {
+			return &ProviderChecksumError{
+				Provider: name,
+				Path:     path,
+				Expected: expected[name],
+				Actual:   actual,
+			}
+		}
+	}
+
+	return nil
+}
+
+// fileSHA256 returns the lowercase hex SHA-256 checksum of the file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stateChanged returns whether the apply changed the state, as decided by
+// Operation.ChangeDetector if there is one.
+func stateChanged(op *backend.Operation, before, after *terraform.State) bool {
+	if op.ChangeDetector != nil {
+		return op.ChangeDetector(before, after)
+	}
+
+	return !after.Equal(before)
+}
+
+// failedResources returns the sorted addresses of the resources that
+// failed to apply.
+func failedResources(results map[string]error) []string {
+	var result []string
+	for addr, err := range results {
+		if err != nil {
+			result = append(result, addr)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// demoteResourceErrors removes the resource errors for which nonFatal
+// returns true from the apply error, returning them as warnings instead.
+// The returned error is nil if every error was demoted. The addrs are the
+// graph addresses of the resources in results, as from
+// ResultsHook.Addresses.
+func demoteResourceErrors(
+	applyErr error,
+	results map[string]error,
+	addrs map[string]string,
+	nonFatal func(addr string, err error) bool) (error, []string) {
+	keys := make([]string, 0, len(results))
+	for addr := range results {
+		keys = append(keys, addr)
+	}
+	sort.Strings(keys)
+
+	// The apply error has an error for each graph node that failed,
+	// prefixed with the node's name, so we match them up by the address
+	demoted := make(map[string]bool)
+	var warnings []string
+	for _, addr := range keys {
+		err := results[addr]
+		if err == nil || !nonFatal(addr, err) {
+			continue
+		}
+
+		demoted[addrs[addr]] = true
+		warnings = append(warnings, fmt.Sprintf(
+			"Ignored error applying %s: %s", addr, multierror.Flatten(err)))
+	}
+	if len(demoted) == 0 {
+		return applyErr, nil
+	}
+
+	var result *multierror.Error
+	for _, e := range flattenErrors(applyErr) {
+		if !demoted[errorNodeAddress(e)] {
+			result = multierror.Append(result, e)
+		}
+	}
+
+	return result.ErrorOrNil(), warnings
+}
+
+// errorNodeAddress returns the address of the resource that an error from
+// walking the apply graph is for, or an empty string if it isn't for one.
+// The errors are prefixed with the name of the graph node, which is the
+// address of the resource with a suffix for destroy nodes.
+func errorNodeAddress(err error) string {
+	msg := err.Error()
+	i := strings.Index(msg, ": ")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.TrimSuffix(msg[:i], " (destroy)")
+}
+
+// cancelReason returns why ctx, derived from parent with the apply's
+// maximum duration, was cancelled.
+func cancelReason(parent, ctx context.Context) backend.CancelReason {
+	switch {
+	case parent.Err() == context.DeadlineExceeded:
+		return backend.CancelReasonDeadline
+	case parent.Err() != nil:
+		return backend.CancelReasonCanceled
+	case ctx.Err() == context.DeadlineExceeded:
+		return backend.CancelReasonMaxDuration
+	default:
+		return backend.CancelReasonCanceled
+	}
+}
+
+// retryResources applies the resources that failed with an error for
+// which op.RetryableError returns true again, up to op.ResourceRetries
+// times, returning the resulting state and error. Each retry is applied
+// through stopper so that stopping the apply stops it.
+func (b *Local) retryResources(
+	ctx context.Context,
+	op *backend.Operation,
+	hooks []terraform.Hook,
+	stopper *ContextStopper,
+	plan *terraform.Plan,
+	plannedDiff *terraform.Diff,
+	countHook *CountHook,
+	resultsHook *ResultsHook,
+	applyState *terraform.State,
+	applyErr error) (*terraform.State, error) {
+	for attempt := 1; attempt <= op.ResourceRetries; attempt++ {
+		targets := retryTargets(
+			plannedDiff, countHook.Applied(), resultsHook.Results(), op.RetryableError)
+		if len(targets) == 0 || ctx.Err() != nil {
+			break
+		}
+
+		logWithContext(ctx, "[INFO] backend/local: retrying %s (attempt %d of %d)",
+			strings.Join(targets, ", "), attempt, op.ResourceRetries)
+		tfCtx, err := b.retryContext(op, hooks, plan, applyState, targets)
+		if err != nil {
+			return applyState, multierror.Append(applyErr, errwrap.Wrapf(
+				"Error planning retry: {{err}}", err))
+		}
+
+		if !stopper.Run(tfCtx) {
+			break
+		}
+
+		_, err = tfCtx.Apply()
+		applyState = tfCtx.State()
+
+		// A retry that was stopped before it could fail leaves the
+		// resources it skipped failed with the earlier error
+		if err == nil && stopper.Stopped() {
+			break
+		}
+		applyErr = err
+		if applyErr == nil {
+			break
+		}
+	}
+
+	return applyState, applyErr
+}
+
+// retryTargets returns the targets of the resources in the diff to retry.
+// Every resource that wasn't applied must have failed with an error for
+// which retryable returns true, otherwise nothing is retried since the
+// resources left include some that depend on others that failed.
+func retryTargets(
+	d *terraform.Diff,
+	applied map[string]bool,
+	results map[string]error,
+	retryable func(error) bool) []string {
+	var targets []string
+	for _, m := range remainingDiff(d, applied).Modules {
+		for k := range m.Resources {
+			info := &terraform.InstanceInfo{Id: k, ModulePath: m.Path}
+			if err := results[info.HumanId()]; err == nil || !retryable(err) {
+				return nil
+			}
+
+			targets = append(targets, retryTarget(m.Path, k))
+		}
+	}
+
+	sort.Strings(targets)
+	return targets
+}
+
+// retryTarget returns the target address of the resource with the given
+// key in the state of the module at path.
+func retryTarget(path []string, key string) string {
+	var buf bytes.Buffer
+	for _, name := range path[1:] {
+		buf.WriteString(fmt.Sprintf("module.%s.", name))
+	}
+
+	// Targets use the index syntax for resources with a count
+	parts := strings.Split(key, ".")
+	if n := len(parts); n > 2 {
+		if _, err := strconv.Atoi(parts[n-1]); err == nil {
+			key = fmt.Sprintf("%s[%s]", strings.Join(parts[:n-1], "."), parts[n-1])
+		}
+	}
+	buf.WriteString(key)
+
+	return buf.String()
+}
+
+// retryContext returns a context to apply the targeted resources again,
+// planned from the given state.
+func (b *Local) retryContext(
+	op *backend.Operation,
+	hooks []terraform.Hook,
+	plan *terraform.Plan,
+	s *terraform.State,
+	targets []string) (*terraform.Context, error) {
+	var opts terraform.ContextOpts
+	if v := b.ContextOpts; v != nil {
+		opts = *v
+	}
+	opts.Destroy = op.Destroy
+	opts.Module = plan.Module
+	opts.Variables = plan.Vars
+	opts.UIInput = op.UIIn
+	opts.State = s
+	opts.Targets = targets
+
+	// Plan without the hooks so they only see the resources applied again
+	opts.Hooks = nil
+	planCtx, err := terraform.NewContext(&opts)
+	if err != nil {
+		return nil, err
+	}
+	retryPlan, err := planCtx.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Hooks = hooks
+	return retryPlan.Context(&opts)
+}
+
+// flattenErrors returns the individual errors within err.
+func flattenErrors(err error) []error {
+	if merr, ok := multierror.Flatten(err).(*multierror.Error); ok {
+		return merr.Errors
+	}
+
+	return []error{err}
+}
+
+// opStateOutPath returns the path the state is reported as written to for
+// the operation: op.StateOutPath if it is set, otherwise b.StateOutPath.
+func (b *Local) opStateOutPath(op *backend.Operation) string {
+	if op.StateOutPath != "" {
+		return op.StateOutPath
+	}
+
+	return b.StateOutPath
+}
+
+// checkPlanState returns a StalePlanError if the plan wasn't made from the
+// current state: either it is from a different lineage or the current
+// state has been written since.
+func checkPlanState(plan *terraform.Plan, current *terraform.State) error {
+	if plan.State == nil || current == nil {
+		return nil
+	}
+
+	if plan.State.SameLineage(current) && current.Serial <= plan.State.Serial {
+		return nil
+	}
+
+	return &StalePlanError{
+		PlanLineage:  plan.State.Lineage,
+		PlanSerial:   plan.State.Serial,
+		StateLineage: current.Lineage,
+		StateSerial:  current.Serial,
+	}
+}
+
+// driftedResources returns the sorted addresses of the managed resources
+// that differ between the state before and after a refresh.
+func driftedResources(before, after *terraform.State) []string {
+	beforeResources := stateResources(before)
+	afterResources := stateResources(after)
+
+	var result []string
+	for addr, r := range beforeResources {
+		if other, ok := afterResources[addr]; !ok || !r.Equal(other) {
+			result = append(result, addr)
+		}
+	}
+	for addr := range afterResources {
+		if _, ok := beforeResources[addr]; !ok {
+			result = append(result, addr)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// stateResources returns the managed resources in the state keyed by
+// their address.
+func stateResources(s *terraform.State) map[string]*terraform.ResourceState {
+	result := make(map[string]*terraform.ResourceState)
+	if s == nil {
+		return result
+	}
+
+	for _, m := range s.Modules {
+		for k, r := range m.Resources {
+			// Data sources are always read during refresh so they never drift
+			if strings.HasPrefix(k, "data.") {
+				continue
+			}
+
+			info := &terraform.InstanceInfo{Id: k, ModulePath: m.Path}
+			result[info.HumanId()] = r
+		}
+	}
+
+	return result
+}
+
+// stateAttributeDiff returns a human-readable description of the
+// attributes of each managed resource that differ between the state before
+// and after an apply, or an empty string if none differ. The values of the
+// sensitive attributes, keyed by resource address, are hidden.
+func stateAttributeDiff(before, after *terraform.State, sensitive map[string]map[string]bool) string {
+	beforeResources := stateResources(before)
+	afterResources := stateResources(after)
+
+	addrs := make(map[string]bool)
+	for addr := range beforeResources {
+		addrs[addr] = true
+	}
+	for addr := range afterResources {
+		addrs[addr] = true
+	}
+	sorted := make([]string, 0, len(addrs))
+	for addr := range addrs {
+		sorted = append(sorted, addr)
+	}
+	sort.Strings(sorted)
+
+	var buf bytes.Buffer
+	for _, addr := range sorted {
+		prior, priorOk := beforeResources[addr]
+		current, currentOk := afterResources[addr]
+		oldAttrs := resourceAttributes(prior)
+		newAttrs := resourceAttributes(current)
+
+		switch {
+		case !currentOk:
+			buf.WriteString(fmt.Sprintf("[red]  - %s[reset]\n", addr))
+			continue
+		case !priorOk:
+			buf.WriteString(fmt.Sprintf("[green]  + %s[reset]\n", addr))
+		case reflect.DeepEqual(oldAttrs, newAttrs):
+			continue
+		default:
+			buf.WriteString(fmt.Sprintf("[yellow]  ~ %s[reset]\n", addr))
+		}
+
+		keys := make([]string, 0, len(oldAttrs)+len(newAttrs))
+		for k := range oldAttrs {
+			keys = append(keys, k)
+		}
+		for k := range newAttrs {
+			if _, ok := oldAttrs[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			oldV, oldOk := oldAttrs[k]
+			newV, newOk := newAttrs[k]
+			if oldOk && newOk && oldV == newV {
+				continue
+			}
+
+			oldV, newV = strconv.Quote(oldV), strconv.Quote(newV)
+			if sensitive[addr][k] {
+				oldV, newV = "<sensitive>", "<sensitive>"
+			}
+
+			switch {
+			case !oldOk:
+				buf.WriteString(fmt.Sprintf("      %s: %s\n", k, newV))
+			case !newOk:
+				buf.WriteString(fmt.Sprintf("      %s: %s => <removed>\n", k, oldV))
+			default:
+				buf.WriteString(fmt.Sprintf("      %s: %s => %s\n", k, oldV, newV))
+			}
+		}
+	}
+
+	if buf.Len() == 0 {
+		return ""
+	}
+
+	return "[reset][bold]\nChanges to the state:[reset]\n\n" + buf.String()
+}
+
+// sensitiveAttributes returns the keys of the sensitive attributes in the
+// diff, keyed by resource address.
+func sensitiveAttributes(d *terraform.Diff) map[string]map[string]bool {
+	result := make(map[string]map[string]bool)
+	if d == nil {
+		return result
+	}
+
+	for _, m := range d.Modules {
+		for k, rd := range m.Resources {
+			for attr, ad := range rd.CopyAttributes() {
+				if !ad.Sensitive {
+					continue
+				}
+
+				addr := (&terraform.InstanceInfo{Id: k, ModulePath: m.Path}).HumanId()
+				if result[addr] == nil {
+					result[addr] = make(map[string]bool)
+				}
+				result[addr][attr] = true
+			}
+		}
+	}
+
+	return result
+}
+
+// resourceAttributes returns the attributes of the primary instance of a
+// resource, including its ID.
+func resourceAttributes(r *terraform.ResourceState) map[string]string {
+	result := make(map[string]string)
+	if r == nil || r.Primary == nil {
+		return result
+	}
+
+	for k, v := range r.Primary.Attributes {
+		result[k] = v
+	}
+	if _, ok := result["id"]; !ok && r.Primary.ID != "" {
+		result["id"] = r.Primary.ID
+	}
+
+	return result
+}
+
+// outputDrift logs and outputs the resources that drifted, if any.
+func (b *Local) outputDrift(ctx context.Context, op *backend.Operation, drifted []string) {
+	if len(drifted) == 0 {
+		return
+	}
+
+	logWithContext(ctx, "[INFO] backend/local: drift detected in: %s",
+		strings.Join(drifted, ", "))
+	if !b.canOutputInfo() || op.JSONUI {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf(
+		"[reset][bold][yellow]Drift detected in %d resource(s) since the "+
+			"last apply:[reset]\n", len(drifted)))
+	for _, addr := range drifted {
+		buf.WriteString(fmt.Sprintf("  - %s\n", addr))
+	}
+	b.applyOutput(b.applyColorize().Color(buf.String()))
+}
+
+// remainingDiff returns a copy of the diff containing only the resources
+// that weren't successfully applied, as reported by CountHook.Applied.
+func remainingDiff(d *terraform.Diff, applied map[string]bool) *terraform.Diff {
+	result := new(terraform.Diff)
+	if d == nil {
+		return result
+	}
+
+	for _, m := range d.Modules {
+		rm := &terraform.ModuleDiff{
+			Path:      m.Path,
+			Resources: make(map[string]*terraform.InstanceDiff),
+			Destroy:   m.Destroy,
+		}
+		for k, rd := range m.Resources {
+			info := &terraform.InstanceInfo{Id: k, ModulePath: m.Path}
+			if rd.Empty() || applied[info.HumanId()] {
+				continue
+			}
+
+			rm.Resources[k] = rd
+		}
+
+		if len(rm.Resources) > 0 {
+			result.Modules = append(result.Modules, rm)
+		}
+	}
+
+	return result
+}
+
+// plannedAdditions returns the addresses of the resources that the diff
+// creates, including those it replaces.
+func plannedAdditions(d *terraform.Diff) map[string]bool {
+	result := make(map[string]bool)
+	if d == nil {
+		return result
+	}
+
+	for _, m := range d.Modules {
+		for k, rd := range m.Resources {
+			switch rd.ChangeType() {
+			case terraform.DiffCreate, terraform.DiffDestroyCreate:
+				info := &terraform.InstanceInfo{Id: k, ModulePath: m.Path}
+				result[info.HumanId()] = true
+			}
+		}
+	}
+
+	return result
+}
+
+// unexpectedResources returns the sorted addresses of the resources that
+// the hook counted as added but that weren't planned to be.
+func unexpectedResources(planned map[string]bool, h *CountHook) []string {
+	var result []string
+	for addr := range h.AddedResources() {
+		if !planned[addr] {
+			result = append(result, addr)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// ApplySummary is the summary of a successful apply that
+// Local.ApplySuccessTemplate and Local.DestroySuccessTemplate are
+// rendered with.
+type ApplySummary struct {
+	Added    int
+	Changed  int
+	Removed  int
+	Deferred int
+
+	// RemovedByType is the number of resources removed for each
+	// resource type.
+	RemovedByType map[string]int
+}
+
+// StatePathSummary is what Local.StatePathMessage is rendered with.
+type StatePathSummary struct {
+	// StatePath is the path the state was saved to.
+	StatePath string
+
+	// Remote is true if the state was saved by a backend other than the
+	// local backend, in which case StatePath may not be meaningful.
+	Remote bool
+}
+
+// statePathMessage returns the message to output once the state is saved,
+// or an empty string if none should be output.
+func (b *Local) statePathMessage(ctx context.Context, op *backend.Operation) string {
+	if b.StatePathMessage == "-" {
+		return ""
+	}
+
+	summary := &StatePathSummary{
+		StatePath: b.opStateOutPath(op),
+		Remote:    b.Backend != nil,
+	}
+
+	def := fmt.Sprintf(applyStatePathLocal, summary.StatePath)
+	if summary.Remote {
+		def = applyStatePathRemote
+	}
+
+	return successMessage(ctx, b.StatePathMessage, def, summary)
+}
+
+// successMessage renders the text/template tmpl with the summary. If tmpl
+// is empty or can't be rendered then def is returned instead.
+func successMessage(ctx context.Context, tmpl, def string, summary interface{}) string {
+	if tmpl == "" {
+		return def
+	}
+
+	t, err := template.New("summary").Parse(tmpl)
+	if err != nil {
+		logWithContext(ctx, "[WARN] backend/local: error parsing success template: %s", err)
+		return def
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, summary); err != nil {
+		logWithContext(ctx, "[WARN] backend/local: error rendering success template: %s", err)
+		return def
+	}
+
+	return buf.String()
+}
+
+// writeResumeToken writes a resume token to op.ResumeTokenOut, if it is
+// set, with the resources completed by this apply and any apply it resumed.
+// This is best-effort: failures are only logged.
+func (b *Local) writeResumeToken(
+	ctx context.Context, op *backend.Operation, s state.State, h *CountHook, resumeHook *ResumeHook) {
+	if op.ResumeTokenOut == "" {
+		return
+	}
+
+	completed := h.Applied()
+	if resumeHook != nil {
+		for addr := range resumeHook.Completed {
+			completed[addr] = true
+		}
+	}
+
+	lineage := ""
+	if current := s.State(); current != nil {
+		lineage = current.Lineage
+	}
+
+	logWithContext(ctx, "[INFO] backend/local: writing resume token to: %s", op.ResumeTokenOut)
+	if err := writeResumeToken(op.ResumeTokenOut, lineage, completed); err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to write resume token %s: %s",
+			op.ResumeTokenOut, err)
+	}
+}
+
+// applyColorize returns the Colorize to use for the output of an apply.
+// This never colorizes if Local.ForcePlainOutput is set or if there's no
+// CLI, since the output is then logged to Local.Logger. It also doesn't
+// if the Colorize is nil or has no colors, such as a zero value CLIColor,
+// which would otherwise panic or output the color codes as they are.
+func (b *Local) applyColorize() *colorstring.Colorize {
+	c := b.Colorize()
+	if b.ForcePlainOutput || b.CLI == nil || c == nil || c.Colors == nil {
+		return &colorstring.Colorize{
+			Colors:  colorstring.DefaultColors,
+			Disable: true,
+		}
+	}
+
+	return c
+}
+
+// canOutput returns true if an apply has somewhere to output messages to:
+// the CLI or, without one, Local.Logger.
+func (b *Local) canOutput() bool {
+	return b.CLI != nil || b.Logger != nil
+}
+
+// canOutputInfo returns true if an apply can output informational messages,
+// such as its summary: it has somewhere to output them and Local.Quiet
+// isn't set.
+func (b *Local) canOutputInfo() bool {
+	return b.canOutput() && !b.Quiet
+}
+
+// applyOutput outputs msg to the CLI, filtered by Local.OutputFilter. If
+// there's no CLI then msg is logged to Local.Logger instead.
+func (b *Local) applyOutput(msg string) {
+	if b.CLI == nil {
+		b.Logger.Printf("%s", b.filterOutput(msg))
+		return
+	}
+
+	b.CLI.Output(b.filterOutput(msg))
+}
+
+// applyError outputs msg to the CLI as an error, filtered by
+// Local.OutputFilter. If there's no CLI then msg is logged to Local.Logger
+// instead.
+func (b *Local) applyError(msg string) {
+	if b.CLI == nil {
+		b.Logger.Printf("%s", b.filterOutput(msg))
+		return
+	}
+
+	b.CLI.Error(b.filterOutput(msg))
+}
+
+// filterOutput returns msg filtered by Local.OutputFilter, if it's set.
+func (b *Local) filterOutput(msg string) string {
+	if b.OutputFilter == nil {
+		return msg
+	}
+
+	return b.OutputFilter(msg)
+}
+
+// applyStoppingMessage returns the message to output when an apply is
+// interrupted, or an empty string if none should be output.
+func (b *Local) applyStoppingMessage() string {
+	switch b.ApplyStoppingMessage {
+	case "-":
+		return ""
+	case "":
+		return applyStopping
+	default:
+		return b.ApplyStoppingMessage
+	}
+}
+
+// operationName returns a short, human-friendly name for the operation.
+func operationName(op *backend.Operation) string {
+	if op.Type == backend.OperationTypeApply && op.Destroy {
+		return "destroy"
+	}
+
+	return strings.ToLower(strings.TrimPrefix(op.Type.String(), "OperationType"))
+}
+
+// writeAuditSnapshot writes a JSON snapshot of the state to op.AuditDir, if
+// it is set. The file name is made up of the operation name, the time and
+// the given suffix. This is best-effort: failures are only logged so that
+// they never abort the operation.
+func writeAuditSnapshot(
+	ctx context.Context,
+	op *backend.Operation, t time.Time, suffix string, s *terraform.State) {
+	if op.AuditDir == "" {
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s.%s.tfstate",
+		operationName(op), t.UTC().Format(stateFileTimeFormat), suffix)
+	path := filepath.Join(op.AuditDir, name)
+	logWithContext(ctx, "[INFO] backend/local: writing audit snapshot to: %s", path)
+
+	if err := writeStateFile(path, s); err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to write audit snapshot %s: %s", path, err)
+	}
+}
+
+// writeStateHistory writes the state from before an apply to
+// Local.StateHistoryDir, if it is set, in a file named for the given time.
+// This is best-effort: failures are only logged.
+func (b *Local) writeStateHistory(ctx context.Context, t time.Time, s *terraform.State) {
+	if b.StateHistoryDir == "" {
+		return
+	}
+
+	path := filepath.Join(
+		b.StateHistoryDir, t.UTC().Format(stateFileTimeFormat)+".tfstate")
+	logWithContext(ctx, "[INFO] backend/local: writing state history to: %s", path)
+
+	if err := writeStateFile(path, s); err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to write state history %s: %s", path, err)
+	}
+}
+
+// stateFileTimeFormat is the format of the times in the names of the state
+// files written by writeAuditSnapshot and writeStateHistory. These sort in
+// time order.
+const stateFileTimeFormat = "20060102T150405.000000000Z"
+
+// writeStateFile writes the state to path, creating its directory if
+// necessary.
+func writeStateFile(path string, s *terraform.State) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return encodeState(w, s)
+	})
+}
+
+// encodeState writes the state to w as JSON, encoding it straight to w
+// rather than first marshaling it into a buffer like terraform.WriteState,
+// so that we don't hold another copy of a large state in memory.
+//
+// Like WriteState this sets the state's version and refuses to write an
+// invalid TFVersion, but it can't sort the modules, so they're written in
+// the order they're in. The result reads back as the same state.
+func encodeState(w io.Writer, s *terraform.State) error {
+	if s == nil {
+		return nil
+	}
+
+	s.Init()
+	s.Version = terraform.StateVersion
+
+	if s.TFVersion != "" {
+		if _, err := version.NewVersion(s.TFVersion); err != nil {
+			return fmt.Errorf(
+				"Error writing state, invalid version: %s\n\n"+
+					"The Terraform version when writing the state must be a semantic\n"+
+					"version.",
+				s.TFVersion)
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(s)
+}
+
+// endSpan ends the span, recording the error if there is one.
+func endSpan(span backend.Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// applyLockMetadata is the metadata about an apply that is stored in the
+// Info of its state lock, to help identify what is holding a lock.
+type applyLockMetadata struct {
+	Operation   string `json:"operation"`
+	PlanPath    string `json:"plan_path,omitempty"`
+	Parallelism int    `json:"parallelism,omitempty"`
+}
+
+// applyLockMetadata returns the JSON-encoded metadata to store in the lock
+// info for an apply.
+func (b *Local) applyLockMetadata(ctx context.Context, op *backend.Operation) string {
+	m := &applyLockMetadata{
+		Operation: operationName(op),
+		PlanPath:  op.PlanOutPath,
+	}
+	if b.ContextOpts != nil {
+		m.Parallelism = b.ContextOpts.Parallelism
+	}
+
+	js, err := json.Marshal(m)
+	if err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to encode lock metadata: %s", err)
+		return ""
+	}
+
+	return string(js)
+}
+
+// shadowError returns the shadow error of a context after an apply. This is
+// a variable so that tests can inject shadow errors.
+var shadowError = (*terraform.Context).ShadowError
+
+// lockProgressInterval is how often Operation.LockProgress is called while
+// waiting to acquire the state lock.
+var lockProgressInterval = 5 * time.Second
+
+// lockWithProgress locks the state using clistate.Lock, calling
+// op.LockProgress periodically until the lock is acquired or fails.
+func (b *Local) lockWithProgress(
+	ctx context.Context,
+	op *backend.Operation,
+	s state.State,
+	info *state.LockInfo) (string, error) {
+	if op.LockProgress == nil {
+		return clistate.Lock(ctx, s, info, b.lockUI(), b.applyColorize())
+	}
+
+	var wg sync.WaitGroup
+	doneCh := make(chan struct{})
+	defer func() {
+		close(doneCh)
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		start := time.Now()
+		ticker := time.NewTicker(lockProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+				op.LockProgress(time.Since(start))
+			}
+		}
+	}()
+
+	return clistate.Lock(ctx, s, info, b.lockUI(), b.applyColorize())
+}
+
+// lockUI returns the UI that clistate outputs the message about waiting
+// for the state lock to, which is nil in quiet mode.
+func (b *Local) lockUI() cli.Ui {
+	if b.Quiet {
+		return nil
+	}
+
+	return b.CLI
+}
+
+// unlockState unlocks the state using clistate.Unlock. In quiet mode the
+// state is unlocked directly so that only an error is output.
+func (b *Local) unlockState(s state.State, id string) error {
+	if !b.Quiet {
+		return clistate.Unlock(s, id, b.CLI, b.applyColorize())
+	}
+
+	if err := s.Unlock(id); err != nil {
+		return errwrap.Wrapf("Error releasing the state lock: {{err}}", err)
+	}
+
+	return nil
+}
+
+// defaultStatePersistRetryInterval is the initial interval between retries
+// of persisting the state if Operation.StatePersistRetryInterval isn't set.
+const defaultStatePersistRetryInterval = time.Second
+
+// checkStateUnlocked returns an ExistingLockError if the state is locked
+// by someone else. There's no way to ask a state.Locker whether it's
+// locked, so this obtains the lock and immediately releases it again.
+// Failing to check for any other reason is only logged.
+//
+// Locking a LocalState creates its state file, so a local state that
+// doesn't exist yet is skipped: nobody can hold a lock on it, and checking
+// would leave an empty state file behind if the operation then fails.
+func checkStateUnlocked(ctx context.Context, s state.State) *ExistingLockError {
+	if path := localStatePath(s); path != "" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	info := state.NewLockInfo()
+	info.Operation = "check"
+	id, err := s.Lock(info)
+	if err != nil {
+		if _, ok := err.(*state.LockError); ok {
+			return &ExistingLockError{Err: err}
+		}
+
+		logWithContext(ctx, "[WARN] backend/local: failed to check the state lock: %s", err)
+		if id == "" {
+			return nil
+		}
+	}
+
+	if err := s.Unlock(id); err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to release the state lock: %s", err)
+	}
+
+	return nil
+}
+
+// localStatePath returns the path of the file backing s if it's a
+// LocalState, possibly wrapped in a BackupState, and "" otherwise.
+func localStatePath(s state.State) string {
+	if backup, ok := s.(*state.BackupState); ok {
+		s = backup.Real
+	}
+
+	local, ok := s.(*state.LocalState)
+	if !ok {
+		return ""
+	}
+	if local.PathOut != "" {
+		return local.PathOut
+	}
+	return local.Path
+}
+
+// persistState writes and persists the given state, retrying with an
+// exponential backoff up to op.StatePersistRetries times on failure.
+func persistState(ctx context.Context, op *backend.Operation, s state.State, applyState *terraform.State) error {
+	if op.SimulateStateWriteError {
+		logWithContext(ctx, "[WARN] backend/local: simulating state write error")
+		return errors.New("simulated state write error")
+	}
+
+	interval := op.StatePersistRetryInterval
+	if interval <= 0 {
+		interval = defaultStatePersistRetryInterval
+	}
+
+	for i := 0; ; i++ {
+		err := s.WriteState(applyState)
+		if err == nil {
+			err = s.PersistState()
+		}
+		if err == nil {
+			return nil
+		}
+
+		if i >= op.StatePersistRetries {
+			return err
+		}
+
+		logWithContext(ctx,
+			"[WARN] backend/local: failed to persist state, retrying in %s: %s",
+			interval, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// signState writes the signature of the serialized state from
+// Operation.StateSigner next to the state. This is best-effort, so failing
+// to sign the state is only a warning.
+func (b *Local) signState(
+	ctx context.Context,
+	op *backend.Operation,
+	runningOp *backend.RunningOperation,
+	s *terraform.State) {
+	// Without a local state path, such as with remote state, there's
+	// nowhere to write the signature next to
+	statePath := b.opStateOutPath(op)
+	if statePath == "" {
+		logWithContext(ctx, "[WARN] backend/local: no local state path, not signing state")
+		runningOp.Warnings = append(runningOp.Warnings,
+			"Failed to sign state: there is no local state path to write the signature next to")
+		return
+	}
+	path := statePath + ".sig"
+
+	var buf bytes.Buffer
+	err := terraform.WriteState(s, &buf)
+	if err == nil {
+		var sig []byte
+		sig, err = op.StateSigner(buf.Bytes())
+		if err == nil {
+			err = writeFileAtomic(path, func(w io.Writer) error {
+				_, err := w.Write(sig)
+				return err
+			})
+		}
+	}
+	if err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to sign state: %s", err)
+		runningOp.Warnings = append(runningOp.Warnings,
+			fmt.Sprintf("Failed to sign state: %s", err))
+		return
+	}
+
+	logWithContext(ctx, "[INFO] backend/local: wrote state signature to %s", path)
+}
+
+// backupStateForError is called in a scenario where we're unable to persist
+// the state for some reason, and will attempt to save a backup copy of it to
+// local disk to help the user recover. This is a "last ditch effort" sort of
+// thing, so we really don't want to end up in this codepath; we should do
+// everything we possibly can to get the state saved _somewhere_.
+func (b *Local) backupStateForError(ctx context.Context, applyState *terraform.State, err error) error {
+	path := b.erroredStatePath()
+	if b.CLI != nil {
+		b.applyError(fmt.Sprintf("Failed to save state: %s\n", err))
+	}
+
+	// Without a writable filesystem the state can be written to a writer
+	if b.ErroredStateWriter != nil {
+		writeErr := encodeState(b.ErroredStateWriter, applyState)
+		if writeErr == nil {
+			return fmt.Errorf(stateWriteBackedUpWriterError, path)
+		}
+
+		logWithContext(ctx, "[ERROR] backend/local: failed to write the errored state: %s", writeErr)
+		if b.CLI == nil {
+			return errors.New(stateWriteFatalError)
+		}
+
+		b.applyError(fmt.Sprintf(
+			"Also failed to write the state for recovery: %s\n\n", writeErr))
+		return b.outputStateForError(applyState, path)
+	}
+
+	var writeErr error
+	if b.CompressErroredState {
+		gzPath := path + ".gz"
+		writeErr = writeCompressedState(gzPath, applyState)
+		if writeErr == nil {
+			writeErr = verifyStateFile(gzPath, applyState, true)
+		}
+		if writeErr == nil {
+			return fmt.Errorf(stateWriteBackedUpCompressedError, gzPath, path)
+		}
+	} else {
+		writeErr = writeStateFile(path, applyState)
+		if writeErr == nil {
+			writeErr = verifyStateFile(path, applyState, false)
+		}
+		if writeErr == nil {
+			return fmt.Errorf(stateWriteBackedUpError, path)
+		}
+	}
+
+	logWithContext(ctx, "[ERROR] backend/local: failed to write %s: %s", path, writeErr)
+	if b.CLI == nil {
+		return errors.New(stateWriteFatalError)
+	}
+
+	b.applyError(fmt.Sprintf(
+		"Also failed to create local state file for recovery: %s\n\n", writeErr))
+	return b.outputStateForError(applyState, path)
+}
+
+// outputStateForError prints the state to the CLI as a last resort when it
+// couldn't be persisted or backed up, unless that is suppressed.
+func (b *Local) outputStateForError(applyState *terraform.State, path string) error {
+	if b.SuppressStateConsoleFallback {
+		return errors.New(stateWriteFatalError)
+	}
+
+	// To avoid leaving the user with no state at all, our last resort
+	// is to print the JSON state out onto the terminal. This is an awful
+	// UX, so we should definitely avoid doing this if at all possible,
+	// but at least the user has _some_ path to recover if we end up
+	// here for some reason.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	indent := "  "
+	if b.StateJSONIndent != nil {
+		indent = *b.StateJSONIndent
+	}
+	if indent != "" {
+		enc.SetIndent("", indent)
+	}
+	if err := enc.Encode(applyState); err != nil {
+		b.applyError(fmt.Sprintf(
+			"Also failed to JSON-serialize the state to print it: %s\n\n", err))
+		return errors.New(stateWriteFatalError)
+	}
+
+	// The encoder ends the state with a newline that the output adds anyway
+	b.applyOutput(strings.TrimSuffix(buf.String(), "\n"))
+	return fmt.Errorf(stateWriteConsoleFallbackError, path)
+}
+
+// writeCompressedState writes the state to path as gzip-compressed JSON.
+func writeCompressedState(path string, s *terraform.State) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		if err := encodeState(gz, s); err != nil {
+			return err
+		}
+
+		return gz.Close()
+	})
+}
+
+// verifyStateFile reads back the state file written at path, decompressing
+// it if it is gzipped, and checks that it decodes to the same state so that
+// we don't rely on a recovery file that was corrupted. The file is decoded
+// as it's read rather than encoding the state again to compare against.
+func verifyStateFile(path string, s *terraform.State, compressed bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("state file %s is corrupt: %s", path, err)
+		}
+		r = gz
+	}
+
+	var actual terraform.State
+	if err := json.NewDecoder(r).Decode(&actual); err != nil {
+		return fmt.Errorf("state file %s is corrupt: %s", path, err)
+	}
+
+	if actual.Lineage != s.Lineage || actual.Serial != s.Serial || !actual.Equal(s) {
+		return fmt.Errorf("state file %s is corrupt: contents don't match the state", path)
+	}
+
+	return nil
+}
+
+// defaultWebhookTimeout is how long posting to Operation.Webhook can take
+// if it doesn't have a timeout.
+const defaultWebhookTimeout = 10 * time.Second
+
+// applySlowestResourcesCount is the number of resources that are logged
+// by logSlowestResources after an apply.
+const applySlowestResourcesCount = 5
+
+// logSlowestResources logs the n resources that took the longest to apply,
+// slowest first.
+func logSlowestResources(ctx context.Context, durations map[string]time.Duration, n int) {
+	if len(durations) == 0 {
+		return
+	}
+
+	addrs := make([]string, 0, len(durations))
+	for addr := range durations {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if durations[addrs[i]] == durations[addrs[j]] {
+			return addrs[i] < addrs[j]
+		}
+
+		return durations[addrs[i]] > durations[addrs[j]]
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+
+	logWithContext(ctx, "[INFO] backend/local: slowest %d resources to apply:", len(addrs))
+	for _, addr := range addrs {
+		logWithContext(ctx, "[INFO] backend/local:   %s: %s", addr, durations[addr])
+	}
+}
+
+// applyPhases are the phases of an apply recorded by logPhaseTimings, in
+// the order that they run.
+var applyPhases = []string{"refresh", "plan", "apply", "persist"}
+
+// logPhaseTimings logs how long each phase of an apply that ran took.
+func logPhaseTimings(ctx context.Context, timings map[string]time.Duration) {
+	var parts []string
+	for _, phase := range applyPhases {
+		if d, ok := timings[phase]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", phase, d))
+		}
+	}
+	if len(parts) == 0 {
+		return
+	}
+
+	logWithContext(ctx, "[INFO] backend/local: apply phase timings: %s", strings.Join(parts, ", "))
+}
+
+// formatRemovedByType formats the number of resources removed by type for
+// output after a destroy, sorted by type, such as
+// " (3 aws_instance, 2 aws_security_group)". This is empty if nothing was
+// removed.
+func formatRemovedByType(removed map[string]int) string {
+	if len(removed) == 0 {
+		return ""
+	}
+
+	types := make([]string, 0, len(removed))
+	for t := range removed {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	parts := make([]string, len(types))
+	for i, t := range types {
+		parts[i] = fmt.Sprintf("%d %s", removed[t], t)
+	}
+
+	return fmt.Sprintf(" (%s)", strings.Join(parts, ", "))
+}
+
+// applySummaryJSON is the summary output for a successful or failed apply
+// when Operation.JSONUI is set.
+type applySummaryJSON struct {
+	Success   bool   `json:"success"`
+	Added     int    `json:"added"`
+	Changed   int    `json:"changed"`
+	Removed   int    `json:"removed"`
+	Deferred  int    `json:"deferred"`
+	StatePath string `json:"state_path"`
+}
+
+// destroySummaryJSON is the destroy equivalent of applySummaryJSON.
+type destroySummaryJSON struct {
+	Success   bool   `json:"success"`
+	Destroyed int    `json:"destroyed"`
+	Deferred  int    `json:"deferred"`
+	StatePath string `json:"state_path"`
+}
+
+// applySummaryFileJSON is the summary of an apply written to
+// Operation.SummaryPath and posted to Operation.Webhook.
+type applySummaryFileJSON struct {
+	Success  bool    `json:"success"`
+	Destroy  bool    `json:"destroy"`
+	Added    int     `json:"added"`
+	Changed  int     `json:"changed"`
+	Removed  int     `json:"removed"`
+	Deferred int     `json:"deferred"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// applyResult returns the outcome of an apply for Operation.OnComplete.
+func applyResult(
+	op *backend.Operation,
+	runningOp *backend.RunningOperation,
+	h *CountHook) backend.ApplyResult {
+	added, changed, removed := h.Counts()
+	return backend.ApplyResult{
+		Success:      runningOp.Err == nil,
+		Err:          runningOp.Err,
+		Destroy:      op.Destroy,
+		Added:        added,
+		Changed:      changed,
+		Removed:      removed,
+		PhaseTimings: runningOp.PhaseTimings,
+		PriorSerial:  runningOp.PriorSerial,
+		NewSerial:    runningOp.NewSerial,
+	}
+}
+
+// writeApplySummary writes the summary of the outcome of an apply that
+// started at start to op.SummaryPath. Failing to write it is only a
+// warning since the apply itself is already done.
+func (b *Local) writeApplySummary(
+	ctx context.Context,
+	op *backend.Operation,
+	runningOp *backend.RunningOperation,
+	h *CountHook,
+	filterHook *ApplyFilterHook,
+	start time.Time) {
+	summary := applySummaryFile(op, runningOp, h, filterHook, start)
+	err := writeFileAtomic(op.SummaryPath, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(summary)
+	})
+	if err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to write apply summary: %s", err)
+		runningOp.Warnings = append(runningOp.Warnings,
+			fmt.Sprintf("Failed to write apply summary: %s", err))
+	}
+}
+
+// applySummaryFile returns the summary of the outcome of an apply that is
+// written to Operation.SummaryPath and posted to Operation.Webhook.
+func applySummaryFile(
+	op *backend.Operation,
+	runningOp *backend.RunningOperation,
+	h *CountHook,
+	filterHook *ApplyFilterHook,
+	start time.Time) *applySummaryFileJSON {
+	added, changed, removed := h.Counts()
+	summary := &applySummaryFileJSON{
+		Success:  runningOp.Err == nil,
+		Destroy:  op.Destroy,
+		Added:    added,
+		Changed:  changed,
+		Removed:  removed,
+		Deferred: len(filterHook.Deferred()),
+		Duration: time.Since(start).Seconds(),
+	}
+	if runningOp.Err != nil {
+		summary.Error = runningOp.Err.Error()
+	}
+
+	return summary
+}
+
+// postWebhook posts the summary of an apply to the webhook as JSON. This
+// is only a notification, so failing to post it is only logged.
+//
+// The post isn't cancelled with ctx, which is only used for logging, since
+// the outcome of an interrupted apply is the one most worth notifying of.
+func postWebhook(ctx context.Context, hook *backend.Webhook, summary *applySummaryFileJSON) {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		// This should never happen since we control the structure
+		logWithContext(ctx, "[ERROR] backend/local: error encoding webhook payload: %s", err)
+		return
+	}
+
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	reqCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to notify webhook: %s", err)
+		return
+	}
+	req = req.WithContext(reqCtx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range hook.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logWithContext(ctx, "[WARN] backend/local: failed to notify webhook: %s", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		logWithContext(ctx, "[WARN] backend/local: webhook responded with %s", resp.Status)
+	}
+}
+
+// outputApplyJSON outputs the JSON summary of an apply if the operation
+// requested it and we have a UI to output to, and writes it to the
+// operation's JSON stream if it has one.
+func (b *Local) outputApplyJSON(
+	ctx context.Context,
+	op *backend.Operation,
+	h *CountHook,
+	filterHook *ApplyFilterHook,
+	success bool) {
+	toUI := op.JSONUI && b.canOutput()
+	if !toUI && op.JSONStream == nil {
+		return
+	}
+
+	added, changed, removed := h.Counts()
+	var v interface{}
+	if op.Destroy {
+		v = &destroySummaryJSON{
+			Success:   success,
+			Destroyed: removed,
+			Deferred:  len(filterHook.Deferred()),
+			StatePath: b.opStateOutPath(op),
+		}
+	} else {
+		v = &applySummaryJSON{
+			Success:   success,
+			Added:     added,
+			Changed:   changed,
+			Removed:   removed,
+			Deferred:  len(filterHook.Deferred()),
+			StatePath: b.opStateOutPath(op),
+		}
+	}
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		// This should never happen since we control the structure
+		logWithContext(ctx, "[ERROR] backend/local: error encoding apply summary: %s", err)
+		return
+	}
+
+	if toUI {
+		b.applyOutput(string(js))
+	}
+	if op.JSONStream != nil {
+		if _, err := fmt.Fprintf(op.JSONStream, "%s\n", js); err != nil {
+			logWithContext(ctx, "[WARN] backend/local: error writing apply summary to JSON stream: %s", err)
+		}
+	}
+}
+
+const applyErrNoConfig = `
+No configuration files found!
 
 Apply requires configuration to be present. Applying without a configuration
 would mark everything for destruction, which is normally not what is desired.
 If you would like to destroy everything, please run 'terraform destroy' instead
 which does not require any configuration files.
 `
+
+const applyWarnEmptyModule = "No configuration was given for the apply, " +
+	"so an empty configuration is being used in its place."
+
+const applyStatePathLocal = "[reset]\n" +
+	"The state of your infrastructure has been saved to the path\n" +
+	"below. This state is required to modify and destroy your\n" +
+	"infrastructure, so keep it safe. To inspect the complete state\n" +
+	"use the `terraform show` command.\n\n" +
+	"State path: %s"
+
+const applyStatePathRemote = "[reset]\n" +
+	"The state of your infrastructure has been saved to the configured\n" +
+	"backend. To inspect the complete state use the `terraform show`\n" +
+	"command."
+
+const applyFutureStateWarning = "The state was last written by Terraform %s, " +
+	"which is newer than this Terraform (%s). Applying may corrupt the " +
+	"state. Please upgrade Terraform before applying again."
+
+const applyTargetingWarning = "Only the targeted resources will be applied: %s. " +
+	"Applying only some resources can leave the state inconsistent with " +
+	"the configuration, so this should only be used to recover from errors."
+
+const applySandboxDiscarded = "[reset]\n" +
+	"This was a sandbox apply against a copy of the state, which has been\n" +
+	"discarded. The real state has not been modified."
+
+const applyStopping = "[reset][bold][yellow]stopping apply operation..."
+
+const applyForcedTermination = `
+Apply didn't stop within %s of being interrupted and was forcefully
+terminated. Resources that were still being applied may have been created or
+modified without being recorded in the state. The state has been saved with
+everything that completed before the apply was terminated.
+`
+
+const applyNoChanges = `
+[reset][bold][green]
+No changes. Infrastructure is up-to-date.
+`
+
+const stateWriteBackedUpError = `Failed to persist state to backend.
+
+The error shown above has prevented Terraform from writing the updated state
+to the configured backend. To allow for recovery, the state has been written
+to the file %[1]q.
+
+Running "terraform apply" again at this point will create a forked state,
+making it harder to recover.
+
+To retry writing this state, use the following command:
+    terraform state push %[1]s
+`
+
+const stateWriteBackedUpCompressedError = `Failed to persist state to backend.
+
+The error shown above has prevented Terraform from writing the updated state
+to the configured backend. To allow for recovery, the state has been written
+to the gzip-compressed file %[1]q.
+
+Running "terraform apply" again at this point will create a forked state,
+making it harder to recover.
+
+To retry writing this state, decompress it and then push it using the
+following commands:
+    gunzip %[1]s
+    terraform state push %[2]s
+`
+
+const stateWriteBackedUpWriterError = `Failed to persist state to backend.
+
+The error shown above has prevented Terraform from writing the updated state
+to the configured backend. To allow for recovery, the state has been written
+to the errored state writer instead of a local file.
+
+Running "terraform apply" again at this point will create a forked state,
+making it harder to recover.
+
+To retry writing this state, save the state data written to the errored state
+writer into a local file called %[1]q, then run the following command:
+    terraform state push %[1]s
+`
+
+const stateWriteConsoleFallbackError = `Failed to persist state to backend.
+
+The errors shown above prevented Terraform from writing the updated state to
+the configured backend and from creating a local backup file. As a fallback,
+the raw state data is printed above as a JSON object.
+
+To retry writing this state, copy the state data (from the first { to the
+last } inclusive) and save it into a local file called %[1]s, then
+run the following command:
+    terraform state push %[1]s
+`
+
+const stateWriteFatalError = `Failed to save state after a successful apply.
+
+A catastrophic error has prevented Terraform from persisting the state file
+or creating a backup. Unfortunately this means that the record of any resources
+created during this apply has been lost, and such resources may exist outside
+of Terraform's management.
+
+For resources that support import, it is possible to recover by manually
+importing each resource using its id from the target system.
+
+This is a serious bug in Terraform and should be reported.
+`
+
+// logWithContext logs a message like log.Printf, including the request ID
+// from the context if there is one so that the log lines of concurrent
+// operations can be told apart. The ID goes after the level prefix, such as
+// "[INFO]", so that log filtering still works.
+//
+// If the context has an operation logger, the message is logged to it too.
+func logWithContext(ctx context.Context, format string, args ...interface{}) {
+	if id := backend.RequestID(ctx); id != "" {
+		prefix := fmt.Sprintf("[request_id=%s] ", id)
+		if i := strings.Index(format, "] "); strings.HasPrefix(format, "[") && i != -1 {
+			format = format[:i+2] + prefix + format[i+2:]
+		} else {
+			format = prefix + format
+		}
+	}
+
+	log.Printf(format, args...)
+	if l := operationLogger(ctx); l != nil {
+		l.Printf(format, args...)
+	}
+}
+
+// operationLoggerKey is the context key for the logger of an operation.
+type operationLoggerKey struct{}
+
+// contextWithOperationLogger returns a context carrying a logger that
+// logWithContext logs to as well as the standard logger, so that the log
+// of a single operation can be kept apart.
+func contextWithOperationLogger(ctx context.Context, l *log.Logger) context.Context {
+	return context.WithValue(ctx, operationLoggerKey{}, l)
+}
+
+// operationLogger returns the operation logger in the context, or nil if
+// there isn't one.
+func operationLogger(ctx context.Context) *log.Logger {
+	l, _ := ctx.Value(operationLoggerKey{}).(*log.Logger)
+	return l
+}
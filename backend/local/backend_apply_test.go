@@ -1,15 +1,33 @@
 package local
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/terraform/backend"
+	"github.com/hashicorp/terraform/command/clistate"
 	"github.com/hashicorp/terraform/config/module"
+	"github.com/hashicorp/terraform/state"
 	"github.com/hashicorp/terraform/terraform"
+	"github.com/mitchellh/cli"
+	"github.com/mitchellh/colorstring"
 )
 
 func TestLocal_applyBasic(t *testing.T) {
@@ -51,6 +69,483 @@ test_instance.foo:
 	`)
 }
 
+func TestLocal_applyOutput(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "Apply complete! Resources: 1 added, 0 changed, 0 destroyed.") {
+		t.Fatalf("bad: %s", output)
+	}
+	if strings.Contains(output, "No changes.") {
+		t.Fatalf("bad: %s", output)
+	}
+	if !strings.Contains(output, "State path: "+b.StateOutPath) {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyFilter(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ApplyFilter = func(addr string) bool {
+		return addr == "test_instance.foo"
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+
+	output := ui.OutputWriter.String()
+	expected := "Apply complete! Resources: 1 added, 0 changed, 0 destroyed, 1 deferred."
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in output:\n\n%s", expected, output)
+	}
+}
+
+func TestLocal_applyNoChanges(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "No changes. Infrastructure is up-to-date.") {
+		t.Fatalf("bad: %s", output)
+	}
+	if strings.Contains(output, "Apply complete!") {
+		t.Fatalf("bad: %s", output)
+	}
+	if strings.Contains(output, "State path:") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyNoChangesRefreshed(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.RefreshFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState) (*terraform.InstanceState, error) {
+		s = s.DeepCopy()
+		s.Attributes = map[string]string{"refreshed": "true"}
+		return s, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanRefresh = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "No changes. Infrastructure is up-to-date.") {
+		t.Fatalf("bad: %s", output)
+	}
+	if !strings.Contains(output, "State path: "+b.StateOutPath) {
+		t.Fatalf("refreshed state path should be output: %s", output)
+	}
+}
+
+func TestLocal_applyDisableRefresh(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+	b.DisableRefresh = true
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanRefresh = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if p.RefreshCalled {
+		t.Fatal("refresh should not be called")
+	}
+
+	if !p.DiffCalled {
+		t.Fatal("diff should be called")
+	}
+}
+
+func TestLocal_applyAuditDir(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	auditDir := filepath.Join(testTempDir(t), "audit")
+	defer os.RemoveAll(filepath.Dir(auditDir))
+
+	op := testOperationApply()
+	op.Module = mod
+	op.AuditDir = auditDir
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	before, err := filepath.Glob(filepath.Join(auditDir, "apply-*.before.tfstate"))
+	if err != nil || len(before) != 1 {
+		t.Fatalf("expected one before snapshot: %v %v", before, err)
+	}
+	after, err := filepath.Glob(filepath.Join(auditDir, "apply-*.after.tfstate"))
+	if err != nil || len(after) != 1 {
+		t.Fatalf("expected one after snapshot: %v %v", after, err)
+	}
+
+	checkState(t, before[0], `
+test_instance.foo:
+  ID = bar
+	`)
+	checkState(t, after[0], `
+test_instance.bar:
+  ID = yes
+test_instance.foo:
+  ID = bar
+	`)
+}
+
+func TestLocal_applyAuditDirError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	// Use a file as the audit directory so that writing snapshots fails
+	f, err := ioutil.TempFile("", "tf")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	op := testOperationApply()
+	op.Module = mod
+	op.AuditDir = f.Name()
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("audit snapshot failures should not fail the apply: %s", run.Err)
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyStateHistory(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	b.StateHistoryDir = filepath.Join(testTempDir(t), "history")
+	defer os.RemoveAll(filepath.Dir(b.StateHistoryDir))
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	history, err := filepath.Glob(filepath.Join(b.StateHistoryDir, "*.tfstate"))
+	if err != nil || len(history) != 1 {
+		t.Fatalf("expected one history file: %v %v", history, err)
+	}
+
+	// The history has the state from before the apply
+	checkState(t, history[0], `
+test_instance.foo:
+  ID = bar
+	`)
+}
+
+func TestLocal_applyStateHistoryError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	// Use a file as the directory so that writing to it fails
+	b.StateHistoryDir = b.StatePath
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("writing history should not fail the apply: %s", run.Err)
+	}
+}
+
+func TestLocal_applyEmptyModuleSavedPlan(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	// Save a plan to apply without a module
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+	planOp := testOperationPlan()
+	planOp.Module = mod
+	planOp.PlanOutPath = filepath.Join(td, "plan.tfplan")
+	run, err := b.Operation(context.Background(), planOp)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	op := testOperationApply()
+	op.Plan = testReadPlan(t, planOp.PlanOutPath)
+
+	run, err = b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	// The plan is applied with its own module, so there's nothing to warn of
+	if len(run.Warnings) != 0 {
+		t.Fatalf("applying a saved plan shouldn't warn: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyEmptyModuleDestroy(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	op := testOperationApply()
+	op.Destroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if len(run.Warnings) != 0 {
+		t.Fatalf("destroying without a module shouldn't warn: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyPlanOnly(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	outDir := testTempDir(t)
+	defer os.RemoveAll(outDir)
+	planPath := filepath.Join(outDir, "plan.tfplan")
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanOnly = true
+	op.PlanOutPath = planPath
+	op.LockState = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.DiffCalled {
+		t.Fatal("diff should be called")
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	if run.PlanEmpty {
+		t.Fatal("plan should not be empty")
+	}
+
+	if _, err := os.Stat(b.StateOutPath); err == nil {
+		t.Fatal("state should not exist")
+	}
+
+	plan := testReadPlan(t, planPath)
+	if plan.Diff.Empty() {
+		t.Fatal("saved plan should not be empty")
+	}
+
+	// The lock should have been released
+	s, err := b.State(backend.DefaultStateName)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	lockID, err := s.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatalf("state should be unlocked: %s", err)
+	}
+	s.Unlock(lockID)
+}
+
+func TestLocal_applyPlanOnlyNoOut(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanOnly = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if p.DiffCalled || p.ApplyCalled {
+		t.Fatal("nothing should be planned or applied")
+	}
+}
+
 func TestLocal_applyEmptyDir(t *testing.T) {
 	b := TestLocal(t)
 	p := TestLocalProvider(t, b, "test")
@@ -58,104 +553,7356 @@ func TestLocal_applyEmptyDir(t *testing.T) {
 	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
 
 	op := testOperationApply()
-	op.Module = nil
+	op.Module = nil
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	if _, err := os.Stat(b.StateOutPath); err == nil {
+		t.Fatal("should not exist")
+	}
+}
+
+func TestLocal_applyEmptyDirDestroy(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = nil
+
+	op := testOperationApply()
+	op.Module = nil
+	op.Destroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	checkState(t, b.StateOutPath, `<no state>`)
+}
+
+func TestLocal_applyError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	var lock sync.Mutex
+	errored := false
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if !errored && info.Id == "test_instance.bar" {
+			errored = true
+			return nil, fmt.Errorf("error")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	applyErr, ok := run.Err.(*ApplyError)
+	if !ok {
+		t.Fatalf("should be an ApplyError: %#v", run.Err)
+	}
+	if errs := applyErr.WrappedErrors(); len(errs) != 1 ||
+		!strings.Contains(errs[0].Error(), "error") {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = foo
+	`)
+}
+
+func TestLocal_applyDestroyOutput(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	expected := "Destroy complete! Resources: 1 destroyed (1 test_instance)."
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in output:\n\n%s", expected, output)
+	}
+}
+
+func TestLocal_applySuccessTemplate(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.ApplySuccessTemplate = "Deployed: {{.Added}} new, {{.Changed}} updated, {{.Removed}} gone"
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	expected := "Deployed: 1 new, 0 updated, 0 gone"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in output:\n\n%s", expected, output)
+	}
+	if strings.Contains(output, "Apply complete!") {
+		t.Fatalf("default message should not be output:\n\n%s", output)
+	}
+}
+
+func TestLocal_applyDestroySuccessTemplate(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.DestroySuccessTemplate = "Torn down {{.Removed}} ({{index .RemovedByType \"test_instance\"}} test_instance)"
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	expected := "Torn down 1 (1 test_instance)"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in output:\n\n%s", expected, output)
+	}
+}
+
+func TestSuccessMessage(t *testing.T) {
+	summary := &ApplySummary{Added: 1, Changed: 2, Removed: 3, Deferred: 4}
+
+	cases := []struct {
+		Template string
+		Expected string
+	}{
+		{"", "default"},
+		{"{{.Added}}/{{.Changed}}/{{.Removed}}/{{.Deferred}}", "1/2/3/4"},
+		{"{{.Added", "default"},
+		{"{{.Missing}}", "default"},
+	}
+
+	for i, tc := range cases {
+		actual := successMessage(context.Background(), tc.Template, "default", summary)
+		if actual != tc.Expected {
+			t.Fatalf("%d: expected %q, got %q", i, tc.Expected, actual)
+		}
+	}
+}
+
+func TestFormatRemovedByType(t *testing.T) {
+	cases := []struct {
+		Input    map[string]int
+		Expected string
+	}{
+		{nil, ""},
+		{map[string]int{"aws_instance": 1}, " (1 aws_instance)"},
+		{
+			map[string]int{"aws_security_group": 2, "aws_instance": 3},
+			" (3 aws_instance, 2 aws_security_group)",
+		},
+	}
+
+	for i, tc := range cases {
+		if actual := formatRemovedByType(tc.Input); actual != tc.Expected {
+			t.Fatalf("%d: expected %q, got %q", i, tc.Expected, actual)
+		}
+	}
+}
+
+func TestLocal_applyJSON(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.JSONUI = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if strings.Contains(output, "Apply complete!") {
+		t.Fatalf("human output should not be present:\n%s", output)
+	}
+
+	var actual applySummaryJSON
+	if err := json.Unmarshal([]byte(output), &actual); err != nil {
+		t.Fatalf("err: %s\n\n%s", err, output)
+	}
+
+	expected := applySummaryJSON{
+		Success:   true,
+		Added:     1,
+		StatePath: b.StateOutPath,
+	}
+	if actual != expected {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyShadowErrors(t *testing.T) {
+	defer func(f func(*terraform.Context) error) { shadowError = f }(shadowError)
+	shadowError = func(*terraform.Context) error {
+		return errors.New("shadow failure")
+	}
+
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.RecordShadowErrors = true
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if len(run.Warnings) != 1 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+	if !strings.Contains(run.Warnings[0], "apply operation: shadow failure") {
+		t.Fatalf("bad: %s", run.Warnings[0])
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyShadowErrorsDisabled(t *testing.T) {
+	defer func(f func(*terraform.Context) error) { shadowError = f }(shadowError)
+	shadowError = func(*terraform.Context) error {
+		return errors.New("shadow failure")
+	}
+
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyPeakParallelism(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	// Neither resource finishes applying until both have started so that
+	// they're applied concurrently.
+	var started sync.WaitGroup
+	started.Add(2)
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		started.Done()
+		started.Wait()
+		return &terraform.InstanceState{ID: "yes"}, nil
+	}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if run.PeakParallelism != 2 {
+		t.Fatalf("bad: %d", run.PeakParallelism)
+	}
+}
+
+func TestLocal_applyPeakParallelismHookError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.ContextOpts.Parallelism = 1
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-parallel")
+	defer modCleanup()
+
+	// The resources a hook fails before applying are never applied, so
+	// they shouldn't count towards the parallelism
+	op := testOperationApply()
+	op.Module = mod
+	op.ExtraHooks = []terraform.Hook{&testPreApplyErrorHook{Prefix: "test_instance.foo"}}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	if run.PeakParallelism != 1 {
+		t.Fatalf("bad: %d", run.PeakParallelism)
+	}
+}
+
+func TestLocal_applySecondaryState(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	secondary := new(state.InmemState)
+	op := testOperationApply()
+	op.Module = mod
+	op.SecondaryState = secondary
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+
+	actual := secondary.State()
+	if actual == nil || !actual.Equal(run.State) {
+		t.Fatalf("bad: %s", actual)
+	}
+}
+
+func TestLocal_applySecondaryStateNotPersisted(t *testing.T) {
+	for _, tc := range []struct {
+		Name string
+		Op   func(*backend.Operation)
+	}{
+		{"skip persist", func(op *backend.Operation) { op.SkipStatePersist = true }},
+		{"ephemeral", func(op *backend.Operation) { op.Ephemeral = true }},
+	} {
+		b := TestLocal(t)
+		p := TestLocalProvider(t, b, "test")
+
+		p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+		mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+		defer modCleanup()
+
+		secondary := new(testPersistFailState)
+		op := testOperationApply()
+		op.Module = mod
+		op.SecondaryState = secondary
+		tc.Op(op)
+
+		run, err := b.Operation(context.Background(), op)
+		if err != nil {
+			t.Fatalf("%s: bad: %s", tc.Name, err)
+		}
+		<-run.Done()
+		if run.Err != nil {
+			t.Fatalf("%s: err: %s", tc.Name, run.Err)
+		}
+
+		if actual := secondary.State(); actual != nil {
+			t.Fatalf("%s: secondary state should be untouched: %s", tc.Name, actual)
+		}
+		if secondary.calls != 0 {
+			t.Fatalf("%s: secondary state should not be persisted", tc.Name)
+		}
+	}
+}
+
+func TestLocal_applySecondaryStateError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SecondaryState = new(testPersistFailState)
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if len(run.Warnings) != 1 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+	if !strings.Contains(run.Warnings[0], "persist failed") {
+		t.Fatalf("bad: %s", run.Warnings[0])
+	}
+
+	// The primary state should still be persisted
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyRemainingPlan(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			return nil, fmt.Errorf("error")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+
+	op := testOperationApply()
+	op.Module = mod
+	op.RemainingPlanPath = filepath.Join(td, "remaining.tfplan")
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	plan := testReadPlan(t, op.RemainingPlanPath)
+	resources := plan.Diff.RootModule().Resources
+	if len(resources) != 1 || resources["test_instance.bar"] == nil {
+		t.Fatalf("bad: %s", plan.Diff)
+	}
+	if plan.State.RootModule().Resources["test_instance.foo"] == nil {
+		t.Fatalf("bad: %s", plan.State)
+	}
+}
+
+func TestLocal_applyRemainingPlanSuccess(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+
+	op := testOperationApply()
+	op.Module = mod
+	op.RemainingPlanPath = filepath.Join(td, "remaining.tfplan")
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	// Nothing remains so nothing should be written
+	if _, err := os.Stat(op.RemainingPlanPath); !os.IsNotExist(err) {
+		t.Fatalf("remaining plan should not exist: %s", err)
+	}
+}
+
+func TestLocal_applyPrePlanApply(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var checked *terraform.Plan
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+	op.PrePlanApply = func(plan *terraform.Plan) error {
+		checked = plan
+		return errors.New("policy violation")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if !strings.Contains(run.Err.Error(), "policy violation") {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	if checked == nil || checked.Diff.Empty() {
+		t.Fatalf("bad: %#v", checked)
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	if _, err := os.Stat(b.StateOutPath); err == nil {
+		t.Fatal("state should not exist")
+	}
+
+	// The lock should have been released
+	s, err := b.State(backend.DefaultStateName)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	lockID, err := s.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatalf("state should be unlocked: %s", err)
+	}
+	s.Unlock(lockID)
+}
+
+func TestLocal_applyPrePlanApplyAccepted(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PrePlanApply = func(*terraform.Plan) error { return nil }
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyDestroyConfirm(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var confirmState *terraform.State
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+	op.LockState = true
+	op.DestroyConfirm = func(s *terraform.State) error {
+		confirmState = s
+		return errors.New("not allowed")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if !strings.Contains(run.Err.Error(), "not allowed") {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	if confirmState == nil || confirmState.RootModule().Resources["test_instance.foo"] == nil {
+		t.Fatalf("bad: %s", confirmState)
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	// Nothing should have been destroyed
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = bar
+	`)
+
+	// The lock should have been released
+	s, err := b.State(backend.DefaultStateName)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	lockID, err := s.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatalf("state should be unlocked: %s", err)
+	}
+	s.Unlock(lockID)
+}
+
+func TestLocal_applyDestroyConfirmed(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+	op.DestroyConfirm = func(*terraform.State) error { return nil }
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+
+	checkState(t, b.StateOutPath, `<no state>`)
+}
+
+func TestLocal_applyReportDrift(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	s := testApplyState()
+	s.RootModule().Resources["test_instance.bar"] = &terraform.ResourceState{
+		Type: "test_instance",
+		Primary: &terraform.InstanceState{
+			ID: "baz",
+		},
+	}
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	// Only foo is changed by the refresh
+	p.RefreshFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState) (*terraform.InstanceState, error) {
+		if info.Id != "test_instance.foo" {
+			return s, nil
+		}
+
+		s = s.DeepCopy()
+		s.Attributes = map[string]string{"ami": "changed"}
+		return s, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanRefresh = true
+	op.ReportDrift = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	expected := []string{"test_instance.foo"}
+	if !reflect.DeepEqual(run.DriftedResources, expected) {
+		t.Fatalf("bad: %#v", run.DriftedResources)
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "Drift detected in 1 resource(s)") ||
+		!strings.Contains(output, "  - test_instance.foo") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestDriftedResources(t *testing.T) {
+	before := testApplyState()
+	before.AddModuleState(&terraform.ModuleState{
+		Path: []string{"root", "child"},
+		Resources: map[string]*terraform.ResourceState{
+			"test_instance.foo": &terraform.ResourceState{
+				Type:    "test_instance",
+				Primary: &terraform.InstanceState{ID: "foo"},
+			},
+			"test_instance.bar": &terraform.ResourceState{
+				Type:    "test_instance",
+				Primary: &terraform.InstanceState{ID: "bar"},
+			},
+			"data.test_data.foo": &terraform.ResourceState{
+				Type:    "test_data",
+				Primary: &terraform.InstanceState{ID: "foo"},
+			},
+		},
+	})
+
+	// The child module's foo is deleted, its bar is changed and its data
+	// source is re-read. The root module is unchanged.
+	after := before.DeepCopy()
+	child := after.ModuleByPath([]string{"root", "child"})
+	delete(child.Resources, "test_instance.foo")
+	child.Resources["test_instance.bar"].Primary.ID = "changed"
+	child.Resources["data.test_data.foo"].Primary.ID = "changed"
+
+	expected := []string{
+		"module.child.test_instance.bar",
+		"module.child.test_instance.foo",
+	}
+	actual := driftedResources(before, after)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+
+	if actual := driftedResources(before, before.DeepCopy()); len(actual) != 0 {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyShowPostApplyDiff(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{
+		ID:         "yes",
+		Attributes: map[string]string{"ami": "bar"},
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ShowPostApplyDiff = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	for _, expected := range []string{
+		"Changes to the state:",
+		"  + test_instance.foo",
+		`      ami: "bar"`,
+		`      id: "yes"`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("expected %q in output:\n\n%s", expected, output)
+		}
+	}
+}
+
+func TestLocal_applyShowPostApplyDiffSensitive(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.DiffReturn = &terraform.InstanceDiff{
+		Attributes: map[string]*terraform.ResourceAttrDiff{
+			"ami":      &terraform.ResourceAttrDiff{New: "bar"},
+			"password": &terraform.ResourceAttrDiff{New: "hunter2", Sensitive: true},
+		},
+	}
+	p.ApplyReturn = &terraform.InstanceState{
+		ID: "yes",
+		Attributes: map[string]string{
+			"ami":      "bar",
+			"password": "hunter2",
+		},
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ShowPostApplyDiff = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "      password: <sensitive>\n") ||
+		!strings.Contains(output, `      ami: "bar"`) {
+		t.Fatalf("bad: %s", output)
+	}
+	if strings.Contains(output, "hunter2") {
+		t.Fatalf("sensitive value should not be output: %s", output)
+	}
+}
+
+func TestLocal_applyShowPostApplyDiffDisabled(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if output := ui.OutputWriter.String(); strings.Contains(output, "Changes to the state:") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestStateAttributeDiff(t *testing.T) {
+	before := testApplyState()
+	foo := before.RootModule().Resources["test_instance.foo"]
+	foo.Primary.Attributes = map[string]string{
+		"id":   "bar",
+		"ami":  "old",
+		"tags": "1",
+		"size": "small",
+	}
+	before.RootModule().Resources["test_instance.gone"] = &terraform.ResourceState{
+		Type:    "test_instance",
+		Primary: &terraform.InstanceState{ID: "gone"},
+	}
+
+	// foo has one attribute changed, one removed and one added, and
+	// unchanged attributes aren't shown
+	after := before.DeepCopy()
+	root := after.RootModule()
+	delete(root.Resources, "test_instance.gone")
+	attrs := root.Resources["test_instance.foo"].Primary.Attributes
+	attrs["ami"] = "new"
+	delete(attrs, "tags")
+	attrs["zone"] = "a"
+	root.Resources["test_instance.new"] = &terraform.ResourceState{
+		Type: "test_instance",
+		Primary: &terraform.InstanceState{
+			ID:         "new",
+			Attributes: map[string]string{"ami": "baz"},
+		},
+	}
+
+	expected := "[reset][bold]\nChanges to the state:[reset]\n\n" +
+		"[yellow]  ~ test_instance.foo[reset]\n" +
+		"      ami: \"old\" => \"new\"\n" +
+		"      tags: \"1\" => <removed>\n" +
+		"      zone: \"a\"\n" +
+		"[red]  - test_instance.gone[reset]\n" +
+		"[green]  + test_instance.new[reset]\n" +
+		"      ami: \"baz\"\n" +
+		"      id: \"new\"\n"
+	if actual := stateAttributeDiff(before, after, nil); actual != expected {
+		t.Fatalf("bad:\n\n%s\n\nexpected:\n\n%s", actual, expected)
+	}
+
+	if actual := stateAttributeDiff(before, before.DeepCopy(), nil); actual != "" {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestStateAttributeDiff_sensitive(t *testing.T) {
+	before := testApplyState()
+	before.RootModule().Resources["test_instance.foo"].Primary.Attributes = map[string]string{
+		"id":       "bar",
+		"password": "old",
+		"token":    "abc",
+	}
+
+	after := before.DeepCopy()
+	attrs := after.RootModule().Resources["test_instance.foo"].Primary.Attributes
+	attrs["password"] = "new"
+	delete(attrs, "token")
+
+	sensitive := map[string]map[string]bool{
+		"test_instance.foo": {"password": true, "token": true},
+	}
+	expected := "[reset][bold]\nChanges to the state:[reset]\n\n" +
+		"[yellow]  ~ test_instance.foo[reset]\n" +
+		"      password: <sensitive> => <sensitive>\n" +
+		"      token: <sensitive> => <removed>\n"
+	if actual := stateAttributeDiff(before, after, sensitive); actual != expected {
+		t.Fatalf("bad:\n\n%s\n\nexpected:\n\n%s", actual, expected)
+	}
+}
+
+func TestLocal_applyStopGracePeriod(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	// The provider ignores being stopped so the apply never completes
+	// until the test is done.
+	startCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	var startOnce sync.Once
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		startOnce.Do(func() { close(startCh) })
+		<-doneCh
+		return &terraform.InstanceState{ID: "yes"}, nil
+	}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.StopGracePeriod = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	<-startCh
+	start := time.Now()
+	cancel()
+
+	select {
+	case <-run.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("apply should have been terminated")
+	}
+	if elapsed := time.Since(start); elapsed < op.StopGracePeriod {
+		t.Fatalf("apply terminated before the grace period: %s", elapsed)
+	}
+
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if !strings.Contains(run.Err.Error(), "didn't stop within 50ms") {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	// The state from before the apply is still there
+	if run.State.RootModule().Resources["test_instance.foo"] == nil {
+		t.Fatalf("bad: %s", run.State)
+	}
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = bar
+	`)
+}
+
+func TestLocal_applyStopGracePeriodLock(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	// The provider ignores being stopped so the apply keeps running after
+	// it's abandoned, until it's released
+	startCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	var startOnce, releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(releaseCh) }) }
+	defer release()
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		startOnce.Do(func() { close(startCh) })
+		<-releaseCh
+		return &terraform.InstanceState{ID: "yes"}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+	op.StopGracePeriod = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-startCh
+	cancel()
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	// The state stays locked while the abandoned apply is running
+	lockInfoPath := filepath.Join(filepath.Dir(b.StatePath), ".state.tfstate.lock.info")
+	if _, err := os.Stat(lockInfoPath); err != nil {
+		t.Fatalf("state should be locked: %s", err)
+	}
+
+	// Once it completes the lock is released
+	release()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(lockInfoPath); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("state should be unlocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLocal_applyResourceResults(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			return nil, fmt.Errorf("error")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	if len(run.ResourceResults) != 2 {
+		t.Fatalf("bad: %#v", run.ResourceResults)
+	}
+	if err, ok := run.ResourceResults["test_instance.foo"]; !ok || err != nil {
+		t.Fatalf("bad: %#v", run.ResourceResults)
+	}
+	if err := run.ResourceResults["test_instance.bar"]; err == nil || !strings.Contains(err.Error(), "error") {
+		t.Fatalf("bad: %#v", run.ResourceResults)
+	}
+}
+
+func TestLocal_applyPostApplyVerify(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var verified *terraform.State
+	op := testOperationApply()
+	op.Module = mod
+	op.PostApplyVerify = func(s *terraform.State) error {
+		verified = s
+		return errors.New("missing tag")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	verifyErr, ok := run.Err.(*VerificationError)
+	if !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+	if verifyErr.Err.Error() != "missing tag" {
+		t.Fatalf("bad: %s", verifyErr.Err)
+	}
+
+	if verified == nil || verified.RootModule().Resources["test_instance.foo"] == nil {
+		t.Fatalf("bad: %s", verified)
+	}
+
+	// The state should still be persisted
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyRequireIdempotent(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.RequireIdempotent = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	idempotentErr, ok := run.Err.(*NonIdempotentError)
+	if !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+	if idempotentErr.Added != 1 || idempotentErr.Changed != 0 || idempotentErr.Removed != 0 {
+		t.Fatalf("bad: %#v", idempotentErr)
+	}
+
+	// The changes were still applied and saved
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyRequireIdempotentNoChanges(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.RequireIdempotent = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+}
+
+func TestLocal_applyExtraHooks(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	hooks := b.ContextOpts.Hooks
+	h := new(terraform.MockHook)
+	op := testOperationApply()
+	op.Module = mod
+	op.ExtraHooks = []terraform.Hook{h}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !h.PreApplyCalled || !h.PostApplyCalled {
+		t.Fatalf("hook should be called: %#v", h)
+	}
+	if h.PreApplyInfo.HumanId() != "test_instance.foo" {
+		t.Fatalf("bad: %s", h.PreApplyInfo.HumanId())
+	}
+
+	// The backend's hooks should be restored
+	if !reflect.DeepEqual(b.ContextOpts.Hooks, hooks) {
+		t.Fatalf("bad: %#v", b.ContextOpts.Hooks)
+	}
+}
+
+func TestLocal_applyTracing(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		return nil, fmt.Errorf("error")
+	}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanRefresh = true
+
+	tracer := new(testTracer)
+	ctx := backend.ContextWithTracer(context.Background(), tracer)
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	if len(tracer.spans) != 3 {
+		t.Fatalf("bad: %#v", tracer.spans)
+	}
+	for i, name := range []string{"refresh", "plan", "apply"} {
+		span := tracer.spans[i]
+		if span.name != name {
+			t.Fatalf("%d: expected %q, got %q", i, name, span.name)
+		}
+		if !span.ended {
+			t.Fatalf("%d: span should be ended", i)
+		}
+		if (span.err != nil) != (name == "apply") {
+			t.Fatalf("%d: bad error: %v", i, span.err)
+		}
+	}
+}
+
+func TestLocal_applyProgress(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	var progress [][2]int
+	op := testOperationApply()
+	op.Module = mod
+	op.ProgressFunc = func(done, total int) {
+		progress = append(progress, [2]int{done, total})
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	expected := [][2]int{{1, 2}, {2, 2}}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Fatalf("bad: %#v", progress)
+	}
+}
+
+func TestLocal_applyProgressEmpty(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var progress [][2]int
+	op := testOperationApply()
+	op.Module = mod
+	op.ProgressFunc = func(done, total int) {
+		progress = append(progress, [2]int{done, total})
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	expected := [][2]int{{0, 0}}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Fatalf("bad: %#v", progress)
+	}
+}
+
+func TestLocal_applyStalePlan(t *testing.T) {
+	cases := map[string]struct {
+		Lineage string
+		Serial  int64
+		Allow   bool
+		Stale   bool
+	}{
+		"matching":          {"foo", 1, false, false},
+		"plan newer":        {"foo", 2, false, false},
+		"different lineage": {"bar", 1, false, true},
+		"older serial":      {"foo", 0, false, true},
+		"allowed":           {"bar", 1, true, false},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			b := TestLocal(t)
+			p := TestLocalProvider(t, b, "test")
+
+			s := testApplyState()
+			s.Lineage = "foo"
+			s.Serial = 1
+			terraform.TestStateFile(t, b.StatePath, s)
+
+			p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+			mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+			defer modCleanup()
+
+			planState := s.DeepCopy()
+			planState.Lineage = tc.Lineage
+			planState.Serial = tc.Serial
+
+			op := testOperationApply()
+			op.Module = mod
+			op.Plan = &terraform.Plan{
+				Module: mod,
+				State:  planState,
+				Diff:   &terraform.Diff{},
+			}
+			op.AllowStalePlan = tc.Allow
+
+			run, err := b.Operation(context.Background(), op)
+			if err != nil {
+				t.Fatalf("bad: %s", err)
+			}
+			<-run.Done()
+
+			staleErr, stale := run.Err.(*StalePlanError)
+			if stale != tc.Stale {
+				t.Fatalf("bad: %#v", run.Err)
+			}
+			if !tc.Stale && run.Err != nil {
+				t.Fatalf("err: %s", run.Err)
+			}
+
+			if tc.Stale {
+				if staleErr.PlanLineage != tc.Lineage || staleErr.StateLineage != "foo" {
+					t.Fatalf("bad: %#v", staleErr)
+				}
+
+				// The state shouldn't have been touched
+				checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = bar
+				`)
+			}
+		})
+	}
+}
+
+func TestLocal_applyForcePlainOutput(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		b := TestLocal(t)
+		p := TestLocalProvider(t, b, "test")
+		ui := new(cli.MockUi)
+		b.CLI = ui
+		b.CLIColor = &colorstring.Colorize{Colors: colorstring.DefaultColors}
+		b.ForcePlainOutput = plain
+
+		p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+		mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+		defer modCleanup()
+
+		op := testOperationApply()
+		op.Module = mod
+
+		run, err := b.Operation(context.Background(), op)
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		<-run.Done()
+		if run.Err != nil {
+			t.Fatalf("err: %s", run.Err)
+		}
+
+		output := ui.OutputWriter.String()
+		if !strings.Contains(output, "Apply complete!") {
+			t.Fatalf("bad: %s", output)
+		}
+		if strings.Contains(output, "\x1b[") == plain {
+			t.Fatalf("plain %t: bad output: %q", plain, output)
+		}
+	}
+}
+
+func TestLocal_applyZeroColorize(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.CLIColor = &colorstring.Colorize{}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "Apply complete!") {
+		t.Fatalf("bad: %s", output)
+	}
+	for _, code := range []string{"\x1b[", "[reset]", "[bold]", "[green]"} {
+		if strings.Contains(output, code) {
+			t.Fatalf("output should be plain, found %q: %q", code, output)
+		}
+	}
+}
+
+func TestLocal_applyMetrics(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	c := new(testMetricsCollector)
+	op := testOperationApply()
+	op.Module = mod
+	op.Metrics = c
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if len(c.resources) != 1 {
+		t.Fatalf("bad: %#v", c.resources)
+	}
+	if r := c.resources[0]; r.addr != "test_instance.foo" || r.err != nil {
+		t.Fatalf("bad: %#v", r)
+	}
+
+	if len(c.finished) != 1 {
+		t.Fatalf("bad: %#v", c.finished)
+	}
+	f := c.finished[0]
+	if f.added != 1 || f.changed != 0 || f.removed != 0 || f.dur < c.resources[0].dur {
+		t.Fatalf("bad: %#v", f)
+	}
+}
+
+func TestLocal_applyResumeToken(t *testing.T) {
+	tokenPath := filepath.Join(testTempDir(t), "resume.json")
+
+	// The first run is interrupted after applying foo
+	b := TestLocal(t)
+	op := testOperationApply()
+	op.ResumeTokenOut = tokenPath
+	run := testApplyInterrupted(t, b, op)
+
+	token, err := readResumeToken(tokenPath)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual(token.Completed, []string{"test_instance.foo"}) {
+		t.Fatalf("bad: %#v", token.Completed)
+	}
+
+	// The second run resumes with the interrupted run's state, always
+	// planning a change to foo, and should skip applying it
+	b2 := TestLocal(t)
+	p := TestLocalProvider(t, b2, "test")
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{New: "bar"},
+			},
+		}, nil
+	}
+	terraform.TestStateFile(t, b2.StatePath, run.State)
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op = testOperationApply()
+	op.Module = mod
+	op.ResumeToken = tokenPath
+
+	run, err = b2.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called for a completed resource")
+	}
+}
+
+func TestLocal_applyResumeTokenLineage(t *testing.T) {
+	tokenPath := filepath.Join(testTempDir(t), "resume.json")
+	if err := writeResumeToken(tokenPath, "other", nil); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := testApplyState()
+	s.Lineage = "current"
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ResumeToken = tokenPath
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if !strings.Contains(run.Err.Error(), "lineage") {
+		t.Fatalf("bad: %s", run.Err)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyEmptyDestroy(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyEmptyDestroyError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+	op.ErrorOnEmptyDestroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if _, ok := run.Err.(*EmptyDestroyError); !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyEmptyDestroyErrorWithResources(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+	op.ErrorOnEmptyDestroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+	checkState(t, b.StateOutPath, `<no state>`)
+}
+
+func TestLocal_applyStateOutPath(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.StateOutPath = "custom.tfstate"
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "State path: custom.tfstate") {
+		t.Fatalf("bad: %s", output)
+	}
+	if strings.Contains(output, b.StateOutPath) {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyStateOutPathJSON(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.JSONUI = true
+	op.StateOutPath = "custom.tfstate"
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	var actual applySummaryJSON
+	if err := json.Unmarshal([]byte(output), &actual); err != nil {
+		t.Fatalf("err: %s\n\n%s", err, output)
+	}
+	if actual.StatePath != "custom.tfstate" {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyRefreshedCount(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	p.RefreshReturn = &terraform.InstanceState{ID: "bar"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanRefresh = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.RefreshCalled {
+		t.Fatal("refresh should be called")
+	}
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "Refreshed 1 resources.") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyRefreshedCountNoRefresh(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if strings.Contains(output, "Refreshed") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyRequestIDLogs(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	ctx := backend.ContextWithRequestID(context.Background(), "abc123")
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := buf.String()
+	expected := "[INFO] [request_id=abc123] backend/local: starting Apply operation"
+	if !strings.Contains(output, expected) {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLogWithContext(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	ctx := backend.ContextWithRequestID(context.Background(), "abc123")
+	cases := map[string]string{
+		"[WARN] backend/local: %s": "[WARN] [request_id=abc123] backend/local: foo\n",
+		"backend/local: %s":        "[request_id=abc123] backend/local: foo\n",
+	}
+
+	for format, expected := range cases {
+		buf.Reset()
+		logWithContext(ctx, format, "foo")
+		if actual := buf.String(); !strings.HasSuffix(actual, expected) {
+			t.Fatalf("%s: bad: %q", format, actual)
+		}
+	}
+
+	buf.Reset()
+	logWithContext(context.Background(), "[INFO] backend/local: %s", "foo")
+	if actual := buf.String(); strings.Contains(actual, "request_id") {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestLocal_applyMaxDuration(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	stopCh := make(chan struct{})
+	var stopOnce sync.Once
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		<-stopCh
+		return &terraform.InstanceState{ID: "yes"}, nil
+	}
+	p.StopFn = func() error {
+		stopOnce.Do(func() { close(stopCh) })
+		return nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+	op.MaxDuration = 50 * time.Millisecond
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	if _, ok := run.Err.(*DeadlineExceededError); !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+	if run.CancelReason != backend.CancelReasonMaxDuration {
+		t.Fatalf("bad: %q", run.CancelReason)
+	}
+	if !p.StopCalled {
+		t.Fatal("stop should be called")
+	}
+
+	// The partial state should be persisted
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+
+	// The state should be unlocked
+	s, err := b.State(backend.DefaultStateName)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	lockID, err := s.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatalf("state should be unlocked: %s", err)
+	}
+	if err := s.Unlock(lockID); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestLocal_applyOnLockAcquired(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := new(testLockIDState)
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var calls []string
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+	op.Environment = backend.DefaultStateName
+	op.OnLockAcquired = func(lockID string) {
+		calls = append(calls, lockID)
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !reflect.DeepEqual(calls, []string{testLockID}) {
+		t.Fatalf("bad: %#v", calls)
+	}
+	if s.unlockID != testLockID {
+		t.Fatalf("bad: %q", s.unlockID)
+	}
+}
+
+func TestLocal_applyOnLockAcquiredNoLock(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.OnLockAcquired = func(string) {
+		t.Fatal("should not be called without locking")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+}
+
+func TestLocal_applyOnLockAcquiredLockFailed(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	b.states = map[string]state.State{backend.DefaultStateName: new(testLockedState)}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+	op.Environment = backend.DefaultStateName
+	op.OnLockAcquired = func(string) {
+		t.Fatal("should not be called when locking fails")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestLocal_applyNonFatalResourceErrors(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			return nil, fmt.Errorf("tags not yet consistent")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	var demoted []string
+	op := testOperationApply()
+	op.Module = mod
+	op.NonFatalResourceErrors = func(addr string, err error) bool {
+		demoted = append(demoted, addr)
+		return strings.Contains(err.Error(), "not yet consistent")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !reflect.DeepEqual(demoted, []string{"test_instance.bar"}) {
+		t.Fatalf("bad: %#v", demoted)
+	}
+	if len(run.Warnings) != 1 ||
+		!strings.Contains(run.Warnings[0], "test_instance.bar") ||
+		!strings.Contains(run.Warnings[0], "tags not yet consistent") {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+
+	// The state is still persisted
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = foo
+	`)
+}
+
+func TestLocal_applyNonFatalResourceErrorsFatal(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			return nil, fmt.Errorf("error")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.NonFatalResourceErrors = func(addr string, err error) bool {
+		return false
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	_, ok := run.Err.(*ApplyError)
+	if !ok {
+		t.Fatalf("should be an ApplyError: %#v", run.Err)
+	}
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyNonFatalResourceErrorsModule(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	// Both resources fail with the same message
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		return nil, fmt.Errorf("tags not yet consistent")
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error-module")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.NonFatalResourceErrors = func(addr string, err error) bool {
+		return addr == "module.child.test_instance.bar"
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	// Only the error of the resource in the module is demoted
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if msg := run.Err.Error(); !strings.Contains(msg, "test_instance.bar") ||
+		strings.Contains(msg, "module.child") {
+		t.Fatalf("bad: %s", msg)
+	}
+	if len(run.Warnings) != 1 ||
+		!strings.Contains(run.Warnings[0], "module.child.test_instance.bar") {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyErrorUnlockError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.CLI = new(cli.MockUi)
+	b.states = map[string]state.State{backend.DefaultStateName: new(testUnlockFailState)}
+
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		return nil, errors.New("error")
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	defer testTmpDir(t)()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	// The unlock error is attached to the apply error
+	applyErr, ok := run.Err.(*ApplyError)
+	if !ok {
+		t.Fatalf("should be an ApplyError: %#v", run.Err)
+	}
+	if applyErr.UnlockErr == nil || !strings.Contains(applyErr.UnlockErr.Error(), "Error releasing the state lock") {
+		t.Fatalf("bad: %#v", applyErr.UnlockErr)
+	}
+}
+
+func TestLocal_applySavedPlanSummary(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	// Save a plan that adds both resources
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+	planOp := testOperationPlan()
+	planOp.Module = mod
+	planOp.PlanOutPath = filepath.Join(td, "plan.tfplan")
+	run, err := b.Operation(context.Background(), planOp)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if output := ui.OutputWriter.String(); !strings.Contains(output, "Plan: 2 to add, 0 to change, 0 to destroy.") {
+		t.Fatalf("bad: %s", output)
+	}
+	ui.OutputWriter.Reset()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Plan = testReadPlan(t, planOp.PlanOutPath)
+
+	run, err = b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	expected := "Applying saved plan: 2 to add, 0 to change, 0 to destroy."
+	if !strings.Contains(output, expected) {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyNoSavedPlanSummary(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if output := ui.OutputWriter.String(); strings.Contains(output, "Applying saved plan") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyErrorTerse(t *testing.T) {
+	cases := map[bool]bool{
+		false: true,
+		true:  false,
+	}
+
+	for terse, verbose := range cases {
+		b := TestLocal(t)
+		p := TestLocalProvider(t, b, "test")
+		b.TerseErrors = terse
+
+		p.ApplyFn = func(
+			*terraform.InstanceInfo,
+			*terraform.InstanceState,
+			*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+			return nil, fmt.Errorf("error")
+		}
+
+		mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+		defer modCleanup()
+
+		op := testOperationApply()
+		op.Module = mod
+
+		run, err := b.Operation(context.Background(), op)
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		<-run.Done()
+		if run.Err == nil {
+			t.Fatalf("%t: should error", terse)
+		}
+
+		msg := run.Err.Error()
+		if !strings.Contains(msg, "test_instance.foo: error") {
+			t.Fatalf("%t: bad: %s", terse, msg)
+		}
+		if actual := strings.Contains(msg, "does not automatically rollback"); actual != verbose {
+			t.Fatalf("%t: bad: %s", terse, msg)
+		}
+	}
+}
+
+func TestLocal_applyEphemeral(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.StateHistoryDir = filepath.Join(testTempDir(t), "history")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Ephemeral = true
+	op.LockState = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+	if run.State.RootModule().Resources["test_instance.foo"].Primary.ID != "yes" {
+		t.Fatalf("bad: %s", run.State)
+	}
+
+	// Nothing should be written
+	for _, path := range []string{
+		b.StateOutPath, b.StateOutPath + ".lock.info", b.StateHistoryDir,
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s should not exist: %s", path, err)
+		}
+	}
+}
+
+func TestLocal_applyEphemeralNoPersist(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := &testPersistFailState{}
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Ephemeral = true
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if s.calls != 0 {
+		t.Fatalf("persist should not be attempted: %d", s.calls)
+	}
+	if s.State() != nil {
+		t.Fatalf("state should not be written: %s", s.State())
+	}
+	if _, err := os.Stat(b.erroredStatePath()); !os.IsNotExist(err) {
+		t.Fatalf("errored state should not exist: %s", err)
+	}
+}
+
+func TestLocal_applySerial(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	s := testApplyState()
+	s.Serial = 3
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if run.PriorSerial != 3 {
+		t.Fatalf("bad: %d", run.PriorSerial)
+	}
+	if run.NewSerial <= run.PriorSerial {
+		t.Fatalf("bad: %d", run.NewSerial)
+	}
+}
+
+func TestLocal_applyConcurrentHooks(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	b.states = map[string]state.State{
+		"one": new(state.InmemState),
+		"two": new(state.InmemState),
+	}
+
+	// Make sure both applies are running at the same time. Each gets its
+	// own provider since the mock provider isn't safe to share.
+	var started sync.WaitGroup
+	started.Add(2)
+	b.ContextOpts.Providers["test"] = func() (terraform.ResourceProvider, error) {
+		p := new(terraform.MockResourceProvider)
+		p.DiffReturn = &terraform.InstanceDiff{}
+		p.ResourcesReturn = []terraform.ResourceType{
+			terraform.ResourceType{Name: "test_instance"},
+		}
+		p.ApplyFn = func(
+			*terraform.InstanceInfo,
+			*terraform.InstanceState,
+			*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+			started.Done()
+			started.Wait()
+			return &terraform.InstanceState{ID: "yes"}, nil
+		}
+		return p, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	hooks := map[string]*testApplyCountHook{
+		"one": new(testApplyCountHook),
+		"two": new(testApplyCountHook),
+	}
+
+	var wg sync.WaitGroup
+	for env, h := range hooks {
+		op := testOperationApply()
+		op.Module = mod
+		op.Environment = env
+		op.ExtraHooks = []terraform.Hook{h}
+
+		wg.Add(1)
+		go func(op *backend.Operation) {
+			defer wg.Done()
+
+			runningOp := &backend.RunningOperation{Context: context.Background()}
+			b.opApply(context.Background(), op, runningOp)
+			if runningOp.Err != nil {
+				t.Errorf("%s: err: %s", op.Environment, runningOp.Err)
+			}
+		}(op)
+	}
+	wg.Wait()
+
+	for env, h := range hooks {
+		if h.calls != 1 {
+			t.Fatalf("%s: expected 1 apply, got %d", env, h.calls)
+		}
+	}
+	if len(b.ContextOpts.Hooks) != 0 {
+		t.Fatalf("backend hooks should not be modified: %#v", b.ContextOpts.Hooks)
+	}
+}
+
+func TestLocal_applyDiffWriter(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{Old: "foo", New: "bar"},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var buf bytes.Buffer
+	op := testOperationApply()
+	op.Module = mod
+	op.DiffWriter = &buf
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	expected := "test_instance.foo: update\n  ami: \"foo\" => \"bar\"\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("bad: %q", actual)
+	}
+}
+
+func TestLocal_applyReadOnly(t *testing.T) {
+	for _, destroy := range []bool{false, true} {
+		b := TestLocal(t)
+		p := TestLocalProvider(t, b, "test")
+		b.ReadOnly = true
+		s := new(testLockInfoState)
+		b.states = map[string]state.State{backend.DefaultStateName: s}
+
+		mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+		defer modCleanup()
+
+		op := testOperationApply()
+		op.Module = mod
+		op.Destroy = destroy
+		op.LockState = true
+		op.Environment = backend.DefaultStateName
+
+		run, err := b.Operation(context.Background(), op)
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		<-run.Done()
+
+		readOnlyErr, ok := run.Err.(*ReadOnlyBackendError)
+		if !ok {
+			t.Fatalf("%t: bad: %#v", destroy, run.Err)
+		}
+		if expected := operationName(op); readOnlyErr.Operation != expected {
+			t.Fatalf("%t: bad: %q", destroy, readOnlyErr.Operation)
+		}
+
+		if s.info != nil {
+			t.Fatalf("%t: state should not be locked", destroy)
+		}
+		if p.DiffCalled || p.ApplyCalled {
+			t.Fatalf("%t: provider should not be called", destroy)
+		}
+	}
+}
+
+func TestLocal_applyOnApplyFailure(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			return nil, fmt.Errorf("error")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	var calls int
+	var failedState *terraform.State
+	var failedErr error
+	op := testOperationApply()
+	op.Module = mod
+	op.OnApplyFailure = func(s *terraform.State, err error) {
+		calls++
+		failedState = s
+		failedErr = err
+
+		// The partial state should already be persisted
+		checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = foo
+	`)
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	_, ok := run.Err.(*ApplyError)
+	if !ok {
+		t.Fatalf("should be an ApplyError: %#v", run.Err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+	if failedErr != run.Err {
+		t.Fatalf("bad: %#v", failedErr)
+	}
+	if !failedState.Equal(run.State) {
+		t.Fatalf("bad: %s", failedState)
+	}
+	if failedState.RootModule().Resources["test_instance.foo"].Primary.ID != "foo" {
+		t.Fatalf("bad: %s", failedState)
+	}
+}
+
+func TestLocal_applyOnApplyFailureSuccess(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.OnApplyFailure = func(*terraform.State, error) {
+		t.Fatal("should not be called")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+}
+
+func TestLocal_applyStateChanged(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !run.StateChanged {
+		t.Fatal("state should be changed")
+	}
+}
+
+func TestLocal_applyStateChangedNoChanges(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanRefresh = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.RefreshCalled {
+		t.Fatal("refresh should be called")
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+	if run.StateChanged {
+		t.Fatal("state should not be changed")
+	}
+}
+
+func TestLocal_applyResourceRetries(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	var lock sync.Mutex
+	attempts := 0
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if info.Id == "test_instance.bar" {
+			attempts++
+			if attempts == 1 {
+				return nil, fmt.Errorf("throttled")
+			}
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = testApplyRetryDiff
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ResourceRetries = 2
+	op.RetryableError = func(err error) bool {
+		return strings.Contains(err.Error(), "throttled")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+	if attempts != 2 {
+		t.Fatalf("bad: %d", attempts)
+	}
+	if err := run.ResourceResults["test_instance.bar"]; err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.bar:
+  ID = foo
+test_instance.foo:
+  ID = foo
+	`)
+}
+
+func TestLocal_applyResourceRetriesExhausted(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	var lock sync.Mutex
+	attempts := 0
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if info.Id == "test_instance.bar" {
+			attempts++
+			return nil, fmt.Errorf("throttled")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = testApplyRetryDiff
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ResourceRetries = 2
+	op.RetryableError = func(error) bool { return true }
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if attempts != 3 {
+		t.Fatalf("bad: %d", attempts)
+	}
+}
+
+func TestLocal_applyResourceRetriesCancel(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopCh := make(chan struct{})
+	var stopOnce sync.Once
+	var lock sync.Mutex
+	attempts := 0
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id != "test_instance.bar" {
+			return &terraform.InstanceState{ID: "foo"}, nil
+		}
+
+		lock.Lock()
+		attempts++
+		attempt := attempts
+		lock.Unlock()
+		if attempt == 1 {
+			return nil, fmt.Errorf("throttled")
+		}
+
+		// Cancel while the retry is applying and wait to be stopped
+		cancel()
+		select {
+		case <-stopCh:
+			return nil, fmt.Errorf("stopped")
+		case <-time.After(5 * time.Second):
+			return nil, fmt.Errorf("not stopped")
+		}
+	}
+	p.StopFn = func() error {
+		stopOnce.Do(func() { close(stopCh) })
+		return nil
+	}
+	p.DiffFn = testApplyRetryDiff
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ResourceRetries = 2
+	op.RetryableError = func(error) bool { return true }
+
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if !p.StopCalled {
+		t.Fatal("stop should be called")
+	}
+	if attempts != 2 {
+		t.Fatalf("bad: %d", attempts)
+	}
+	if err := run.ResourceResults["test_instance.bar"]; err == nil ||
+		!strings.Contains(err.Error(), "stopped") ||
+		strings.Contains(err.Error(), "not stopped") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestLocal_applyResourceRetriesNotRetryable(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	var lock sync.Mutex
+	attempts := 0
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if info.Id == "test_instance.bar" {
+			attempts++
+			if attempts == 1 {
+				return nil, fmt.Errorf("invalid")
+			}
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = testApplyRetryDiff
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ResourceRetries = 2
+	op.RetryableError = func(err error) bool {
+		return strings.Contains(err.Error(), "throttled")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if attempts != 1 {
+		t.Fatalf("bad: %d", attempts)
+	}
+}
+
+func TestLocal_applyResourceRetriesDependent(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	var lock sync.Mutex
+	attempts := 0
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if info.Id == "test_instance.bar" {
+			attempts++
+			if attempts == 1 {
+				return nil, fmt.Errorf("throttled")
+			}
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = testApplyRetryDiff
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error-depends")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ResourceRetries = 2
+	op.RetryableError = func(error) bool { return true }
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	// The dependent resource wasn't applied so nothing is retried
+	if attempts != 1 {
+		t.Fatalf("bad: %d", attempts)
+	}
+}
+
+func TestRetryTarget(t *testing.T) {
+	cases := []struct {
+		Path     []string
+		Key      string
+		Expected string
+	}{
+		{[]string{"root"}, "test_instance.foo", "test_instance.foo"},
+		{[]string{"root"}, "test_instance.foo.1", "test_instance.foo[1]"},
+		{[]string{"root"}, "data.test_ds.foo", "data.test_ds.foo"},
+		{[]string{"root"}, "data.test_ds.foo.0", "data.test_ds.foo[0]"},
+		{[]string{"root", "child"}, "test_instance.foo", "module.child.test_instance.foo"},
+		{[]string{"root", "a", "b"}, "test_instance.foo.2", "module.a.module.b.test_instance.foo[2]"},
+	}
+
+	for _, tc := range cases {
+		if actual := retryTarget(tc.Path, tc.Key); actual != tc.Expected {
+			t.Fatalf("%s: bad: %s", tc.Key, actual)
+		}
+	}
+}
+
+// testApplyRetryDiff is a DiffFn that always sets the ami.
+func testApplyRetryDiff(
+	*terraform.InstanceInfo,
+	*terraform.InstanceState,
+	*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+	return &terraform.InstanceDiff{
+		Attributes: map[string]*terraform.ResourceAttrDiff{
+			"ami": &terraform.ResourceAttrDiff{
+				New: "bar",
+			},
+		},
+	}, nil
+}
+
+func TestLocal_applySummaryPath(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SummaryPath = filepath.Join(testTempDir(t), "summary.json")
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	summary := testReadApplySummary(t, op.SummaryPath)
+	if !summary.Success || summary.Destroy || summary.Added != 1 ||
+		summary.Changed != 0 || summary.Removed != 0 || summary.Error != "" {
+		t.Fatalf("bad: %#v", summary)
+	}
+}
+
+func TestLocal_applySummaryPathError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			return nil, fmt.Errorf("error")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = testApplyRetryDiff
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SummaryPath = filepath.Join(testTempDir(t), "summary.json")
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	summary := testReadApplySummary(t, op.SummaryPath)
+	if summary.Success || summary.Added != 1 || summary.Error != run.Err.Error() {
+		t.Fatalf("bad: %#v", summary)
+	}
+}
+
+func TestLocal_applySummaryPathEarlyError(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	b.ReadOnly = true
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SummaryPath = filepath.Join(testTempDir(t), "summary.json")
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	summary := testReadApplySummary(t, op.SummaryPath)
+	if summary.Success || summary.Error != run.Err.Error() {
+		t.Fatalf("bad: %#v", summary)
+	}
+}
+
+func TestLocal_applySummaryPathDestroy(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	op := testOperationApply()
+	op.Destroy = true
+	op.SummaryPath = filepath.Join(testTempDir(t), "summary.json")
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	summary := testReadApplySummary(t, op.SummaryPath)
+	if !summary.Success || !summary.Destroy || summary.Removed != 1 {
+		t.Fatalf("bad: %#v", summary)
+	}
+}
+
+func testReadApplySummary(t *testing.T, path string) *applySummaryFileJSON {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var summary applySummaryFileJSON
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return &summary
+}
+
+func TestLocal_applyOutputFilter(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.OutputFilter = testRedactOutput
+	b.ApplySuccessTemplate = "Applied with token s3cr3t"
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if strings.Contains(output, "s3cr3t") || !strings.Contains(output, "Applied with token [REDACTED]") {
+		t.Fatalf("bad: %q", output)
+	}
+}
+
+func TestLocal_applyOutputFilterStopping(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.OutputFilter = testRedactOutput
+	b.ApplyStoppingMessage = "stopping s3cr3t"
+
+	testApplyInterrupted(t, b, testOperationApply())
+
+	output := ui.OutputWriter.String()
+	if strings.Contains(output, "s3cr3t") || !strings.Contains(output, "stopping [REDACTED]") {
+		t.Fatalf("bad: %q", output)
+	}
+}
+
+func TestLocal_backupStateForErrorOutputFilter(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.OutputFilter = testRedactOutput
+
+	// Use a directory as the path so that writing it fails
+	b.ErroredStatePath = testTempDir(t)
+
+	s := testApplyState()
+	s.RootModule().Resources["test_instance.foo"].Primary.Attributes = map[string]string{
+		"password": "s3cr3t",
+	}
+	b.backupStateForError(context.Background(), s, errors.New("persist s3cr3t failed"))
+
+	if output := ui.OutputWriter.String(); strings.Contains(output, "s3cr3t") ||
+		!strings.Contains(output, "[REDACTED]") {
+		t.Fatalf("bad: %q", output)
+	}
+	if output := ui.ErrorWriter.String(); strings.Contains(output, "s3cr3t") ||
+		!strings.Contains(output, "persist [REDACTED] failed") {
+		t.Fatalf("bad: %q", output)
+	}
+}
+
+// testRedactOutput is a Local.OutputFilter that redacts the test token.
+func testRedactOutput(s string) string {
+	return strings.Replace(s, "s3cr3t", "[REDACTED]", -1)
+}
+
+func TestLocal_applyDestroyFailedDestroys(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	terraform.TestStateFile(t, b.StatePath, testApplyStateTwoResources())
+
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			return nil, fmt.Errorf("error")
+		}
+
+		return nil, nil
+	}
+
+	op := testOperationApply()
+	op.Destroy = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	expected := []string{"test_instance.bar"}
+	if !reflect.DeepEqual(run.FailedDestroys, expected) {
+		t.Fatalf("bad: %#v", run.FailedDestroys)
+	}
+}
+
+func TestLocal_applyFailedDestroysNotDestroy(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		return nil, fmt.Errorf("error")
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if run.FailedDestroys != nil {
+		t.Fatalf("bad: %#v", run.FailedDestroys)
+	}
+}
+
+func TestLocal_applyCheckLockEvenWhenUnlocked(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := new(testLockIDState)
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+	op.CheckLockEvenWhenUnlocked = true
+	op.FailOnExistingLock = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+
+	// Checking the lock should release it again
+	if s.unlockID != testLockID {
+		t.Fatalf("bad: %q", s.unlockID)
+	}
+}
+
+func TestLocal_applyCheckLockEvenWhenUnlockedLocked(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.states = map[string]state.State{backend.DefaultStateName: new(testLockedState)}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+	op.CheckLockEvenWhenUnlocked = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+	if len(run.Warnings) != 1 || !strings.Contains(run.Warnings[0], "state locked") {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestCheckStateUnlocked_noLocalState(t *testing.T) {
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+
+	dir := filepath.Join(td, "sub")
+	path := filepath.Join(dir, "terraform.tfstate")
+	s := &state.BackupState{
+		Real: &state.LocalState{Path: path},
+		Path: path + DefaultBackupExtension,
+	}
+
+	if err := checkStateUnlocked(context.Background(), s); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Checking the lock shouldn't create the state file or its directory
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("state directory should not exist: %v", err)
+	}
+}
+
+func TestLocal_applyFailOnExistingLock(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.states = map[string]state.State{backend.DefaultStateName: new(testLockedState)}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+	op.CheckLockEvenWhenUnlocked = true
+	op.FailOnExistingLock = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	_, ok := run.Err.(*ExistingLockError)
+	if !ok {
+		t.Fatalf("should be an ExistingLockError: %#v", run.Err)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyWriteStateToStdout(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var buf bytes.Buffer
+	op := testOperationApply()
+	op.Module = mod
+	op.WriteStateToStdout = true
+	op.StateStdout = &buf
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	actual, err := terraform.ReadState(&buf)
+	if err != nil {
+		t.Fatalf("state should be written as JSON: %s", err)
+	}
+	if !actual.Equal(run.State) {
+		t.Fatalf("bad: %s", actual)
+	}
+	if actual.Serial != run.NewSerial {
+		t.Fatalf("bad: %d", actual.Serial)
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyWriteStateToStdoutUnset(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var buf bytes.Buffer
+	op := testOperationApply()
+	op.Module = mod
+	op.StateStdout = &buf
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
+
+func TestLocal_applyDestroyWarnThreshold(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyStateTwoResources())
+
+	var counts []int
+	op := testOperationApply()
+	op.Destroy = true
+	op.DestroyWarnThreshold = 1
+	op.DestroyGate = func(count int) error {
+		counts = append(counts, count)
+		return errors.New("too many")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil || !strings.Contains(run.Err.Error(), "too many") {
+		t.Fatalf("bad: %v", run.Err)
+	}
+	if !reflect.DeepEqual(counts, []int{2}) {
+		t.Fatalf("bad: %#v", counts)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	// Nothing should have been destroyed
+	checkState(t, b.StateOutPath, `
+test_instance.bar:
+  ID = baz
+test_instance.foo:
+  ID = bar
+	`)
+}
+
+func TestLocal_applyDestroyWarnThresholdNotExceeded(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyStateTwoResources())
+
+	op := testOperationApply()
+	op.Destroy = true
+	op.DestroyWarnThreshold = 2
+	op.DestroyGate = func(int) error {
+		t.Fatal("should not be called")
+		return nil
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+
+	checkState(t, b.StateOutPath, `<no state>`)
+}
+
+func TestLocal_applyDestroyWarnThresholdApply(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	// Neither bar nor baz are in the configuration so both are destroyed
+	s := testApplyStateTwoResources()
+	s.RootModule().Resources["test_instance.baz"] = &terraform.ResourceState{
+		Type:    "test_instance",
+		Primary: &terraform.InstanceState{ID: "qux"},
+	}
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var counts []int
+	op := testOperationApply()
+	op.Module = mod
+	op.DestroyWarnThreshold = 1
+	op.DestroyGate = func(count int) error {
+		counts = append(counts, count)
+		return nil
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+	if !reflect.DeepEqual(counts, []int{2}) {
+		t.Fatalf("bad: %#v", counts)
+	}
+	if len(run.Warnings) != 1 || !strings.Contains(run.Warnings[0], "destroys 2 resources") {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyProvenance(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Meta = map[string]string{"user": "alice", "job": "deploy-42"}
+
+	start := time.Now().UTC().Truncate(time.Second)
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	f, err := os.Open(b.StateOutPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	actual, err := terraform.ReadState(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	provenance := actual.Provenance
+	if provenance == nil {
+		t.Fatal("state should have provenance")
+	}
+	if !reflect.DeepEqual(provenance.Meta, op.Meta) {
+		t.Fatalf("bad: %#v", provenance.Meta)
+	}
+	if provenance.TFVersion != terraform.Version {
+		t.Fatalf("bad: %s", provenance.TFVersion)
+	}
+	applied, err := time.Parse(time.RFC3339, provenance.Time)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if applied.Before(start) || applied.After(time.Now()) {
+		t.Fatalf("bad: %s", applied)
+	}
+}
+
+func TestLocal_applyProvenanceNoop(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	// Neither apply changes any resources, so the second shouldn't rewrite
+	// the state with a new provenance and serial
+	var contents [][]byte
+	for _, job := range []string{"deploy-1", "deploy-2"} {
+		op := testOperationApply()
+		op.Module = mod
+		op.Meta = map[string]string{"job": job}
+
+		run, err := b.Operation(context.Background(), op)
+		if err != nil {
+			t.Fatalf("bad: %s", err)
+		}
+		<-run.Done()
+		if run.Err != nil {
+			t.Fatalf("err: %s", run.Err)
+		}
+		if run.StateChanged {
+			t.Fatal("state should not change")
+		}
+
+		raw, err := ioutil.ReadFile(b.StateOutPath)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		actual, err := terraform.ReadState(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if actual.Provenance != nil {
+			t.Fatalf("provenance should not be recorded: %#v", actual.Provenance)
+		}
+
+		contents = append(contents, raw)
+	}
+
+	if !bytes.Equal(contents[0], contents[1]) {
+		t.Fatalf("state should not be rewritten:\n\n%s\n\n%s", contents[0], contents[1])
+	}
+}
+
+func TestLocal_applyLockTimeouts(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	b.states = map[string]state.State{backend.DefaultStateName: new(testLockedState)}
+	b.LockTimeouts = map[string]time.Duration{
+		"apply":   10 * time.Millisecond,
+		"destroy": time.Hour,
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+	op.StateLockTimeout = time.Hour
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The timeout for applies is used rather than that of the operation
+	select {
+	case <-run.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("should time out obtaining the lock")
+	}
+	if run.Err == nil || !strings.Contains(run.Err.Error(), "Error locking state") {
+		t.Fatalf("bad: %v", run.Err)
+	}
+}
+
+func TestLocal_applyLockTimeoutsDestroy(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	b.states = map[string]state.State{backend.DefaultStateName: new(testLockedState)}
+	b.LockTimeouts = map[string]time.Duration{
+		"apply":   time.Hour,
+		"destroy": 10 * time.Millisecond,
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+	op.LockState = true
+	op.StateLockTimeout = time.Hour
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The timeout for destroys is used rather than that of applies
+	select {
+	case <-run.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("should time out obtaining the lock")
+	}
+	if run.Err == nil || !strings.Contains(run.Err.Error(), "Error locking state") {
+		t.Fatalf("bad: %v", run.Err)
+	}
+}
+
+func TestLocal_applyCostEstimate(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var estimated *terraform.Plan
+	op := testOperationApply()
+	op.Module = mod
+	op.CostEstimate = func(plan *terraform.Plan) (string, error) {
+		estimated = plan
+		return "[bold]Estimated cost: $12.34/month", nil
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	if estimated == nil {
+		t.Fatal("should estimate the plan")
+	}
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "Estimated cost: $12.34/month") || strings.Contains(output, "[bold]") {
+		t.Fatalf("bad: %q", output)
+	}
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+}
+
+func TestLocal_applyCostEstimateError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.CostEstimate = func(*terraform.Plan) (string, error) {
+		return "", errors.New("over budget")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil || !strings.Contains(run.Err.Error(), "over budget") {
+		t.Fatalf("bad: %v", run.Err)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyApprovedPlanHash(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	// Save the plan to approve
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+	planOp := testOperationPlan()
+	planOp.Module = mod
+	planOp.PlanOutPath = filepath.Join(td, "plan.tfplan")
+	run, err := b.Operation(context.Background(), planOp)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	plan := testReadPlan(t, planOp.PlanOutPath)
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Plan = plan
+	op.ApprovedPlanHash = PlanHash(plan)
+
+	run, err = b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+}
+
+func TestLocal_applyApprovedPlanHashNewPlan(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	// Approve a saved plan but apply without it, planning the same changes
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+	planOp := testOperationPlan()
+	planOp.Module = mod
+	planOp.PlanOutPath = filepath.Join(td, "plan.tfplan")
+	run, err := b.Operation(context.Background(), planOp)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ApprovedPlanHash = PlanHash(testReadPlan(t, planOp.PlanOutPath))
+
+	run, err = b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+}
+
+func TestLocal_applyApprovedPlanHashMismatch(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ApprovedPlanHash = PlanHash(&terraform.Plan{})
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	planErr, ok := run.Err.(*UnapprovedPlanError)
+	if !ok {
+		t.Fatalf("should be an UnapprovedPlanError: %#v", run.Err)
+	}
+	if planErr.Approved != op.ApprovedPlanHash || planErr.Actual == planErr.Approved {
+		t.Fatalf("bad: %#v", planErr)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyPhaseTimings(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanRefresh = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	testPhaseTimings(t, run.PhaseTimings, "refresh", "plan", "apply", "persist")
+}
+
+func TestLocal_applyPhaseTimingsSavedPlan(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+	planOp := testOperationPlan()
+	planOp.Module = mod
+	planOp.PlanOutPath = filepath.Join(td, "plan.tfplan")
+	run, err := b.Operation(context.Background(), planOp)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Plan = testReadPlan(t, planOp.PlanOutPath)
+	op.PlanRefresh = true
+
+	run, err = b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	// Refreshing and planning are skipped with a saved plan
+	testPhaseTimings(t, run.PhaseTimings, "apply", "persist")
+}
+
+// testPhaseTimings fails the test unless timings has exactly the given
+// phases.
+func testPhaseTimings(t *testing.T, timings map[string]time.Duration, phases ...string) {
+	if len(timings) != len(phases) {
+		t.Fatalf("bad: %#v", timings)
+	}
+	for _, phase := range phases {
+		if d, ok := timings[phase]; !ok || d < 0 {
+			t.Fatalf("bad %s: %#v", phase, timings)
+		}
+	}
+}
+
+func TestLocal_applyConcurrentModification(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	s := testApplyState()
+	s.Lineage = "test-lineage"
+	s.Serial = 1
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	// Simulate another run writing the state while we're planning
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		other := testApplyState()
+		other.Lineage = "test-lineage"
+		other.Serial = 2
+		terraform.TestStateFile(t, b.StatePath, other)
+
+		return testApplyRetryDiff(nil, nil, nil)
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	modErr, ok := run.Err.(*ConcurrentModificationError)
+	if !ok {
+		t.Fatalf("should be a ConcurrentModificationError: %#v", run.Err)
+	}
+	if modErr.PlannedSerial != 1 || modErr.CurrentSerial != 2 {
+		t.Fatalf("bad: %#v", modErr)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyIgnoreConcurrentChanges(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	s := testApplyState()
+	s.Lineage = "test-lineage"
+	s.Serial = 1
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		other := testApplyState()
+		other.Lineage = "test-lineage"
+		other.Serial = 2
+		terraform.TestStateFile(t, b.StatePath, other)
+
+		return testApplyRetryDiff(nil, nil, nil)
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.IgnoreConcurrentChanges = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+}
+
+func TestLocal_applyLogger(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	logger := new(testLogger)
+	b.Logger = logger
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	output := logger.String()
+	if !strings.Contains(output, "Apply complete! Resources: 1 added, 0 changed, 0 destroyed.") {
+		t.Fatalf("bad: %q", output)
+	}
+	if !strings.Contains(output, "State path: "+b.StateOutPath) {
+		t.Fatalf("bad: %q", output)
+	}
+	if strings.Contains(output, "\x1b[") {
+		t.Fatalf("logged messages shouldn't be colorized: %q", output)
+	}
+}
+
+func TestLocal_applyLoggerJSON(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	logger := new(testLogger)
+	b.Logger = logger
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.JSONUI = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	var summary applySummaryJSON
+	if err := json.Unmarshal([]byte(logger.String()), &summary); err != nil {
+		t.Fatalf("summary should be logged as JSON: %s\n\n%s", err, logger.String())
+	}
+	if !summary.Success || summary.Added != 1 {
+		t.Fatalf("bad: %#v", summary)
+	}
+}
+
+func TestLocal_applyLoggerStopping(t *testing.T) {
+	b := TestLocal(t)
+	logger := new(testLogger)
+	b.Logger = logger
+
+	testApplyInterrupted(t, b, testOperationApply())
+
+	if output := logger.String(); !strings.Contains(output, "stopping apply operation") {
+		t.Fatalf("bad: %q", output)
+	}
+}
+
+func TestLocal_applyPlanApprovalToken(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	td := testTempDir(t)
+	defer os.RemoveAll(td)
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanOnly = true
+	op.PlanOutPath = filepath.Join(td, "plan.tfplan")
+	op.GeneratePlanApprovalToken = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	// The token is for the plan that was saved
+	token := testDecodePlanApprovalToken(t, run.PlanApprovalToken)
+	if token.PlanHash != PlanHash(testReadPlan(t, op.PlanOutPath)) {
+		t.Fatalf("bad: %#v", token)
+	}
+	if _, err := time.Parse(time.RFC3339, token.Time); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestLocal_applyStateTransform(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{
+		ID: "yes",
+		Attributes: map[string]string{
+			"ami":   "bar",
+			"token": "secret",
+		},
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.StateTransform = func(s *terraform.State) (*terraform.State, error) {
+		result := s.DeepCopy()
+		for _, r := range result.RootModule().Resources {
+			delete(r.Primary.Attributes, "token")
+		}
+
+		return result, nil
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+  ami = bar
+	`)
+	if _, ok := run.State.RootModule().Resources["test_instance.foo"].Primary.Attributes["token"]; ok {
+		t.Fatalf("bad: %s", run.State)
+	}
+}
+
+func TestLocal_applyStateTransformError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	b.CLI = new(cli.MockUi)
+	b.ErroredStatePath = filepath.Join(testTempDir(t), "errored.tfstate")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.StateTransform = func(*terraform.State) (*terraform.State, error) {
+		return nil, errors.New("transform failed")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil || !strings.Contains(run.Err.Error(), b.ErroredStatePath) {
+		t.Fatalf("bad: %v", run.Err)
+	}
+	if output := b.CLI.(*cli.MockUi).ErrorWriter.String(); !strings.Contains(output, "transform failed") {
+		t.Fatalf("bad: %s", output)
+	}
+
+	// The untransformed state is backed up
+	checkState(t, b.ErroredStatePath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyQuiet(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.Quiet = true
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.PlanRefresh = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	if w := ui.OutputWriter; w != nil && w.Len() > 0 {
+		t.Fatalf("bad: %q", w.String())
+	}
+	if w := ui.ErrorWriter; w != nil && w.Len() > 0 {
+		t.Fatalf("bad: %q", w.String())
+	}
+}
+
+func TestLocal_applyQuietLock(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.Quiet = true
+
+	// Locking and unlocking are slow enough to output their messages
+	// without quiet mode
+	b.states = map[string]state.State{
+		backend.DefaultStateName: &testSlowLockState{Delay: clistate.LockThreshold + 50*time.Millisecond},
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+	op.LockState = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	if w := ui.OutputWriter; w != nil && w.Len() > 0 {
+		t.Fatalf("bad: %q", w.String())
+	}
+	if w := ui.ErrorWriter; w != nil && w.Len() > 0 {
+		t.Fatalf("bad: %q", w.String())
+	}
+}
+
+func TestLocal_applyQuietError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.Quiet = true
+	b.ErroredStatePath = filepath.Join(testTempDir(t), "errored.tfstate")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SimulateStateWriteError = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	if w := ui.OutputWriter; w != nil && w.Len() > 0 {
+		t.Fatalf("bad: %q", w.String())
+	}
+	if output := ui.ErrorWriter.String(); !strings.Contains(output, "Failed to save state") {
+		t.Fatalf("bad: %q", output)
+	}
+}
+
+func TestLocal_applyQuietStopping(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.Quiet = true
+
+	testApplyInterrupted(t, b, testOperationApply())
+
+	if output := ui.OutputWriter.String(); !strings.Contains(output, "stopping apply operation") {
+		t.Fatalf("bad: %q", output)
+	}
+}
+
+func TestLocal_applyCancelReason(t *testing.T) {
+	b := TestLocal(t)
+
+	run := testApplyInterrupted(t, b, testOperationApply())
+	if run.CancelReason != backend.CancelReasonCanceled {
+		t.Fatalf("bad: %q", run.CancelReason)
+	}
+}
+
+func TestLocal_applyCancelReasonDeadline(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	stopCh := make(chan struct{})
+	var stopOnce sync.Once
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		<-stopCh
+		return &terraform.InstanceState{ID: "yes"}, nil
+	}
+	p.StopFn = func() error {
+		stopOnce.Do(func() { close(stopCh) })
+		return nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	// The deadline of the context is reached before the maximum duration
+	op := testOperationApply()
+	op.Module = mod
+	op.MaxDuration = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	if run.CancelReason != backend.CancelReasonDeadline {
+		t.Fatalf("bad: %q", run.CancelReason)
+	}
+	if _, ok := run.Err.(*DeadlineExceededError); ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+}
+
+func TestLocal_applyCancelReasonNotCancelled(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("bad: %s", run.Err)
+	}
+	if run.CancelReason != "" {
+		t.Fatalf("bad: %q", run.CancelReason)
+	}
+}
+
+func TestLocal_applyStatePathMessage(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.StatePathMessage = "Saved to {{.StatePath}} (remote: {{.Remote}})"
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	expected := fmt.Sprintf("Saved to %s (remote: false)", b.StatePath)
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected %q in output:\n\n%s", expected, output)
+	}
+	if strings.Contains(output, "keep it safe") {
+		t.Fatalf("default message should not be output:\n\n%s", output)
+	}
+}
+
+func TestLocal_applyStatePathMessageDisabled(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.StatePathMessage = "-"
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	if strings.Contains(output, "State path") {
+		t.Fatalf("state path should not be output:\n\n%s", output)
+	}
+	if !strings.Contains(output, "Apply complete!") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_statePathMessageRemote(t *testing.T) {
+	b := TestLocal(t)
+	op := testOperationApply()
+
+	local := b.statePathMessage(context.Background(), op)
+	if !strings.Contains(local, "keep it safe") || !strings.Contains(local, b.StatePath) {
+		t.Fatalf("bad: %s", local)
+	}
+
+	b.Backend = &testDelegateBackend{}
+	remote := b.statePathMessage(context.Background(), op)
+	if strings.Contains(remote, "keep it safe") || strings.Contains(remote, "State path") {
+		t.Fatalf("remote message should not describe a local file: %s", remote)
+	}
+	if !strings.Contains(remote, "terraform show") {
+		t.Fatalf("bad: %s", remote)
+	}
+}
+
+func TestLocal_applySandbox(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyStateTwoResources())
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	before, err := ioutil.ReadFile(b.StatePath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SandboxApply = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+
+	sandbox := run.Sandbox
+	if sandbox == nil {
+		t.Fatal("sandbox result should be set")
+	}
+	if sandbox.Added != 0 || sandbox.Changed != 0 || sandbox.Removed != 1 {
+		t.Fatalf("bad: %#v", sandbox)
+	}
+	if sandbox.Diff == nil {
+		t.Fatal("diff should be set")
+	}
+	rd := sandbox.Diff.RootModule().Resources["test_instance.bar"]
+	if rd == nil || !rd.Destroy {
+		t.Fatalf("bad: %s", sandbox.Diff)
+	}
+	if _, ok := run.State.RootModule().Resources["test_instance.bar"]; ok {
+		t.Fatalf("sandbox state should have the resource removed: %s", run.State)
+	}
+
+	// The real state should be untouched
+	after, err := ioutil.ReadFile(b.StatePath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("state should not change:\n\n%s\n\n%s", before, after)
+	}
+	checkState(t, b.StatePath, `
+test_instance.bar:
+  ID = baz
+test_instance.foo:
+  ID = bar
+`)
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "sandbox apply") {
+		t.Fatalf("bad: %s", output)
+	}
+	if strings.Contains(output, "State path") {
+		t.Fatalf("state path should not be output:\n\n%s", output)
+	}
+}
+
+func TestLocal_applySandboxNoPersist(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := &testPersistFailState{}
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SandboxApply = true
+	op.LockState = true
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if s.calls != 0 {
+		t.Fatalf("persist should not be attempted: %d", s.calls)
+	}
+	if s.State() != nil {
+		t.Fatalf("state should not be written: %s", s.State())
+	}
+	if run.Sandbox == nil || run.Sandbox.Added != 1 {
+		t.Fatalf("bad: %#v", run.Sandbox)
+	}
+}
+
+func TestLocal_applyFutureState(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := testApplyState()
+	s.TFVersion = "99.0.0"
+	terraform.TestStateFile(t, b.StatePath, s)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	// Without a strict check, the apply only warns
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if len(run.Warnings) != 1 || !strings.Contains(run.Warnings[0], "99.0.0") {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+	if output := ui.ErrorWriter.String(); !strings.Contains(output, "may corrupt") {
+		t.Fatalf("bad: %s", output)
+	}
+
+	// The state is written by this version now
+	f, err := os.Open(b.StateOutPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	actual, err := terraform.ReadState(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if actual.TFVersion != terraform.Version {
+		t.Fatalf("bad: %s", actual.TFVersion)
+	}
+}
+
+func TestLocal_applyFutureStateStrict(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := testApplyState()
+	s.TFVersion = "99.0.0"
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.StrictVersionCheck = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	versionErr, ok := run.Err.(*FutureStateError)
+	if !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+	if versionErr.StateVersion != "99.0.0" || versionErr.Version != terraform.Version {
+		t.Fatalf("bad: %#v", versionErr)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	checkState(t, b.StatePath, `
+test_instance.foo:
+  ID = bar
+`)
+}
+
+func TestLocal_applyFutureStateCurrent(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	s := testApplyState()
+	s.TFVersion = terraform.Version
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.StrictVersionCheck = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyLogFile(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LogFile = filepath.Join(testTempDir(t), "apply.log")
+
+	ctx := backend.ContextWithRequestID(context.Background(), "abc123")
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	data, err := ioutil.ReadFile(op.LogFile)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	actual := string(data)
+	for _, expected := range []string{
+		"[INFO] [request_id=abc123] backend/local: starting Apply operation",
+		"[INFO] [request_id=abc123] backend/local: apply phase timings: ",
+	} {
+		if !strings.Contains(actual, expected) {
+			t.Fatalf("expected %q in log file:\n\n%s", expected, actual)
+		}
+	}
+}
+
+func TestLocal_applyLogFileError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LogFile = filepath.Join(testTempDir(t), "missing", "apply.log")
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil || !strings.Contains(run.Err.Error(), "Error opening log file") {
+		t.Fatalf("bad: %v", run.Err)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyProviderHashes(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.ContextOpts.ProviderPaths = map[string]string{"test": testProviderPlugin(t)}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ExpectedProviderHashes = map[string]string{"test": testProviderPluginHash}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+}
+
+func TestLocal_applyProviderHashesMismatch(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	path := testProviderPlugin(t)
+	b.ContextOpts.ProviderPaths = map[string]string{"test": path}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	expected := "d9298a10d1b0735837dc4bd85dac641b0f3cef27a47e5d53a54f2f3f5b2fcffa"
+	op := testOperationApply()
+	op.Module = mod
+	op.ExpectedProviderHashes = map[string]string{"test": expected}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	checksumErr, ok := run.Err.(*ProviderChecksumError)
+	if !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+	if checksumErr.Provider != "test" || checksumErr.Path != path ||
+		checksumErr.Expected != expected || checksumErr.Actual != testProviderPluginHash {
+		t.Fatalf("bad: %#v", checksumErr)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyProviderHashesUnknownPath(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ExpectedProviderHashes = map[string]string{"test": testProviderPluginHash}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	checksumErr, ok := run.Err.(*ProviderChecksumError)
+	if !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+	if checksumErr.Path != "" || checksumErr.Actual != "" {
+		t.Fatalf("bad: %#v", checksumErr)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyOnComplete(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var results []backend.ApplyResult
+	op := testOperationApply()
+	op.Module = mod
+	op.OnComplete = func(result backend.ApplyResult) {
+		results = append(results, result)
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("bad: %#v", results)
+	}
+	result := results[0]
+	if !result.Success || result.Err != nil || result.Destroy {
+		t.Fatalf("bad: %#v", result)
+	}
+	if result.Added != 1 || result.Changed != 0 || result.Removed != 0 {
+		t.Fatalf("bad: %#v", result)
+	}
+	if _, ok := result.PhaseTimings["apply"]; !ok {
+		t.Fatalf("bad: %#v", result.PhaseTimings)
+	}
+	if result.PriorSerial != run.PriorSerial || result.NewSerial != run.NewSerial {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestLocal_applyOnCompleteDestroy(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	s := testApplyState()
+	s.Serial = 3
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var result backend.ApplyResult
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+	op.OnComplete = func(r backend.ApplyResult) { result = r }
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !result.Success || !result.Destroy || result.Removed != 1 {
+		t.Fatalf("bad: %#v", result)
+	}
+	if result.PriorSerial != 3 || result.NewSerial <= 3 {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestLocal_applyOnCompleteError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		return nil, errors.New("error")
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var results []backend.ApplyResult
+	op := testOperationApply()
+	op.Module = mod
+	op.OnComplete = func(result backend.ApplyResult) {
+		results = append(results, result)
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("bad: %#v", results)
+	}
+	result := results[0]
+	if result.Success || result.Err != run.Err || result.Added != 0 {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestLocal_applyOnCompleteReadOnly(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	b.ReadOnly = true
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var results []backend.ApplyResult
+	op := testOperationApply()
+	op.Module = mod
+	op.OnComplete = func(result backend.ApplyResult) {
+		results = append(results, result)
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	if len(results) != 1 || results[0].Success {
+		t.Fatalf("bad: %#v", results)
+	}
+	if _, ok := results[0].Err.(*ReadOnlyBackendError); !ok {
+		t.Fatalf("bad: %#v", results[0].Err)
+	}
+}
+
+func TestLocal_applySkipStatePersist(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := &testPersistFailState{}
+	if err := s.WriteState(testApplyStateTwoResources()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var result backend.ApplyResult
+	op := testOperationApply()
+	op.Module = mod
+	op.SkipStatePersist = true
+	op.Environment = backend.DefaultStateName
+	op.OnComplete = func(r backend.ApplyResult) { result = r }
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+	if result.Removed != 1 {
+		t.Fatalf("bad: %#v", result)
+	}
+	if s.calls != 0 {
+		t.Fatalf("persist should not be attempted: %d", s.calls)
+	}
+	if _, ok := s.State().RootModule().Resources["test_instance.bar"]; !ok {
+		t.Fatalf("state should not be written: %s", s.State())
+	}
+	if _, err := os.Stat(b.erroredStatePath()); !os.IsNotExist(err) {
+		t.Fatalf("errored state should not exist: %s", err)
+	}
+}
+
+func TestLocal_applySkipStatePersistFile(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyStateTwoResources())
+	b.StateHistoryDir = filepath.Join(testTempDir(t), "history")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SkipStatePersist = true
+	op.LockState = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	checkState(t, b.StatePath, `
+test_instance.bar:
+  ID = baz
+test_instance.foo:
+  ID = bar
+`)
+	for _, path := range []string{b.StateBackupPath, b.StateHistoryDir} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s should not exist: %s", path, err)
+		}
+	}
+	if output := ui.OutputWriter.String(); strings.Contains(output, "State path") {
+		t.Fatalf("state path should not be output:\n\n%s", output)
+	}
+}
+
+func TestLocal_applyUnexpectedResources(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	// Only what was planned was added
+	if len(run.UnexpectedResources) != 0 {
+		t.Fatalf("bad: %#v", run.UnexpectedResources)
+	}
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestUnexpectedResources(t *testing.T) {
+	diff := &terraform.Diff{
+		Modules: []*terraform.ModuleDiff{
+			&terraform.ModuleDiff{
+				Path: []string{"root"},
+				Resources: map[string]*terraform.InstanceDiff{
+					"test_instance.foo": &terraform.InstanceDiff{
+						Attributes: map[string]*terraform.ResourceAttrDiff{
+							"ami": &terraform.ResourceAttrDiff{New: "bar", RequiresNew: true},
+						},
+					},
+				},
+			},
+			&terraform.ModuleDiff{
+				Path: []string{"root", "child"},
+				Resources: map[string]*terraform.InstanceDiff{
+					"test_instance.bar": &terraform.InstanceDiff{
+						Attributes: map[string]*terraform.ResourceAttrDiff{
+							"ami": &terraform.ResourceAttrDiff{New: "bar", RequiresNew: true},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// The hook reports more additions than were planned
+	h := new(CountHook)
+	for _, info := range []*terraform.InstanceInfo{
+		&terraform.InstanceInfo{Id: "test_instance.foo"},
+		&terraform.InstanceInfo{Id: "test_instance.bar", ModulePath: []string{"root", "child"}},
+		&terraform.InstanceInfo{Id: "test_instance.side_effect"},
+		&terraform.InstanceInfo{Id: "test_instance.other", ModulePath: []string{"root", "child"}},
+	} {
+		h.PreApply(info, &terraform.InstanceState{}, &terraform.InstanceDiff{})
+		h.PostApply(info, nil, nil)
+	}
+
+	actual := unexpectedResources(plannedAdditions(diff), h)
+	expected := []string{
+		"module.child.test_instance.other",
+		"test_instance.side_effect",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+
+	if h.Added <= countDiff(diff).ToAdd {
+		t.Fatalf("bad: %d", h.Added)
+	}
+}
+
+func TestLocal_applyBreakpoint(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	hitCh := make(chan string)
+	continueCh := make(chan struct{})
+	op := testOperationApply()
+	op.Module = mod
+	op.Breakpoints = map[string]bool{"test_instance.foo": true}
+	op.OnBreakpoint = func(addr string, s *terraform.State) error {
+		if s == nil {
+			t.Errorf("state should be given")
+		}
+
+		hitCh <- addr
+		<-continueCh
+		return nil
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if addr := <-hitCh; addr != "test_instance.foo" {
+		t.Fatalf("bad: %s", addr)
+	}
+
+	// The apply should wait for the breakpoint
+	select {
+	case <-run.Done():
+		t.Fatal("apply should be blocked at the breakpoint")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.Lock()
+	called := p.ApplyCalled
+	p.Unlock()
+	if called {
+		t.Fatal("apply should not be called before the breakpoint returns")
+	}
+
+	close(continueCh)
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+`)
+}
+
+func TestLocal_applyBreakpointError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Breakpoints = map[string]bool{"test_instance.foo": true}
+	op.OnBreakpoint = func(string, *terraform.State) error {
+		return errors.New("abort")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil || !strings.Contains(run.Err.Error(), "Breakpoint at test_instance.foo: abort") {
+		t.Fatalf("bad: %v", run.Err)
+	}
+
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+}
+
+func TestLocal_applyBreakpointParallel(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.ContextOpts.Parallelism = 4
+
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		time.Sleep(5 * time.Millisecond)
+		return &terraform.InstanceState{ID: "yes"}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-parallel")
+	defer modCleanup()
+
+	// Read the state repeatedly while the other resources are applied and
+	// update it, so that the race detector catches any shared access
+	hits := 0
+	op := testOperationApply()
+	op.Module = mod
+	op.Breakpoints = map[string]bool{"test_instance.bar": true}
+	op.OnBreakpoint = func(addr string, s *terraform.State) error {
+		hits++
+		for i := 0; i < 10; i++ {
+			if s.String() == "" {
+				return errors.New("state should be given")
+			}
+			s.RootModule().Resources["test_instance.breakpoint"] = &terraform.ResourceState{
+				Type:    "test_instance",
+				Primary: &terraform.InstanceState{ID: "modified"},
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		return nil
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if hits != 1 {
+		t.Fatalf("expected the breakpoint to be hit once, got %d", hits)
+	}
+	resources := run.State.RootModule().Resources
+	if len(resources) != 6 {
+		t.Fatalf("bad: %s", run.State)
+	}
+	if _, ok := resources["test_instance.breakpoint"]; ok {
+		t.Fatalf("the breakpoint shouldn't modify the state: %s", run.State)
+	}
+}
+
+func TestLocal_applyJSONStream(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var stream bytes.Buffer
+	op := testOperationApply()
+	op.Module = mod
+	op.JSONStream = &stream
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	// The human-readable summary is still output
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "Apply complete! Resources: 1 added, 0 changed, 0 destroyed.") {
+		t.Fatalf("bad: %s", output)
+	}
+	if strings.Contains(output, `"success"`) {
+		t.Fatalf("JSON should not be output to the UI:\n%s", output)
+	}
+
+	var actual applySummaryJSON
+	if err := json.Unmarshal(stream.Bytes(), &actual); err != nil {
+		t.Fatalf("err: %s\n\n%s", err, stream.String())
+	}
+
+	expected := applySummaryJSON{
+		Success:   true,
+		Added:     1,
+		StatePath: b.StateOutPath,
+	}
+	if actual != expected {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyJSONStreamError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		return nil, errors.New("error")
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var stream bytes.Buffer
+	op := testOperationApply()
+	op.Module = mod
+	op.JSONStream = &stream
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	var actual applySummaryJSON
+	if err := json.Unmarshal(stream.Bytes(), &actual); err != nil {
+		t.Fatalf("err: %s\n\n%s", err, stream.String())
+	}
+	if actual.Success || actual.Added != 0 {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyStateSigner(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var signed []byte
+	op := testOperationApply()
+	op.Module = mod
+	op.StateSigner = func(data []byte) ([]byte, error) {
+		signed = data
+		sum := sha256.Sum256(data)
+		return []byte(hex.EncodeToString(sum[:])), nil
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	// The state that was signed is the state that was written
+	data, err := ioutil.ReadFile(b.StateOutPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(signed, data) {
+		t.Fatalf("signed state doesn't match:\n\n%s\n\n%s", signed, data)
+	}
+
+	sig, err := ioutil.ReadFile(b.StateOutPath + ".sig")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sum := sha256.Sum256(data)
+	if expected := hex.EncodeToString(sum[:]); string(sig) != expected {
+		t.Fatalf("bad: %s", sig)
+	}
+}
+
+func TestLocal_applyStateSignerError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.StateSigner = func([]byte) ([]byte, error) {
+		return nil, errors.New("no key")
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if len(run.Warnings) != 1 || !strings.Contains(run.Warnings[0], "Failed to sign state: no key") {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+	if _, err := os.Stat(b.StateOutPath + ".sig"); !os.IsNotExist(err) {
+		t.Fatalf("signature should not exist: %s", err)
+	}
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = yes
+`)
+}
+
+func TestLocal_applyStateSignerNoPath(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.StateOutPath = ""
+	b.states = map[string]state.State{backend.DefaultStateName: new(state.InmemState)}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	defer testTmpDir(t)()
+
+	signed := false
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+	op.StateSigner = func([]byte) ([]byte, error) {
+		signed = true
+		return []byte("sig"), nil
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if signed {
+		t.Fatal("state should not be signed")
+	}
+	if len(run.Warnings) != 1 || !strings.Contains(run.Warnings[0], "no local state path") {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+	if _, err := os.Stat(".sig"); !os.IsNotExist(err) {
+		t.Fatalf("signature should not exist: %s", err)
+	}
+}
+
+func TestLocal_applyChangeDetector(t *testing.T) {
+	b := TestLocal(t)
+	p := testApplyTimestampProvider(t, b)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.ChangeDetector = func(before, after *terraform.State) bool {
+		return !testStripTimestamps(after).Equal(testStripTimestamps(before))
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+	if run.StateChanged {
+		t.Fatal("state should not be changed when only the timestamp changed")
+	}
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "No changes. Infrastructure is up-to-date.") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyChangeDetectorDefault(t *testing.T) {
+	b := TestLocal(t)
+	testApplyTimestampProvider(t, b)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if !run.StateChanged {
+		t.Fatal("state should be changed")
+	}
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "Apply complete! Resources: 0 added, 1 changed, 0 destroyed.") {
+		t.Fatalf("bad: %s", output)
+	}
+}
+
+func TestLocal_applyWebhook(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	reqCh := make(chan *http.Request, 1)
+	bodyCh := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqCh <- r
+		bodyCh <- body
+	}))
+	defer srv.Close()
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Webhook = &backend.Webhook{
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	req := <-reqCh
+	if req.Method != "POST" {
+		t.Fatalf("bad: %s", req.Method)
+	}
+	if v := req.Header.Get("Content-Type"); v != "application/json" {
+		t.Fatalf("bad: %s", v)
+	}
+	if v := req.Header.Get("Authorization"); v != "Bearer token" {
+		t.Fatalf("bad: %s", v)
+	}
+
+	var actual applySummaryFileJSON
+	if err := json.Unmarshal(<-bodyCh, &actual); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	actual.Duration = 0
+	expected := applySummaryFileJSON{Success: true, Added: 1}
+	if actual != expected {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyWebhookError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		return nil, errors.New("error")
+	}
+
+	bodyCh := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodyCh <- body
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Webhook = &backend.Webhook{URL: srv.URL}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	var actual applySummaryFileJSON
+	if err := json.Unmarshal(<-bodyCh, &actual); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if actual.Success || actual.Error != run.Err.Error() {
+		t.Fatalf("bad: %#v", actual)
+	}
+
+	// The webhook failing doesn't affect the apply
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyWebhookSlow(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	releaseCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(doneCh)
+		<-releaseCh
+	}))
+	defer srv.Close()
+	defer close(releaseCh)
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Webhook = &backend.Webhook{URL: srv.URL, Timeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The apply waits for the webhook, but only until it times out
+	select {
+	case <-run.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("apply should not wait past the webhook timeout")
+	}
+	if elapsed := time.Since(start); elapsed < op.Webhook.Timeout {
+		t.Fatalf("apply didn't wait for the webhook: %s", elapsed)
+	}
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	select {
+	case <-doneCh:
+		t.Fatal("webhook should still be waiting")
+	default:
+	}
+}
+
+func TestLocal_applyWebhookInterrupted(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Interrupt the apply while the resource is applying
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		cancel()
+		return &terraform.InstanceState{ID: "yes"}, nil
+	}
+
+	bodyCh := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodyCh <- body
+	}))
+	defer srv.Close()
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Webhook = &backend.Webhook{URL: srv.URL}
+
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	// The summary is posted before the operation is done
+	select {
+	case body := <-bodyCh:
+		var actual applySummaryFileJSON
+		if err := json.Unmarshal(body, &actual); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	default:
+		t.Fatal("webhook should be posted to")
+	}
+}
+
+func TestLocal_applyWebhookEarlyError(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	b.ReadOnly = true
+
+	bodyCh := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodyCh <- body
+	}))
+	defer srv.Close()
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Webhook = &backend.Webhook{URL: srv.URL}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	// The webhook has been posted to by the time the apply is done
+	select {
+	case body := <-bodyCh:
+		var actual applySummaryFileJSON
+		if err := json.Unmarshal(body, &actual); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if actual.Success || actual.Error != run.Err.Error() {
+			t.Fatalf("bad: %#v", actual)
+		}
+	default:
+		t.Fatal("webhook should be posted to")
+	}
+}
+
+func TestLocal_applyProvisionerOutput(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	pr := new(terraform.MockResourceProvisioner)
+	b.ContextOpts.Provisioners = map[string]terraform.ResourceProvisionerFactory{
+		"shell": func() (terraform.ResourceProvisioner, error) { return pr, nil },
+	}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+	pr.ApplyFn = func(*terraform.InstanceState, *terraform.ResourceConfig) error {
+		pr.ApplyOutput.Output("step one")
+		pr.ApplyOutput.Output("step two")
+		return errors.New("exit status 1")
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-provisioner")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	expected := map[string]string{
+		"test_instance.foo": "step one\nstep two\n",
+	}
+	if !reflect.DeepEqual(run.ProvisionerOutput, expected) {
+		t.Fatalf("bad: %#v", run.ProvisionerOutput)
+	}
+}
+
+func TestLocal_applyTargetingWarning(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Targets = []string{"test_instance.foo"}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+
+	expected := fmt.Sprintf(applyTargetingWarning, "test_instance.foo")
+	if len(run.Warnings) != 1 || run.Warnings[0] != expected {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+	if output := ui.ErrorWriter.String(); !strings.Contains(output, "Warning: "+expected) {
+		t.Fatalf("bad: %q", output)
+	}
+}
+
+func TestLocal_applyTargetingRefused(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Targets = []string{"test_instance.foo"}
+	op.RefuseTargeting = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	targetErr, ok := run.Err.(*UnacknowledgedTargetingError)
+	if !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+	if !reflect.DeepEqual(targetErr.Targets, []string{"test_instance.foo"}) {
+		t.Fatalf("bad: %#v", targetErr.Targets)
+	}
+	if p.ApplyCalled {
+		t.Fatal("apply should not be called")
+	}
+
+	checkState(t, b.StatePath, `
+test_instance.foo:
+  ID = bar
+`)
+}
+
+func TestLocal_applyTargetingAcknowledged(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Targets = []string{"test_instance.foo"}
+	op.AckTargeting = true
+	op.RefuseTargeting = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+	if len(run.Warnings) != 0 {
+		t.Fatalf("bad: %#v", run.Warnings)
+	}
+}
+
+func TestLocal_applyPreflight(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Preflight = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+	if !p.ApplyCalled {
+		t.Fatal("apply should be called")
+	}
+}
+
+func TestLocal_applyPreflightUnavailable(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := new(testRefreshFailState)
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.LockState = true
+	op.Preflight = true
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	unavailableErr, ok := run.Err.(*BackendUnavailableError)
+	if !ok {
+		t.Fatalf("bad: %#v", run.Err)
+	}
+	if unavailableErr.Err.Error() != "connection refused" {
+		t.Fatalf("bad: %s", unavailableErr.Err)
+	}
+	if s.locks != 0 {
+		t.Fatalf("state should not be locked, locked %d times", s.locks)
+	}
+	if p.DiffCalled || p.ApplyCalled {
+		t.Fatal("nothing should be planned or applied")
+	}
+}
+
+func TestLocal_applyStopOnError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+
+	// foo only completes once the provider is stopped, so the apply only
+	// completes if the error from bar stops it. bar waits for foo to start
+	// so that foo is already applying when it is stopped.
+	startCh := make(chan struct{})
+	stopCh := make(chan struct{})
+	var stopOnce sync.Once
+	p.StopFn = func() error {
+		stopOnce.Do(func() { close(stopCh) })
+		return nil
+	}
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			<-startCh
+			return nil, fmt.Errorf("error")
+		}
+
+		close(startCh)
+		select {
+		case <-stopCh:
+		case <-time.After(5 * time.Second):
+			return nil, fmt.Errorf("not stopped")
+		}
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.StopOnError = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+	if strings.Contains(run.Err.Error(), "not stopped") {
+		t.Fatalf("apply should have been stopped: %s", run.Err)
+	}
+
+	if !p.StopCalled {
+		t.Fatal("provider should be stopped")
+	}
+
+	// foo was already applying so it should still complete
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = foo
+	`)
+}
+
+func TestLocal_applyEventStream(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	var buf bytes.Buffer
+	op := testOperationApply()
+	op.Module = mod
+	op.EventStream = &buf
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	events := testReadEventStream(t, &buf)
+	pre := make(map[string]int)
+	post := make(map[string]int)
+	for i, e := range events {
+		if i > 0 && e.Timestamp.Before(events[i-1].Timestamp) {
+			t.Fatalf("%d: events out of order: %#v", i, events)
+		}
+
+		switch e.Type {
+		case "pre_apply":
+			if e.Action != "create" {
+				t.Fatalf("%d: bad action: %#v", i, e)
+			}
+			pre[e.Address] = i
+		case "post_apply":
+			if e.Error != "" {
+				t.Fatalf("%d: bad error: %#v", i, e)
+			}
+			post[e.Address] = i
+		}
+	}
+
+	for _, addr := range []string{"test_instance.foo", "test_instance.bar"} {
+		preIdx, ok := pre[addr]
+		if !ok {
+			t.Fatalf("no pre_apply event for %s: %#v", addr, events)
+		}
+		postIdx, ok := post[addr]
+		if !ok {
+			t.Fatalf("no post_apply event for %s: %#v", addr, events)
+		}
+		if preIdx > postIdx {
+			t.Fatalf("post_apply before pre_apply for %s: %#v", addr, events)
+		}
+	}
+}
+
+func TestLocal_applyJSONDestroy(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+	op.JSONUI = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	output := ui.OutputWriter.String()
+	var actual destroySummaryJSON
+	if err := json.Unmarshal([]byte(output), &actual); err != nil {
+		t.Fatalf("err: %s\n\n%s", err, output)
+	}
+
+	expected := destroySummaryJSON{
+		Success:   true,
+		Destroyed: 1,
+		StatePath: b.StateOutPath,
+	}
+	if actual != expected {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyJSONError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	p.ApplyFn = func(
+		info *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Id == "test_instance.bar" {
+			return nil, fmt.Errorf("error")
+		}
+
+		return &terraform.InstanceState{ID: "foo"}, nil
+	}
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"ami": &terraform.ResourceAttrDiff{
+					New: "bar",
+				},
+			},
+		}, nil
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.JSONUI = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	output := ui.OutputWriter.String()
+	var actual applySummaryJSON
+	if err := json.Unmarshal([]byte(output), &actual); err != nil {
+		t.Fatalf("err: %s\n\n%s", err, output)
+	}
+
+	expected := applySummaryJSON{
+		Success:   false,
+		Added:     1,
+		StatePath: b.StateOutPath,
+	}
+	if actual != expected {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyBackupStateForError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.states = map[string]state.State{
+		backend.DefaultStateName: new(testPersistFailState),
+	}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	// The errored state is written to the working directory by default
+	defer testTmpDir(t)()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	expected := fmt.Sprintf(stateWriteBackedUpError, DefaultErroredStateFilename)
+	if run.Err.Error() != expected {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	checkState(t, DefaultErroredStateFilename, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applySimulateStateWriteError(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	terraform.TestStateFile(t, b.StatePath, testApplyState())
+	b.ErroredStatePath = filepath.Join(filepath.Dir(b.StatePath), "errored.tfstate")
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.SimulateStateWriteError = true
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+
+	expected := fmt.Sprintf(stateWriteBackedUpError, b.ErroredStatePath)
+	if run.Err == nil || run.Err.Error() != expected {
+		t.Fatalf("bad: %s", run.Err)
+	}
+
+	checkState(t, b.ErroredStatePath, `
+test_instance.bar:
+  ID = yes
+test_instance.foo:
+  ID = bar
+	`)
+
+	// The real state should be untouched
+	checkState(t, b.StateOutPath, `
+test_instance.foo:
+  ID = bar
+	`)
+}
+
+func TestLocal_applyBackupStateForErrorPath(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.ErroredStatePath = filepath.Join(filepath.Dir(b.StatePath), "custom.tfstate")
+	b.states = map[string]state.State{
+		backend.DefaultStateName: new(testPersistFailState),
+	}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	if !strings.Contains(run.Err.Error(), b.ErroredStatePath) {
+		t.Fatalf("error should mention %s: %s", b.ErroredStatePath, run.Err)
+	}
+	if strings.Contains(run.Err.Error(), DefaultErroredStateFilename) {
+		t.Fatalf("error should not mention the default path: %s", run.Err)
+	}
+
+	checkState(t, b.ErroredStatePath, `
+test_instance.foo:
+  ID = yes
+	`)
+}
+
+func TestLocal_applyBackupStateForErrorCompressed(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.ErroredStatePath = filepath.Join(filepath.Dir(b.StatePath), "custom.tfstate")
+	b.CompressErroredState = true
+	b.states = map[string]state.State{
+		backend.DefaultStateName: new(testPersistFailState),
+	}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	gzPath := b.ErroredStatePath + ".gz"
+	expected := fmt.Sprintf(stateWriteBackedUpCompressedError, gzPath, b.ErroredStatePath)
+	if run.Err.Error() != expected {
+		t.Fatalf("bad: %s", run.Err)
+	}
+	if _, err := os.Stat(b.ErroredStatePath); err == nil {
+		t.Fatal("uncompressed state should not exist")
+	}
+
+	// Decompress the state and check it round trips
+	f, err := os.Open(gzPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	actual, err := terraform.ReadState(gz)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !actual.Equal(run.State) {
+		t.Fatalf("bad: %s", actual)
+	}
+	if actual.RootModule().Resources["test_instance.foo"].Primary.ID != "yes" {
+		t.Fatalf("bad: %s", actual)
+	}
+}
+
+func TestLocal_backupStateForErrorConsoleFallback(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+
+	// Use a directory as the path so that writing it fails
+	b.ErroredStatePath = testTempDir(t)
+
+	s := testApplyState()
+	err := b.backupStateForError(context.Background(), s, errors.New("persist failed"))
+	expected := fmt.Sprintf(stateWriteConsoleFallbackError, b.ErroredStatePath)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("bad: %s", err)
+	}
+
+	var actual terraform.State
+	if err := json.Unmarshal(ui.OutputWriter.Bytes(), &actual); err != nil {
+		t.Fatalf("state should be output as JSON: %s\n\n%s", err, ui.OutputWriter)
+	}
+	if !actual.Equal(s) {
+		t.Fatalf("bad: %s", &actual)
+	}
+}
+
+func TestLocal_backupStateForErrorAtomic(t *testing.T) {
+	b := TestLocal(t)
+	b.CLI = new(cli.MockUi)
+	b.ErroredStatePath = filepath.Join(testTempDir(t), "errored.tfstate")
+	if err := ioutil.WriteFile(b.ErroredStatePath, []byte("original"), 0644); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Simulate dying after the state is written but before it is renamed
+	defer func(f func(string, string) error) { renameFile = f }(renameFile)
+	renameFile = func(from, to string) error {
+		if _, err := os.Stat(from); err != nil {
+			t.Fatalf("temporary file should exist: %s", err)
+		}
+		return errors.New("rename failed")
+	}
+
+	b.backupStateForError(context.Background(), testApplyState(), errors.New("persist failed"))
+
+	actual, err := ioutil.ReadFile(b.ErroredStatePath)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if string(actual) != "original" {
+		t.Fatalf("errored state should be untouched: %q", actual)
+	}
+}
+
+func TestLocal_backupStateForErrorContents(t *testing.T) {
+	b := TestLocal(t)
+	b.CLI = new(cli.MockUi)
+	b.ErroredStatePath = filepath.Join(testTempDir(t), "errored.tfstate")
+
+	s := testApplyStateTwoResources()
+	err := b.backupStateForError(context.Background(), s, errors.New("persist failed"))
+	if err == nil || !strings.Contains(err.Error(), b.ErroredStatePath) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	actual, err := ioutil.ReadFile(b.ErroredStatePath)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The file should be the state as terraform.WriteState encodes it
+	expected, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	expected = append(expected, '\n')
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("bad:\n\n%s\n\nexpected:\n\n%s", actual, expected)
+	}
+}
+
+func TestEncodeState(t *testing.T) {
+	s := testApplyStateTwoResources()
+
+	var actual bytes.Buffer
+	if err := encodeState(&actual, s); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Streaming the state should be the same as terraform.WriteState
+	var expected bytes.Buffer
+	if err := terraform.WriteState(s, &expected); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+		t.Fatalf("bad:\n\n%s\n\nexpected:\n\n%s", actual.Bytes(), expected.Bytes())
+	}
+}
+
+func TestEncodeState_unsortedModules(t *testing.T) {
+	s := testApplyStateTwoResources()
+	s.Modules = append([]*terraform.ModuleState{{
+		Path: []string{"root", "child"},
+	}}, s.Modules...)
+
+	var buf bytes.Buffer
+	if err := encodeState(&buf, s.DeepCopy()); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The modules aren't sorted like terraform.WriteState sorts them, but
+	// it reads back as the same state
+	actual, err := terraform.ReadState(&buf)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	var expectedBuf bytes.Buffer
+	if err := terraform.WriteState(s.DeepCopy(), &expectedBuf); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	expected, err := terraform.ReadState(&expectedBuf)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !actual.Equal(expected) {
+		t.Fatalf("bad:\n\n%s\n\nexpected:\n\n%s", actual, expected)
+	}
+}
+
+func TestEncodeState_invalidVersion(t *testing.T) {
+	s := testApplyStateTwoResources()
+	s.TFVersion = "not a version"
+
+	// Like terraform.WriteState, an invalid version isn't written
+	var buf bytes.Buffer
+	err := encodeState(&buf, s)
+	if err == nil || !strings.Contains(err.Error(), "invalid version") {
+		t.Fatalf("bad: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("bad: %s", buf.Bytes())
+	}
+}
+
+func TestLocal_backupStateForErrorCorrupt(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.ErroredStatePath = filepath.Join(testTempDir(t), "errored.tfstate")
+
+	// Silently corrupt the file as it is written
+	defer func(f func(string, string) error) { renameFile = f }(renameFile)
+	renameFile = func(from, to string) error {
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(to, []byte(`{"version": 3}`), 0644)
+	}
+
+	s := testApplyState()
+	err := b.backupStateForError(context.Background(), s, errors.New("persist failed"))
+	expected := fmt.Sprintf(stateWriteConsoleFallbackError, b.ErroredStatePath)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "contents don't match the state") {
+		t.Fatalf("bad: %s", ui.ErrorWriter)
+	}
+
+	var actual terraform.State
+	if err := json.Unmarshal(ui.OutputWriter.Bytes(), &actual); err != nil {
+		t.Fatalf("state should be output as JSON: %s\n\n%s", err, ui.OutputWriter)
+	}
+	if !actual.Equal(s) {
+		t.Fatalf("bad: %s", &actual)
+	}
+}
+
+func TestLocal_backupStateForErrorCorruptCompressed(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.CompressErroredState = true
+	b.ErroredStatePath = filepath.Join(testTempDir(t), "errored.tfstate")
+
+	// Silently corrupt the file as it is written
+	defer func(f func(string, string) error) { renameFile = f }(renameFile)
+	renameFile = func(from, to string) error {
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(to, []byte("not gzip"), 0644)
+	}
+
+	err := b.backupStateForError(context.Background(), testApplyState(), errors.New("persist failed"))
+	expected := fmt.Sprintf(stateWriteConsoleFallbackError, b.ErroredStatePath)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("bad: %s", err)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "is corrupt") {
+		t.Fatalf("bad: %s", ui.ErrorWriter)
+	}
+}
+
+func TestLocal_backupStateForErrorJSONIndent(t *testing.T) {
+	compact := ""
+	tab := "\t"
+	cases := map[string]struct {
+		Indent  *string
+		Marshal func(*terraform.State) ([]byte, error)
+	}{
+		"default": {
+			nil,
+			func(s *terraform.State) ([]byte, error) {
+				return json.MarshalIndent(s, "", "  ")
+			},
+		},
+		"tab": {
+			&tab,
+			func(s *terraform.State) ([]byte, error) {
+				return json.MarshalIndent(s, "", "\t")
+			},
+		},
+		"compact": {
+			&compact,
+			func(s *terraform.State) ([]byte, error) {
+				return json.Marshal(s)
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		b := TestLocal(t)
+		ui := new(cli.MockUi)
+		b.CLI = ui
+		b.StateJSONIndent = tc.Indent
+
+		// Use a directory as the path so that writing it fails
+		b.ErroredStatePath = testTempDir(t)
+
+		// The encoder should escape the output the same way
+		s := testApplyState()
+		s.RootModule().Resources["test_instance.foo"].Primary.Attributes = map[string]string{
+			"html": "<a & b>",
+		}
+		b.backupStateForError(context.Background(), s, errors.New("persist failed"))
+
+		expected, err := tc.Marshal(s)
+		if err != nil {
+			t.Fatalf("%s: err: %s", name, err)
+		}
+		if actual := strings.TrimSpace(ui.OutputWriter.String()); actual != string(expected) {
+			t.Fatalf("%s: bad:\n\n%s", name, actual)
+		}
+	}
+}
+
+func TestLocal_backupStateForErrorSuppressConsoleFallback(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.SuppressStateConsoleFallback = true
+
+	// Use a directory as the path so that writing it fails
+	b.ErroredStatePath = testTempDir(t)
+
+	err := b.backupStateForError(context.Background(), testApplyState(), errors.New("persist failed"))
+	if err == nil || err.Error() != stateWriteFatalError {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if output := ui.OutputWriter.String(); output != "" {
+		t.Fatalf("state should not be output:\n\n%s", output)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Also failed to create local state file") {
+		t.Fatalf("errored state write should be attempted:\n\n%s", ui.ErrorWriter)
+	}
+}
+
+func TestLocal_backupStateForErrorWriter(t *testing.T) {
+	b := TestLocal(t)
+	b.CLI = new(cli.MockUi)
+	b.ErroredStatePath = filepath.Join(testTempDir(t), "errored.tfstate")
+	var buf bytes.Buffer
+	b.ErroredStateWriter = &buf
+
+	s := testApplyState()
+	err := b.backupStateForError(context.Background(), s, errors.New("persist failed"))
+	expected := fmt.Sprintf(stateWriteBackedUpWriterError, b.ErroredStatePath)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("bad: %v", err)
+	}
+
+	actual, err := terraform.ReadState(&buf)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !actual.Equal(s) {
+		t.Fatalf("bad: %s", actual)
+	}
+
+	if _, err := os.Stat(b.ErroredStatePath); !os.IsNotExist(err) {
+		t.Fatalf("errored state file should not be written: %v", err)
+	}
+}
+
+func TestLocal_backupStateForErrorWriterFailed(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.ErroredStateWriter = testFailWriter{}
+
+	s := testApplyState()
+	err := b.backupStateForError(context.Background(), s, errors.New("persist failed"))
+	expected := fmt.Sprintf(stateWriteConsoleFallbackError, DefaultErroredStateFilename)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("bad: %v", err)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Also failed to write the state for recovery") {
+		t.Fatalf("bad: %s", ui.ErrorWriter)
+	}
+
+	var actual terraform.State
+	if err := json.Unmarshal(ui.OutputWriter.Bytes(), &actual); err != nil {
+		t.Fatalf("state should be output as JSON: %s\n\n%s", err, ui.OutputWriter)
+	}
+	if !actual.Equal(s) {
+		t.Fatalf("bad: %s", &actual)
+	}
+
+	if _, err := os.Stat(DefaultErroredStateFilename); !os.IsNotExist(err) {
+		t.Fatalf("errored state file should not be written: %v", err)
+	}
+}
+
+func TestLocal_applyLockInfo(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	b.ContextOpts.Parallelism = 3
+	s := new(testLockInfoState)
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Destroy = true
+	op.LockState = true
+	op.PlanOutPath = "foo.tfplan"
+	op.Environment = backend.DefaultStateName
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
+	}
+
+	if s.info == nil {
+		t.Fatal("state should be locked")
+	}
+
+	var actual map[string]interface{}
+	if err := json.Unmarshal([]byte(s.info.Info), &actual); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := map[string]interface{}{
+		"operation":   "destroy",
+		"plan_path":   "foo.tfplan",
+		"parallelism": float64(3),
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestLocal_applyLockProgress(t *testing.T) {
+	b := TestLocal(t)
+	TestLocalProvider(t, b, "test")
+	b.states = map[string]state.State{
+		backend.DefaultStateName: new(testLockedState),
+	}
+
+	defer func(v time.Duration) { lockProgressInterval = v }(lockProgressInterval)
+	lockProgressInterval = 10 * time.Millisecond
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	var lock sync.Mutex
+	var elapsed []time.Duration
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+	op.LockState = true
+	op.StateLockTimeout = 200 * time.Millisecond
+	op.LockProgress = func(d time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		elapsed = append(elapsed, d)
+	}
+
+	run, err := b.Operation(context.Background(), op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(elapsed) == 0 {
+		t.Fatal("LockProgress should be called")
+	}
+	for i := 1; i < len(elapsed); i++ {
+		if elapsed[i] < elapsed[i-1] {
+			t.Fatalf("elapsed times should increase: %v", elapsed)
+		}
+	}
+}
+
+func TestLocal_applyPersistRetry(t *testing.T) {
+	b := TestLocal(t)
+	p := TestLocalProvider(t, b, "test")
+	s := &testPersistFailState{failures: 2}
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	defer testTmpDir(t)()
+
+	op := testOperationApply()
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+	op.StatePersistRetries = 3
+	op.StatePersistRetryInterval = time.Millisecond
 
 	run, err := b.Operation(context.Background(), op)
 	if err != nil {
 		t.Fatalf("bad: %s", err)
 	}
 	<-run.Done()
-	if run.Err == nil {
-		t.Fatal("should error")
+	if run.Err != nil {
+		t.Fatalf("err: %s", run.Err)
 	}
 
-	if p.ApplyCalled {
-		t.Fatal("apply should not be called")
+	if s.calls != 3 {
+		t.Fatalf("expected 3 persist calls, got %d", s.calls)
 	}
 
-	if _, err := os.Stat(b.StateOutPath); err == nil {
-		t.Fatal("should not exist")
+	if _, err := os.Stat(DefaultErroredStateFilename); err == nil {
+		t.Fatal("errored state should not exist")
 	}
 }
 
-func TestLocal_applyEmptyDirDestroy(t *testing.T) {
+func TestLocal_applyPersistRetryExhausted(t *testing.T) {
 	b := TestLocal(t)
 	p := TestLocalProvider(t, b, "test")
+	s := new(testPersistFailState)
+	b.states = map[string]state.State{backend.DefaultStateName: s}
 
-	p.ApplyReturn = nil
+	p.ApplyReturn = &terraform.InstanceState{ID: "yes"}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+
+	defer testTmpDir(t)()
 
 	op := testOperationApply()
-	op.Module = nil
-	op.Destroy = true
+	op.Module = mod
+	op.Environment = backend.DefaultStateName
+	op.StatePersistRetries = 2
+	op.StatePersistRetryInterval = time.Millisecond
 
 	run, err := b.Operation(context.Background(), op)
 	if err != nil {
 		t.Fatalf("bad: %s", err)
 	}
 	<-run.Done()
+	if run.Err == nil {
+		t.Fatal("should error")
+	}
+
+	if s.calls != 3 {
+		t.Fatalf("expected 3 persist calls, got %d", s.calls)
+	}
+
+	if _, err := os.Stat(DefaultErroredStateFilename); err != nil {
+		t.Fatalf("errored state should exist: %s", err)
+	}
+}
+
+func TestLocal_applyPersistRetryInterrupted(t *testing.T) {
+	b := TestLocal(t)
+	s := &testPersistFailState{failures: 1}
+	b.states = map[string]state.State{backend.DefaultStateName: s}
+
+	op := testOperationApply()
+	op.Environment = backend.DefaultStateName
+	op.StatePersistRetries = 3
+	op.StatePersistRetryInterval = time.Millisecond
+
+	// Interrupting the apply doesn't stop persisting the state from being
+	// retried
+	run := testApplyInterrupted(t, b, op)
 	if run.Err != nil {
-		t.Fatalf("err: %s", err)
+		t.Fatalf("err: %s", run.Err)
 	}
 
-	if p.ApplyCalled {
-		t.Fatal("apply should not be called")
+	if s.calls != 2 {
+		t.Fatalf("expected 2 persist calls, got %d", s.calls)
 	}
+}
 
-	checkState(t, b.StateOutPath, `<no state>`)
+func TestLocal_applyStopping(t *testing.T) {
+	b := TestLocal(t)
+	h := new(testStoppingHook)
+	b.ContextOpts.Hooks = []terraform.Hook{h}
+
+	testApplyInterrupted(t, b, testOperationApply())
+
+	if h.calls != 1 {
+		t.Fatalf("expected Stopping to be called once, got %d", h.calls)
+	}
 }
 
-func TestLocal_applyError(t *testing.T) {
+func TestLocal_applyStoppingMessage(t *testing.T) {
 	b := TestLocal(t)
-	p := TestLocalProvider(t, b, "test")
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.CLIColor = &colorstring.Colorize{Colors: colorstring.DefaultColors}
 
-	var lock sync.Mutex
-	errored := false
-	p.ApplyFn = func(
-		info *terraform.InstanceInfo,
-		s *terraform.InstanceState,
-		d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
-		lock.Lock()
-		defer lock.Unlock()
+	testApplyInterrupted(t, b, testOperationApply())
 
-		if !errored && info.Id == "test_instance.bar" {
-			errored = true
-			return nil, fmt.Errorf("error")
-		}
+	expected := b.Colorize().Color(applyStopping)
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, expected) {
+		t.Fatalf("expected colorized %q in output:\n\n%q", expected, output)
+	}
+	if !strings.Contains(expected, "\x1b[") {
+		t.Fatalf("message should be colorized: %q", expected)
+	}
+}
 
-		return &terraform.InstanceState{ID: "foo"}, nil
+func TestLocal_applyStoppingMessageCustom(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.ApplyStoppingMessage = "[red]custom stop"
+
+	testApplyInterrupted(t, b, testOperationApply())
+
+	output := ui.OutputWriter.String()
+	if !strings.Contains(output, "custom stop") {
+		t.Fatalf("bad: %q", output)
 	}
-	p.DiffFn = func(
-		*terraform.InstanceInfo,
-		*terraform.InstanceState,
-		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
-		return &terraform.InstanceDiff{
-			Attributes: map[string]*terraform.ResourceAttrDiff{
-				"ami": &terraform.ResourceAttrDiff{
-					New: "bar",
-				},
-			},
-		}, nil
+	if strings.Contains(output, "[red]") || strings.Contains(output, "stopping apply operation") {
+		t.Fatalf("bad: %q", output)
 	}
+}
 
-	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply-error")
-	defer modCleanup()
+func TestLocal_applyStoppingMessageDisabled(t *testing.T) {
+	b := TestLocal(t)
+	ui := new(cli.MockUi)
+	b.CLI = ui
+	b.ApplyStoppingMessage = "-"
 
-	op := testOperationApply()
-	op.Module = mod
+	testApplyInterrupted(t, b, testOperationApply())
 
-	run, err := b.Operation(context.Background(), op)
-	if err != nil {
-		t.Fatalf("bad: %s", err)
+	if output := ui.OutputWriter.String(); strings.Contains(output, "stopping") {
+		t.Fatalf("bad: %q", output)
 	}
-	<-run.Done()
-	if run.Err == nil {
-		t.Fatal("should error")
+}
+
+func TestLocal_applyStopError(t *testing.T) {
+	b := TestLocal(t)
+
+	run := testApplyInterruptedStopErr(
+		t, b, testOperationApply(), errors.New("connection reset"))
+
+	expected := "Failed to stop provider: connection reset"
+	found := false
+	for _, w := range run.Warnings {
+		if w == expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected warning %q, got: %#v", expected, run.Warnings)
 	}
+}
 
-	checkState(t, b.StateOutPath, `
-test_instance.foo:
-  ID = foo
-	`)
+func TestLocal_applyStopNoError(t *testing.T) {
+	b := TestLocal(t)
+
+	run := testApplyInterrupted(t, b, testOperationApply())
+
+	for _, w := range run.Warnings {
+		if strings.Contains(w, "Failed to stop") {
+			t.Fatalf("bad: %#v", run.Warnings)
+		}
+	}
 }
 
 func testOperationApply() *backend.Operation {
@@ -164,6 +7911,55 @@ func testOperationApply() *backend.Operation {
 	}
 }
 
+// testApplyInterrupted runs the given apply operation against the "apply"
+// fixture, cancelling its context once the provider starts applying. The
+// provider's apply blocks until the provider is stopped.
+func testApplyInterrupted(
+	t *testing.T, b *Local, op *backend.Operation) *backend.RunningOperation {
+	return testApplyInterruptedStopErr(t, b, op, nil)
+}
+
+// testApplyInterruptedStopErr is like testApplyInterrupted, but the
+// provider's Stop returns stopErr.
+func testApplyInterruptedStopErr(
+	t *testing.T, b *Local, op *backend.Operation, stopErr error) *backend.RunningOperation {
+	p := TestLocalProvider(t, b, "test")
+
+	startCh := make(chan struct{})
+	stopCh := make(chan struct{})
+	var startOnce, stopOnce sync.Once
+	p.ApplyFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		startOnce.Do(func() { close(startCh) })
+		<-stopCh
+		return &terraform.InstanceState{ID: "yes"}, nil
+	}
+	p.StopFn = func() error {
+		stopOnce.Do(func() { close(stopCh) })
+		return stopErr
+	}
+
+	mod, modCleanup := module.TestTree(t, "./test-fixtures/apply")
+	defer modCleanup()
+	op.Module = mod
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	run, err := b.Operation(ctx, op)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	<-startCh
+	cancel()
+	<-run.Done()
+
+	return run
+}
+
 // testApplyState is just a common state that we use for testing refresh.
 func testApplyState() *terraform.State {
 	return &terraform.State{
@@ -183,3 +7979,335 @@ func testApplyState() *terraform.State {
 		},
 	}
 }
+
+// testPersistFailState is a state.State that can't be persisted. If
+// failures is non-zero, only that many calls to PersistState fail.
+type testPersistFailState struct {
+	state.InmemState
+
+	failures int
+	calls    int
+}
+
+func (s *testPersistFailState) PersistState() error {
+	s.calls++
+	if s.failures == 0 || s.calls <= s.failures {
+		return errors.New("persist failed")
+	}
+
+	return nil
+}
+
+// testRefreshFailState is a state.State that can't be read, as if the
+// backend were unreachable. It counts how many times it's locked.
+type testRefreshFailState struct {
+	state.InmemState
+
+	locks int
+}
+
+func (s *testRefreshFailState) RefreshState() error {
+	return errors.New("connection refused")
+}
+
+func (s *testRefreshFailState) Lock(info *state.LockInfo) (string, error) {
+	s.locks++
+	return s.InmemState.Lock(info)
+}
+
+// testSlowLockState is a state.State that takes Delay to lock and unlock.
+type testSlowLockState struct {
+	state.InmemState
+
+	Delay time.Duration
+}
+
+func (s *testSlowLockState) Lock(info *state.LockInfo) (string, error) {
+	time.Sleep(s.Delay)
+	return s.InmemState.Lock(info)
+}
+
+func (s *testSlowLockState) Unlock(id string) error {
+	time.Sleep(s.Delay)
+	return s.InmemState.Unlock(id)
+}
+
+// testStoppingHook is a StoppingHook that counts calls to Stopping.
+type testStoppingHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	calls int
+}
+
+func (h *testStoppingHook) Stopping() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.calls++
+}
+
+// testLockedState is a state.State that is always locked by someone else.
+type testLockedState struct {
+	state.InmemState
+}
+
+func (s *testLockedState) Lock(*state.LockInfo) (string, error) {
+	return "", &state.LockError{
+		Info: &state.LockInfo{ID: "other"},
+		Err:  errors.New("state locked"),
+	}
+}
+
+// testLockInfoState is a state.State that records the info it is locked
+// with.
+type testLockInfoState struct {
+	state.InmemState
+
+	info *state.LockInfo
+}
+
+func (s *testLockInfoState) Lock(info *state.LockInfo) (string, error) {
+	s.info = info
+	return s.InmemState.Lock(info)
+}
+
+// testLockIDState is a state.State that is locked with a fixed lock ID
+// and records the ID it is unlocked with.
+type testLockIDState struct {
+	state.InmemState
+
+	unlockID string
+}
+
+const testLockID = "test-lock-id"
+
+func (s *testLockIDState) Lock(*state.LockInfo) (string, error) {
+	return testLockID, nil
+}
+
+func (s *testLockIDState) Unlock(id string) error {
+	s.unlockID = id
+	return nil
+}
+
+// testUnlockFailState is a state.State that can be locked but fails to
+// be unlocked.
+type testUnlockFailState struct {
+	state.InmemState
+}
+
+func (s *testUnlockFailState) Unlock(id string) error {
+	return errors.New("unlock failed")
+}
+
+// testTracer is a backend.Tracer that records the spans it starts.
+type testTracer struct {
+	sync.Mutex
+
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(
+	ctx context.Context, name string) (context.Context, backend.Span) {
+	t.Lock()
+	defer t.Unlock()
+
+	span := &testSpan{name: name}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+type testSpan struct {
+	name  string
+	err   error
+	ended bool
+}
+
+func (s *testSpan) SetError(err error) { s.err = err }
+func (s *testSpan) End()               { s.ended = true }
+
+// testMetricsCollector is a backend.MetricsCollector that records the
+// calls to it.
+type testMetricsCollector struct {
+	sync.Mutex
+
+	resources []testMetricsResource
+	finished  []testMetricsFinished
+}
+
+type testMetricsResource struct {
+	addr string
+	dur  time.Duration
+	err  error
+}
+
+type testMetricsFinished struct {
+	added, changed, removed int
+	dur                     time.Duration
+}
+
+func (c *testMetricsCollector) ResourceApplied(
+	addr string, dur time.Duration, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.resources = append(c.resources, testMetricsResource{addr, dur, err})
+}
+
+func (c *testMetricsCollector) ApplyFinished(
+	added, changed, removed int, dur time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.finished = append(c.finished,
+		testMetricsFinished{added, changed, removed, dur})
+}
+
+// testApplyCountHook is a terraform.Hook that counts calls to PostApply.
+type testApplyCountHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	calls int
+}
+
+func (h *testApplyCountHook) PostApply(
+	*terraform.InstanceInfo,
+	*terraform.InstanceState,
+	error) (terraform.HookAction, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.calls++
+	return terraform.HookActionContinue, nil
+}
+
+// testPreApplyErrorHook is a terraform.Hook that fails PreApply for the
+// resources whose address starts with Prefix.
+type testPreApplyErrorHook struct {
+	terraform.NilHook
+
+	Prefix string
+}
+
+func (h *testPreApplyErrorHook) PreApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	if strings.HasPrefix(n.HumanId(), h.Prefix) {
+		return terraform.HookActionHalt, errors.New("hook error")
+	}
+
+	return terraform.HookActionContinue, nil
+}
+
+// testApplyStateTwoResources is testApplyState with another resource,
+// test_instance.bar with ID baz.
+func testApplyStateTwoResources() *terraform.State {
+	s := testApplyState()
+	s.RootModule().Resources["test_instance.bar"] = &terraform.ResourceState{
+		Type:    "test_instance",
+		Primary: &terraform.InstanceState{ID: "baz"},
+	}
+
+	return s
+}
+
+// testLogger is a Logger that records what is logged.
+type testLogger struct {
+	sync.Mutex
+
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// String returns everything that was logged, one line per call.
+func (l *testLogger) String() string {
+	l.Lock()
+	defer l.Unlock()
+
+	return strings.Join(l.lines, "\n")
+}
+
+// testProviderPluginHash is the SHA-256 checksum of the plugin written by
+// testProviderPlugin.
+const testProviderPluginHash = "5e689e2b01672bf33996e75d5e372ff60c536ce1599a1458e867cd8f4bef5160"
+
+// testProviderPlugin writes a fake provider plugin binary, returning its
+// path.
+func testProviderPlugin(t *testing.T) string {
+	path := filepath.Join(testTempDir(t), "terraform-provider-test")
+	if err := ioutil.WriteFile(path, []byte("plugin"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return path
+}
+
+// testApplyTimestampProvider sets up the state and the test provider so
+// that applying the "apply" fixture only changes the timestamp attribute
+// of test_instance.foo.
+func testApplyTimestampProvider(t *testing.T, b *Local) *terraform.MockResourceProvider {
+	s := testApplyState()
+	s.RootModule().Resources["test_instance.foo"].Primary.Attributes = map[string]string{
+		"id":        "bar",
+		"ami":       "bar",
+		"timestamp": "1",
+	}
+	terraform.TestStateFile(t, b.StatePath, s)
+
+	p := TestLocalProvider(t, b, "test")
+	p.DiffFn = func(
+		*terraform.InstanceInfo,
+		*terraform.InstanceState,
+		*terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		return &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{
+				"timestamp": &terraform.ResourceAttrDiff{Old: "1", New: "2"},
+			},
+		}, nil
+	}
+	p.ApplyFn = func(
+		_ *terraform.InstanceInfo,
+		s *terraform.InstanceState,
+		_ *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		return &terraform.InstanceState{
+			ID: s.ID,
+			Attributes: map[string]string{
+				"ami":       "bar",
+				"timestamp": "2",
+			},
+		}, nil
+	}
+
+	return p
+}
+
+// testStripTimestamps returns a copy of the state without the timestamp
+// attribute of any resource.
+func testStripTimestamps(s *terraform.State) *terraform.State {
+	s = s.DeepCopy()
+	for _, m := range s.Modules {
+		for _, r := range m.Resources {
+			if r.Primary != nil {
+				delete(r.Primary.Attributes, "timestamp")
+			}
+		}
+	}
+
+	return s
+}
+
+// testFailWriter is an io.Writer that always fails.
+type testFailWriter struct{}
+
+func (testFailWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
@@ -22,6 +22,19 @@ func (b *Local) Context(op *backend.Operation) (*terraform.Context, state.State,
 }
 
 func (b *Local) context(op *backend.Operation) (*terraform.Context, state.State, error) {
+	var hooks []terraform.Hook
+	if b.ContextOpts != nil {
+		hooks = b.ContextOpts.Hooks
+	}
+
+	return b.contextWithHooks(op, hooks)
+}
+
+// contextWithHooks is like context but the context uses the given hooks
+// rather than those in ContextOpts. This lets an operation add hooks of
+// its own without modifying ContextOpts, which may be shared.
+func (b *Local) contextWithHooks(
+	op *backend.Operation, hooks []terraform.Hook) (*terraform.Context, state.State, error) {
 	// Get the state.
 	s, err := b.State(op.Environment)
 	if err != nil {
@@ -37,6 +50,7 @@ func (b *Local) context(op *backend.Operation) (*terraform.Context, state.State,
 	if v := b.ContextOpts; v != nil {
 		opts = *v
 	}
+	opts.Hooks = hooks
 
 	// Copy set options from the operation
 	opts.Destroy = op.Destroy
@@ -50,6 +64,12 @@ func (b *Local) context(op *backend.Operation) (*terraform.Context, state.State,
 	// Load our state
 	opts.State = s.State()
 
+	// Applies check whether the state is from a future Terraform version
+	// themselves, so that they can warn about it rather than fail
+	if op.Type == backend.OperationTypeApply {
+		opts.StateFutureAllowed = true
+	}
+
 	// Build the context
 	var tfCtx *terraform.Context
 	if op.Plan != nil {
@@ -3,8 +3,8 @@ package local
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"strings"
 
 	"github.com/hashicorp/errwrap"
@@ -61,7 +61,7 @@ func (b *Local) opPlan(
 	}
 
 	if op.LockState {
-		lockCtx, cancel := context.WithTimeout(ctx, op.StateLockTimeout)
+		lockCtx, cancel := context.WithTimeout(ctx, b.lockTimeout(op))
 		defer cancel()
 
 		lockInfo := state.NewLockInfo()
@@ -109,26 +109,9 @@ func (b *Local) opPlan(
 	runningOp.PlanEmpty = plan.Diff.Empty()
 
 	// Save the plan to disk
-	if path := op.PlanOutPath; path != "" {
-		// Write the backend if we have one
-		plan.Backend = op.PlanOutBackend
-
-		// This works around a bug (#12871) which is no longer possible to
-		// trigger but will exist for already corrupted upgrades.
-		if plan.Backend != nil && plan.State != nil {
-			plan.State.Remote = nil
-		}
-
-		log.Printf("[INFO] backend/local: writing plan output to: %s", path)
-		f, err := os.Create(path)
-		if err == nil {
-			err = terraform.WritePlan(plan, f)
-		}
-		f.Close()
-		if err != nil {
-			runningOp.Err = fmt.Errorf("Error writing plan file: %s", err)
-			return
-		}
+	if err := writePlan(op, op.PlanOutPath, plan); err != nil {
+		runningOp.Err = err
+		return
 	}
 
 	// Perform some output tasks if we have a CLI to output to.
@@ -161,6 +144,32 @@ func (b *Local) opPlan(
 	}
 }
 
+// writePlan saves the plan for the operation to path, if it is set.
+func writePlan(op *backend.Operation, path string, plan *terraform.Plan) error {
+	if path == "" {
+		return nil
+	}
+
+	// Write the backend if we have one
+	plan.Backend = op.PlanOutBackend
+
+	// This works around a bug (#12871) which is no longer possible to
+	// trigger but will exist for already corrupted upgrades.
+	if plan.Backend != nil && plan.State != nil {
+		plan.State.Remote = nil
+	}
+
+	log.Printf("[INFO] backend/local: writing plan output to: %s", path)
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		return terraform.WritePlan(plan, w)
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing plan file: %s", err)
+	}
+
+	return nil
+}
+
 const planErrNoConfig = `
 No configuration files found!
 
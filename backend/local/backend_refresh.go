@@ -51,7 +51,7 @@ func (b *Local) opRefresh(
 	}
 
 	if op.LockState {
-		lockCtx, cancel := context.WithTimeout(ctx, op.StateLockTimeout)
+		lockCtx, cancel := context.WithTimeout(ctx, b.lockTimeout(op))
 		defer cancel()
 
 		lockInfo := state.NewLockInfo()
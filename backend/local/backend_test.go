@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/terraform/backend"
 	"github.com/hashicorp/terraform/state"
@@ -266,6 +267,53 @@ func TestLocal_remoteStateBackup(t *testing.T) {
 	}
 }
 
+func TestLocal_lockTimeout(t *testing.T) {
+	b := &Local{
+		LockTimeouts: map[string]time.Duration{
+			"apply":   10 * time.Minute,
+			"destroy": 30 * time.Minute,
+			"plan":    0,
+		},
+	}
+
+	cases := []struct {
+		Type     backend.OperationType
+		Destroy  bool
+		Expected time.Duration
+	}{
+		{backend.OperationTypeApply, false, 10 * time.Minute},
+		{backend.OperationTypeApply, true, 30 * time.Minute},
+		{backend.OperationTypePlan, false, 0},
+		{backend.OperationTypeRefresh, false, time.Minute},
+	}
+
+	for _, tc := range cases {
+		op := &backend.Operation{
+			Type:             tc.Type,
+			Destroy:          tc.Destroy,
+			StateLockTimeout: time.Minute,
+		}
+		if actual := b.lockTimeout(op); actual != tc.Expected {
+			t.Fatalf("%s (destroy: %t): bad: %s", tc.Type, tc.Destroy, actual)
+		}
+	}
+}
+
+func TestLocal_lockTimeoutsUnknown(t *testing.T) {
+	b := TestLocal(t)
+	b.LockTimeouts = map[string]time.Duration{"aply": time.Minute}
+
+	err := b.Configure(terraform.NewResourceConfig(nil))
+	if err == nil || !strings.Contains(err.Error(), `unknown operation "aply"`) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	b.LockTimeouts = map[string]time.Duration{"destroy": time.Minute}
+	if err := b.Configure(terraform.NewResourceConfig(nil)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
 // change into a tmp dir and return a deferable func to change back and cleanup
 func testTmpDir(t *testing.T) func() {
 	tmp, err := ioutil.TempDir("", "tf")
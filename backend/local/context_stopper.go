@@ -0,0 +1,82 @@
+package local
+
+import (
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// ContextStopper stops whichever context is applying. Retrying resources
+// applies them again with a new context, so stopping the apply needs to
+// stop the context that's running at the time and keep any context started
+// afterwards from applying anything. It's also a hook so that it can halt
+// resources that a stopped context would still start applying.
+type ContextStopper struct {
+	terraform.NilHook
+	sync.Mutex
+
+	ctx     *terraform.Context
+	stopped bool
+	stopErr error
+}
+
+// Run sets the context that's about to apply. It returns false if the
+// apply has already been stopped, in which case the context shouldn't be
+// applied.
+func (h *ContextStopper) Run(c *terraform.Context) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	h.ctx = c
+	return !h.stopped
+}
+
+// Stop stops the context that's applying, waiting for it to complete.
+// Resources that any later context would start applying are halted.
+func (h *ContextStopper) Stop() {
+	h.Lock()
+	h.stopped = true
+	c := h.ctx
+	h.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	c.Stop()
+	err := c.StopError()
+
+	h.Lock()
+	defer h.Unlock()
+	if err != nil {
+		h.stopErr = err
+	}
+}
+
+// Stopped returns true if the apply has been stopped.
+func (h *ContextStopper) Stopped() bool {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.stopped
+}
+
+// StopError returns the errors the providers and provisioners returned
+// when they were stopped.
+func (h *ContextStopper) StopError() error {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.stopErr
+}
+
+func (h *ContextStopper) PreApply(
+	*terraform.InstanceInfo,
+	*terraform.InstanceState,
+	*terraform.InstanceDiff) (terraform.HookAction, error) {
+	if h.Stopped() {
+		return terraform.HookActionHalt, nil
+	}
+
+	return terraform.HookActionContinue, nil
+}
@@ -0,0 +1,38 @@
+package local
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestContextStopper_impl(t *testing.T) {
+	var _ terraform.Hook = new(ContextStopper)
+}
+
+func TestContextStopper(t *testing.T) {
+	h := new(ContextStopper)
+
+	n := &terraform.InstanceInfo{Id: "test_instance.foo"}
+	if action, _ := h.PreApply(n, nil, nil); action != terraform.HookActionContinue {
+		t.Fatalf("bad: %#v", action)
+	}
+	if !h.Run(nil) {
+		t.Fatal("should run before stopping")
+	}
+
+	// Stopping without a running context only stops later ones
+	h.Stop()
+	if !h.Stopped() {
+		t.Fatal("should stop")
+	}
+	if h.Run(nil) {
+		t.Fatal("should not run after stopping")
+	}
+	if action, _ := h.PreApply(n, nil, nil); action != terraform.HookActionHalt {
+		t.Fatalf("bad: %#v", action)
+	}
+	if err := h.StopError(); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+}
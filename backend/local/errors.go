@@ -0,0 +1,290 @@
+package local
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// ApplyError is the error returned by an apply operation when applying the
+// plan itself failed, as opposed to an earlier phase such as locking the
+// state, refreshing or planning.
+type ApplyError struct {
+	// Err is the error returned by terraform.Context.Apply.
+	Err error
+
+	// Terse leaves out the explanation of how to recover from the error.
+	Terse bool
+
+	// UnlockErr is the error releasing the state lock after the apply
+	// failed, if that failed too.
+	UnlockErr error
+}
+
+func (e *ApplyError) Error() string {
+	var msg string
+	if e.Terse {
+		msg = fmt.Sprintf("Error applying plan:\n\n%s", multierror.Flatten(e.Err))
+	} else {
+		msg = fmt.Sprintf(
+			"Error applying plan:\n\n"+
+				"%s\n\n"+
+				"Terraform does not automatically rollback in the face of errors.\n"+
+				"Instead, your Terraform state file has been partially updated with\n"+
+				"any resources that successfully completed. Please address the error\n"+
+				"above and apply again to incrementally change your infrastructure.",
+			multierror.Flatten(e.Err))
+	}
+
+	if e.UnlockErr != nil {
+		msg += fmt.Sprintf("\n\n%s", e.UnlockErr)
+	}
+
+	return msg
+}
+
+// WrappedErrors returns the individual errors that caused the apply to
+// fail, followed by the error releasing the state lock if there is one.
+// This implements errwrap.Wrapper.
+func (e *ApplyError) WrappedErrors() []error {
+	var result []error
+	if err, ok := multierror.Flatten(e.Err).(*multierror.Error); ok {
+		result = err.Errors
+	} else {
+		result = []error{e.Err}
+	}
+
+	if e.UnlockErr != nil {
+		result = append(result, e.UnlockErr)
+	}
+
+	return result
+}
+
+// NonIdempotentError is the error returned by an apply operation with
+// Operation.RequireIdempotent set when the apply changed resources.
+type NonIdempotentError struct {
+	Added   int
+	Changed int
+	Removed int
+}
+
+func (e *NonIdempotentError) Error() string {
+	return fmt.Sprintf(
+		"Apply was required to be idempotent but changed resources: "+
+			"%d added, %d changed, %d destroyed.",
+		e.Added, e.Changed, e.Removed)
+}
+
+// VerificationError is the error returned by an apply operation when
+// Operation.PostApplyVerify fails. The state from the apply has still been
+// persisted.
+type VerificationError struct {
+	// Err is the error returned by Operation.PostApplyVerify.
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf(
+		"Verification of the applied state failed: %s\n\n"+
+			"The apply completed and the state has been saved, but the\n"+
+			"resulting infrastructure didn't pass verification.", e.Err)
+}
+
+// WrappedErrors returns the error returned by the verification. This
+// implements errwrap.Wrapper.
+func (e *VerificationError) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
+// StalePlanError is the error returned by an apply operation when the plan
+// being applied wasn't made from the current state, unless
+// Operation.AllowStalePlan is set.
+type StalePlanError struct {
+	PlanLineage  string
+	PlanSerial   int64
+	StateLineage string
+	StateSerial  int64
+}
+
+func (e *StalePlanError) Error() string {
+	return fmt.Sprintf(
+		"The plan was made from a state that doesn't match the current state\n"+
+			"(plan lineage %q serial %d, current lineage %q serial %d).\n\n"+
+			"Applying it could overwrite changes made since the plan was created.\n"+
+			"Please create a new plan and apply that instead.",
+		e.PlanLineage, e.PlanSerial, e.StateLineage, e.StateSerial)
+}
+
+// EmptyDestroyError is the error returned by a destroy operation with
+// Operation.ErrorOnEmptyDestroy set when the state had nothing to destroy.
+type EmptyDestroyError struct {
+	// Environment is the name of the state that was empty.
+	Environment string
+}
+
+func (e *EmptyDestroyError) Error() string {
+	return fmt.Sprintf(
+		"Nothing to destroy: the state %q is empty.\n\n"+
+			"Destroy was required to remove at least one resource. Please check\n"+
+			"that the correct state is selected.", e.Environment)
+}
+
+// DeadlineExceededError is the error returned by an apply operation that
+// was interrupted because it ran for longer than Operation.MaxDuration.
+type DeadlineExceededError struct {
+	MaxDuration time.Duration
+}
+
+func (e *DeadlineExceededError) Error() string {
+	return fmt.Sprintf(
+		"Apply didn't complete within its maximum duration of %s.\n\n"+
+			"The apply was stopped and any resources that completed have been\n"+
+			"saved to the state. Please apply again to continue.", e.MaxDuration)
+}
+
+// ReadOnlyBackendError is the error returned by an apply or destroy
+// operation when the backend is read-only.
+type ReadOnlyBackendError struct {
+	// Operation is the name of the operation, "apply" or "destroy".
+	Operation string
+}
+
+func (e *ReadOnlyBackendError) Error() string {
+	return fmt.Sprintf(
+		"Cannot %s: the backend is read-only.\n\n"+
+			"This backend has been configured to never modify infrastructure or\n"+
+			"state. Only operations that don't make changes, such as plan, can\n"+
+			"be run with it.", e.Operation)
+}
+
+// ExistingLockError is the error returned by an apply operation with
+// Operation.CheckLockEvenWhenUnlocked and Operation.FailOnExistingLock set
+// when the state is locked by another operation.
+type ExistingLockError struct {
+	Err error
+}
+
+func (e *ExistingLockError) Error() string {
+	return fmt.Sprintf(
+		"State is locked by another operation:\n\n%s\n\n"+
+			"Applying while another operation holds the lock could result in\n"+
+			"conflicting changes to the state. Please wait for it to complete.",
+		e.Err)
+}
+
+// WrappedErrors implements errwrap.Wrapper.
+func (e *ExistingLockError) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
+// UnapprovedPlanError is the error returned by an apply operation with
+// Operation.ApprovedPlanHash set when the plan to apply isn't the one that
+// was approved.
+type UnapprovedPlanError struct {
+	Approved string
+	Actual   string
+}
+
+func (e *UnapprovedPlanError) Error() string {
+	return fmt.Sprintf(
+		"The plan to apply has hash %s, but the approved plan has hash %s.\n\n"+
+			"Only the approved plan can be applied. The changes may have been\n"+
+			"modified since the plan was approved. Please review and approve\n"+
+			"the plan again.", e.Actual, e.Approved)
+}
+
+// ConcurrentModificationError is the error returned by an apply operation
+// when the state was written by someone else while the apply was planning,
+// unless Operation.IgnoreConcurrentChanges is set.
+type ConcurrentModificationError struct {
+	PlannedSerial int64
+	CurrentSerial int64
+}
+
+func (e *ConcurrentModificationError) Error() string {
+	return fmt.Sprintf(
+		"The state was modified while planning: it had serial %d when\n"+
+			"planning started but now has serial %d.\n\n"+
+			"Applying could overwrite the changes made by another operation.\n"+
+			"Please plan and apply again.", e.PlannedSerial, e.CurrentSerial)
+}
+
+// FutureStateError is the error returned by an apply operation with
+// Operation.StrictVersionCheck set when the state was written by a newer
+// version of Terraform than the one running.
+type FutureStateError struct {
+	StateVersion string
+	Version      string
+}
+
+func (e *FutureStateError) Error() string {
+	return fmt.Sprintf(
+		"The state was last written by Terraform %s, which is newer than\n"+
+			"this Terraform (%s). Applying could corrupt the state.\n\n"+
+			"Please run at least Terraform %s to continue.",
+		e.StateVersion, e.Version, e.StateVersion)
+}
+
+// ProviderChecksumError is the error returned by an apply operation when
+// the plugin binary of a provider doesn't have the checksum given in
+// Operation.ExpectedProviderHashes. Path and Actual are empty if the path
+// of the plugin isn't known.
+type ProviderChecksumError struct {
+	Provider string
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *ProviderChecksumError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf(
+			"The plugin for provider %q can't be verified because its path\n"+
+				"isn't known. Expected SHA-256 checksum: %s",
+			e.Provider, e.Expected)
+	}
+
+	return fmt.Sprintf(
+		"The plugin for provider %q at %s doesn't have the expected\n"+
+			"checksum, so it may have been tampered with.\n\n"+
+			"Expected SHA-256: %s\n"+
+			"Actual SHA-256:   %s",
+		e.Provider, e.Path, e.Expected, e.Actual)
+}
+
+// UnacknowledgedTargetingError is the error returned by an apply operation
+// with Operation.RefuseTargeting set when it has targets that weren't
+// acknowledged with Operation.AckTargeting.
+type UnacknowledgedTargetingError struct {
+	Targets []string
+}
+
+func (e *UnacknowledgedTargetingError) Error() string {
+	return fmt.Sprintf(
+		"Refusing to apply with targets that weren't acknowledged: %s\n\n"+
+			"Applying only some resources can leave the state inconsistent\n"+
+			"with the configuration. Please acknowledge the targets to apply\n"+
+			"them, or apply without targets.", strings.Join(e.Targets, ", "))
+}
+
+// BackendUnavailableError is the error returned by an apply operation with
+// Operation.Preflight set when the state couldn't be read from the backend.
+type BackendUnavailableError struct {
+	Err error
+}
+
+func (e *BackendUnavailableError) Error() string {
+	return fmt.Sprintf(
+		"The backend is unavailable, the state couldn't be read: %s\n\n"+
+			"The result of an apply couldn't be saved to the state either, so\n"+
+			"nothing was applied. Please check that the backend is reachable\n"+
+			"and try again.", e.Err)
+}
+
+// WrappedErrors implements errwrap.Wrapper.
+func (e *BackendUnavailableError) WrappedErrors() []error {
+	return []error{e.Err}
+}
@@ -0,0 +1,129 @@
+package local
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
+)
+
+func TestApplyError(t *testing.T) {
+	var err error = &ApplyError{
+		Err: multierror.Append(errors.New("foo"), errors.New("bar")),
+	}
+
+	applyErr, ok := err.(*ApplyError)
+	if !ok {
+		t.Fatal("should be an ApplyError")
+	}
+
+	wrapped := applyErr.WrappedErrors()
+	if len(wrapped) != 2 || wrapped[0].Error() != "foo" || wrapped[1].Error() != "bar" {
+		t.Fatalf("bad: %#v", wrapped)
+	}
+
+	if !errwrap.Contains(err, "bar") {
+		t.Fatal("should contain bar")
+	}
+
+	if !strings.Contains(err.Error(), "Error applying plan:") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestApplyError_terse(t *testing.T) {
+	cases := map[bool]bool{
+		false: true,
+		true:  false,
+	}
+
+	for terse, verbose := range cases {
+		err := &ApplyError{Err: errors.New("foo"), Terse: terse}
+
+		msg := err.Error()
+		if !strings.Contains(msg, "Error applying plan:") || !strings.Contains(msg, "foo") {
+			t.Fatalf("%t: bad: %s", terse, msg)
+		}
+		if actual := strings.Contains(msg, "does not automatically rollback"); actual != verbose {
+			t.Fatalf("%t: bad: %s", terse, msg)
+		}
+	}
+}
+
+func TestApplyError_unlock(t *testing.T) {
+	err := &ApplyError{
+		Err:       errors.New("foo"),
+		UnlockErr: errors.New("unlock failed"),
+	}
+
+	wrapped := err.WrappedErrors()
+	if len(wrapped) != 2 || wrapped[0].Error() != "foo" || wrapped[1].Error() != "unlock failed" {
+		t.Fatalf("bad: %#v", wrapped)
+	}
+
+	if msg := err.Error(); !strings.Contains(msg, "foo") || !strings.Contains(msg, "unlock failed") {
+		t.Fatalf("bad: %s", msg)
+	}
+}
+
+func TestNonIdempotentError(t *testing.T) {
+	err := &NonIdempotentError{Added: 1, Changed: 2, Removed: 3}
+
+	expected := "1 added, 2 changed, 3 destroyed"
+	if !strings.Contains(err.Error(), expected) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestVerificationError(t *testing.T) {
+	inner := errors.New("missing tag")
+	var err error = &VerificationError{Err: inner}
+
+	if !errwrap.Contains(err, "missing tag") {
+		t.Fatal("should wrap the verification error")
+	}
+	if !strings.Contains(err.Error(), "missing tag") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestStalePlanError(t *testing.T) {
+	err := &StalePlanError{
+		PlanLineage:  "foo",
+		PlanSerial:   1,
+		StateLineage: "bar",
+		StateSerial:  2,
+	}
+
+	expected := `plan lineage "foo" serial 1, current lineage "bar" serial 2`
+	if !strings.Contains(err.Error(), expected) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestEmptyDestroyError(t *testing.T) {
+	err := &EmptyDestroyError{Environment: "staging"}
+
+	if !strings.Contains(err.Error(), `state "staging" is empty`) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestDeadlineExceededError(t *testing.T) {
+	err := &DeadlineExceededError{MaxDuration: 5 * time.Minute}
+
+	if !strings.Contains(err.Error(), "maximum duration of 5m0s") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestReadOnlyBackendError(t *testing.T) {
+	err := &ReadOnlyBackendError{Operation: "destroy"}
+
+	if !strings.Contains(err.Error(), "Cannot destroy: the backend is read-only.") {
+		t.Fatalf("bad: %s", err)
+	}
+}
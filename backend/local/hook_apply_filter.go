@@ -0,0 +1,53 @@
+package local
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// ApplyFilterHook is a hook that skips applying any resource whose address
+// doesn't match Filter, recording it as deferred. Resources that depend on
+// a deferred resource may fail to apply.
+type ApplyFilterHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	Filter func(addr string) bool
+
+	deferred []string
+}
+
+func (h *ApplyFilterHook) PreApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	if h.Filter == nil || h.Filter(n.HumanId()) {
+		return terraform.HookActionContinue, nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.deferred = append(h.deferred, n.HumanId())
+
+	// Halting here skips applying just this resource
+	return terraform.HookActionHalt, nil
+}
+
+// Deferred returns the sorted addresses of the resources that were skipped.
+// This is safe to call on a nil hook.
+func (h *ApplyFilterHook) Deferred() []string {
+	if h == nil {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	result := make([]string, len(h.deferred))
+	copy(result, h.deferred)
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,48 @@
+package local
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestApplyFilterHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(ApplyFilterHook)
+}
+
+func TestApplyFilterHook(t *testing.T) {
+	h := &ApplyFilterHook{
+		Filter: func(addr string) bool {
+			return strings.HasPrefix(addr, "test_instance.")
+		},
+	}
+
+	cases := map[string]terraform.HookAction{
+		"test_instance.foo":  terraform.HookActionContinue,
+		"other_instance.foo": terraform.HookActionHalt,
+		"other_instance.bar": terraform.HookActionHalt,
+	}
+
+	for id, expected := range cases {
+		n := &terraform.InstanceInfo{Id: id}
+		action, err := h.PreApply(n, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: err: %s", id, err)
+		}
+		if action != expected {
+			t.Fatalf("%s: expected %v, got %v", id, expected, action)
+		}
+	}
+
+	expected := []string{"other_instance.bar", "other_instance.foo"}
+	if actual := h.Deferred(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+
+	var nilHook *ApplyFilterHook
+	if len(nilHook.Deferred()) != 0 {
+		t.Fatal("nil hook should have no deferred resources")
+	}
+}
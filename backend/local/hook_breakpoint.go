@@ -0,0 +1,97 @@
+package local
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// BreakpointHook is a hook that pauses applying a resource with a
+// breakpoint until Func returns, so that the apply can be inspected. Only
+// one breakpoint is handled at a time. Other resources that don't depend
+// on the resource may continue applying while it's paused.
+type BreakpointHook struct {
+	terraform.NilHook
+
+	// Breakpoints are the addresses of the resources to pause before
+	// applying.
+	Breakpoints map[string]bool
+
+	// Func is called with the address of the resource and a copy of the
+	// most recent state when a breakpoint is reached. If it returns an
+	// error, the resource fails to apply and the apply is stopped.
+	Func func(addr string, state *terraform.State) error
+
+	// State is the state to call Func with until the apply updates it. It
+	// must not be modified once the apply starts.
+	State *terraform.State
+
+	// Stop is called the first time Func returns an error. It is called
+	// in a new goroutine since stopping waits for the apply to complete.
+	Stop func()
+
+	l       sync.Mutex
+	stopped bool
+
+	// The state is copied as it's updated rather than read from the
+	// running context, which isn't safe while other resources apply.
+	stateL sync.Mutex
+	state  *terraform.State
+}
+
+func (h *BreakpointHook) PreApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	addr := n.HumanId()
+	if !h.Breakpoints[addr] || h.Func == nil {
+		return terraform.HookActionContinue, nil
+	}
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if err := h.Func(addr, h.currentState()); err != nil {
+		if !h.stopped && h.Stop != nil {
+			h.stopped = true
+			go h.Stop()
+		}
+
+		return terraform.HookActionHalt, errwrap.Wrapf(
+			fmt.Sprintf("Breakpoint at %s: {{err}}", addr), err)
+	}
+
+	return terraform.HookActionContinue, nil
+}
+
+func (h *BreakpointHook) PostStateUpdate(
+	s *terraform.State) (terraform.HookAction, error) {
+	// The state is only read locked while the hook is called, so this is
+	// the one safe time to copy it.
+	if len(h.Breakpoints) > 0 {
+		h.stateL.Lock()
+		h.state = s.DeepCopy()
+		h.stateL.Unlock()
+	}
+
+	return terraform.HookActionContinue, nil
+}
+
+// currentState returns a copy of the most recent state, so that Func can't
+// modify the copy that is shared with other breakpoints.
+func (h *BreakpointHook) currentState() *terraform.State {
+	h.stateL.Lock()
+	defer h.stateL.Unlock()
+
+	s := h.state
+	if s == nil {
+		s = h.State
+	}
+	if s == nil {
+		return nil
+	}
+
+	return s.DeepCopy()
+}
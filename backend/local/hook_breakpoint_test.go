@@ -0,0 +1,103 @@
+package local
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestBreakpointHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(BreakpointHook)
+}
+
+func TestBreakpointHook(t *testing.T) {
+	var addrs []string
+	state := terraform.NewState()
+	h := &BreakpointHook{
+		Breakpoints: map[string]bool{"module.child.test_instance.foo": true},
+		Func: func(addr string, s *terraform.State) error {
+			if !s.Equal(state) {
+				t.Fatalf("bad: %s", s)
+			}
+
+			addrs = append(addrs, addr)
+			return nil
+		},
+		State: state,
+	}
+
+	for _, n := range []*terraform.InstanceInfo{
+		&terraform.InstanceInfo{Id: "test_instance.foo"},
+		&terraform.InstanceInfo{Id: "test_instance.foo", ModulePath: []string{"root", "child"}},
+	} {
+		action, err := h.PreApply(n, nil, nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if action != terraform.HookActionContinue {
+			t.Fatalf("bad: %#v", action)
+		}
+	}
+
+	if len(addrs) != 1 || addrs[0] != "module.child.test_instance.foo" {
+		t.Fatalf("bad: %#v", addrs)
+	}
+}
+
+func TestBreakpointHook_error(t *testing.T) {
+	stopCh := make(chan struct{}, 2)
+	h := &BreakpointHook{
+		Breakpoints: map[string]bool{
+			"test_instance.foo": true,
+			"test_instance.bar": true,
+		},
+		Func: func(string, *terraform.State) error { return errors.New("abort") },
+		Stop: func() { stopCh <- struct{}{} },
+	}
+
+	for _, id := range []string{"test_instance.foo", "test_instance.bar"} {
+		action, err := h.PreApply(&terraform.InstanceInfo{Id: id}, nil, nil)
+		if err == nil || !strings.Contains(err.Error(), "Breakpoint at "+id+": abort") {
+			t.Fatalf("bad: %v", err)
+		}
+		if action != terraform.HookActionHalt {
+			t.Fatalf("bad: %#v", action)
+		}
+	}
+
+	<-stopCh
+	select {
+	case <-stopCh:
+		t.Fatal("Stop should only be called once")
+	default:
+	}
+}
+
+func TestBreakpointHook_stateUpdate(t *testing.T) {
+	var actual *terraform.State
+	h := &BreakpointHook{
+		Breakpoints: map[string]bool{"test_instance.foo": true},
+		Func: func(addr string, s *terraform.State) error {
+			actual = s
+			return nil
+		},
+		State: terraform.NewState(),
+	}
+
+	// The hook keeps its own copy of the updated state
+	updated := terraform.NewState()
+	updated.Serial = 2
+	if _, err := h.PostStateUpdate(updated); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	updated.Serial = 3
+
+	if _, err := h.PreApply(&terraform.InstanceInfo{Id: "test_instance.foo"}, nil, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if actual == nil || actual.Serial != 2 {
+		t.Fatalf("bad: %s", actual)
+	}
+}
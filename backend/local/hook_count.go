@@ -3,6 +3,7 @@ package local
 import (
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/terraform/terraform"
 )
@@ -14,12 +15,20 @@ type CountHook struct {
 	Changed int
 	Removed int
 
+	// Refreshed is the number of resources that were refreshed.
+	Refreshed int
+
 	ToAdd          int
 	ToChange       int
 	ToRemove       int
 	ToRemoveAndAdd int
 
-	pending map[string]countHookAction
+	pending       map[string]countHookAction
+	started       map[string]time.Time
+	durations     map[string]time.Duration
+	removedByType map[string]int
+	applied       map[string]bool
+	added         map[string]bool
 
 	sync.Mutex
 	terraform.NilHook
@@ -30,9 +39,15 @@ func (h *CountHook) Reset() {
 	defer h.Unlock()
 
 	h.pending = nil
+	h.started = nil
+	h.durations = nil
+	h.removedByType = nil
+	h.applied = nil
+	h.added = nil
 	h.Added = 0
 	h.Changed = 0
 	h.Removed = 0
+	h.Refreshed = 0
 }
 
 func (h *CountHook) PreApply(
@@ -45,6 +60,9 @@ func (h *CountHook) PreApply(
 	if h.pending == nil {
 		h.pending = make(map[string]countHookAction)
 	}
+	if h.started == nil {
+		h.started = make(map[string]time.Time)
+	}
 
 	action := countHookActionChange
 	if d.GetDestroy() {
@@ -54,6 +72,7 @@ func (h *CountHook) PreApply(
 	}
 
 	h.pending[n.HumanId()] = action
+	h.started[n.HumanId()] = time.Now()
 
 	return terraform.HookActionContinue, nil
 }
@@ -65,18 +84,42 @@ func (h *CountHook) PostApply(
 	h.Lock()
 	defer h.Unlock()
 
+	if start, ok := h.started[n.HumanId()]; ok {
+		delete(h.started, n.HumanId())
+
+		if h.durations == nil {
+			h.durations = make(map[string]time.Duration)
+		}
+		h.durations[n.HumanId()] = time.Since(start)
+	}
+
 	if h.pending != nil {
 		if a, ok := h.pending[n.HumanId()]; ok {
 			delete(h.pending, n.HumanId())
 
 			if e == nil {
+				if h.applied == nil {
+					h.applied = make(map[string]bool)
+				}
+				h.applied[n.HumanId()] = true
+
 				switch a {
 				case countHookActionAdd:
 					h.Added += 1
+
+					if h.added == nil {
+						h.added = make(map[string]bool)
+					}
+					h.added[n.HumanId()] = true
 				case countHookActionChange:
 					h.Changed += 1
 				case countHookActionRemove:
 					h.Removed += 1
+
+					if h.removedByType == nil {
+						h.removedByType = make(map[string]int)
+					}
+					h.removedByType[countHookResourceType(n)] += 1
 				}
 			}
 		}
@@ -85,6 +128,83 @@ func (h *CountHook) PostApply(
 	return terraform.HookActionContinue, nil
 }
 
+// Counts returns the number of resources added, changed and removed so
+// far. It's safe to call while the apply is still running.
+func (h *CountHook) Counts() (added, changed, removed int) {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.Added, h.Changed, h.Removed
+}
+
+// Durations returns the wall-clock duration of each resource operation
+// that has completed, keyed by the resource address. The returned map is
+// a copy and is safe to use after the hook continues to be called.
+func (h *CountHook) Durations() map[string]time.Duration {
+	h.Lock()
+	defer h.Unlock()
+
+	result := make(map[string]time.Duration, len(h.durations))
+	for k, v := range h.durations {
+		result[k] = v
+	}
+
+	return result
+}
+
+// RemovedByType returns the number of resources removed, keyed by the
+// resource type. The returned map is a copy.
+func (h *CountHook) RemovedByType() map[string]int {
+	h.Lock()
+	defer h.Unlock()
+
+	result := make(map[string]int, len(h.removedByType))
+	for k, v := range h.removedByType {
+		result[k] = v
+	}
+
+	return result
+}
+
+// Applied returns the addresses of the resources that were applied
+// successfully. The returned map is a copy.
+func (h *CountHook) Applied() map[string]bool {
+	h.Lock()
+	defer h.Unlock()
+
+	result := make(map[string]bool, len(h.applied))
+	for k, v := range h.applied {
+		result[k] = v
+	}
+
+	return result
+}
+
+// AddedResources returns the addresses of the resources that were added.
+// The returned map is a copy.
+func (h *CountHook) AddedResources() map[string]bool {
+	h.Lock()
+	defer h.Unlock()
+
+	result := make(map[string]bool, len(h.added))
+	for k, v := range h.added {
+		result[k] = v
+	}
+
+	return result
+}
+
+func (h *CountHook) PostRefresh(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState) (terraform.HookAction, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.Refreshed += 1
+
+	return terraform.HookActionContinue, nil
+}
+
 func (h *CountHook) PostDiff(
 	n *terraform.InstanceInfo, d *terraform.InstanceDiff) (
 	terraform.HookAction, error) {
@@ -109,3 +229,30 @@ func (h *CountHook) PostDiff(
 
 	return terraform.HookActionContinue, nil
 }
+
+// countDiff returns a CountHook with the planned changes counted for each
+// resource in the diff, as if it had been called for each while planning.
+func countDiff(d *terraform.Diff) *CountHook {
+	h := new(CountHook)
+	if d == nil {
+		return h
+	}
+
+	for _, m := range d.Modules {
+		for id, rd := range m.Resources {
+			h.PostDiff(&terraform.InstanceInfo{Id: id, ModulePath: m.Path}, rd)
+		}
+	}
+
+	return h
+}
+
+// countHookResourceType returns the resource type for the given instance,
+// extracting it from the resource address if it isn't set.
+func countHookResourceType(n *terraform.InstanceInfo) string {
+	if n.Type != "" {
+		return n.Type
+	}
+
+	return strings.SplitN(n.Id, ".", 2)[0]
+}
@@ -1,8 +1,11 @@
 package local
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/terraform/terraform"
 )
@@ -241,3 +244,210 @@ func TestCountHookPostDiff_DataSource(t *testing.T) {
 			expected, h)
 	}
 }
+
+func TestCountHookDurations(t *testing.T) {
+	h := new(CountHook)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			n := &terraform.InstanceInfo{
+				Id:   fmt.Sprintf("test_instance.foo%d", i),
+				Type: "test_instance",
+			}
+			s := &terraform.InstanceState{ID: "foo"}
+			d := &terraform.InstanceDiff{}
+
+			h.PreApply(n, s, d)
+			time.Sleep(time.Millisecond)
+			h.PostApply(n, s, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	durations := h.Durations()
+	if len(durations) != 10 {
+		t.Fatalf("bad: %#v", durations)
+	}
+	for addr, d := range durations {
+		if d < time.Millisecond {
+			t.Fatalf("bad duration for %s: %s", addr, d)
+		}
+	}
+
+	// Modifying the result shouldn't modify the hook
+	delete(durations, "test_instance.foo0")
+	if len(h.Durations()) != 10 {
+		t.Fatal("Durations should return a copy")
+	}
+
+	h.Reset()
+	if len(h.Durations()) != 0 {
+		t.Fatal("Reset should clear durations")
+	}
+}
+
+func TestCountHookRemovedByType(t *testing.T) {
+	h := new(CountHook)
+
+	resources := map[string]string{
+		"aws_instance.foo":       "aws_instance",
+		"aws_instance.bar":       "aws_instance",
+		"aws_instance.baz.0":     "aws_instance",
+		"aws_security_group.foo": "aws_security_group",
+		"aws_security_group.bar": "",
+	}
+
+	for id, typ := range resources {
+		n := &terraform.InstanceInfo{Id: id, Type: typ}
+		s := &terraform.InstanceState{ID: "foo"}
+		d := &terraform.InstanceDiff{Destroy: true}
+
+		h.PreApply(n, s, d)
+		h.PostApply(n, nil, nil)
+	}
+
+	// A failed removal shouldn't be counted
+	n := &terraform.InstanceInfo{Id: "aws_vpc.foo", Type: "aws_vpc"}
+	h.PreApply(n, &terraform.InstanceState{ID: "foo"}, &terraform.InstanceDiff{Destroy: true})
+	h.PostApply(n, nil, fmt.Errorf("error"))
+
+	expected := map[string]int{
+		"aws_instance":       3,
+		"aws_security_group": 2,
+	}
+	if actual := h.RemovedByType(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+	if h.Removed != 5 {
+		t.Fatalf("bad: %d", h.Removed)
+	}
+}
+
+func TestCountHookCounts(t *testing.T) {
+	h := new(CountHook)
+
+	add := &terraform.InstanceInfo{Id: "aws_instance.foo"}
+	h.PreApply(add, &terraform.InstanceState{}, &terraform.InstanceDiff{})
+	h.PostApply(add, &terraform.InstanceState{ID: "foo"}, nil)
+
+	change := &terraform.InstanceInfo{Id: "aws_instance.bar"}
+	h.PreApply(change, &terraform.InstanceState{ID: "bar"}, &terraform.InstanceDiff{})
+	h.PostApply(change, &terraform.InstanceState{ID: "bar"}, nil)
+
+	remove := &terraform.InstanceInfo{Id: "aws_instance.baz"}
+	h.PreApply(remove, &terraform.InstanceState{ID: "baz"}, &terraform.InstanceDiff{Destroy: true})
+	h.PostApply(remove, nil, nil)
+
+	added, changed, removed := h.Counts()
+	if added != 1 || changed != 1 || removed != 1 {
+		t.Fatalf("bad: %d, %d, %d", added, changed, removed)
+	}
+}
+
+func TestCountHookApplied(t *testing.T) {
+	h := new(CountHook)
+
+	foo := &terraform.InstanceInfo{Id: "aws_instance.foo"}
+	h.PreApply(foo, &terraform.InstanceState{}, &terraform.InstanceDiff{})
+	h.PostApply(foo, nil, nil)
+
+	bar := &terraform.InstanceInfo{Id: "aws_instance.bar", ModulePath: []string{"root", "child"}}
+	h.PreApply(bar, &terraform.InstanceState{}, &terraform.InstanceDiff{})
+	h.PostApply(bar, nil, nil)
+
+	// A failed resource isn't applied
+	baz := &terraform.InstanceInfo{Id: "aws_instance.baz"}
+	h.PreApply(baz, &terraform.InstanceState{}, &terraform.InstanceDiff{})
+	h.PostApply(baz, nil, fmt.Errorf("error"))
+
+	expected := map[string]bool{
+		"aws_instance.foo":              true,
+		"module.child.aws_instance.bar": true,
+	}
+	if actual := h.Applied(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestCountHookAddedResources(t *testing.T) {
+	h := new(CountHook)
+
+	foo := &terraform.InstanceInfo{Id: "aws_instance.foo"}
+	h.PreApply(foo, &terraform.InstanceState{}, &terraform.InstanceDiff{})
+	h.PostApply(foo, nil, nil)
+
+	// A changed resource isn't added
+	bar := &terraform.InstanceInfo{Id: "aws_instance.bar"}
+	h.PreApply(bar, &terraform.InstanceState{ID: "bar"}, &terraform.InstanceDiff{})
+	h.PostApply(bar, nil, nil)
+
+	expected := map[string]bool{"aws_instance.foo": true}
+	if actual := h.AddedResources(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestCountHookPostRefresh(t *testing.T) {
+	h := new(CountHook)
+
+	for _, id := range []string{"aws_instance.foo", "aws_instance.bar", "data.aws_ami.foo"} {
+		n := &terraform.InstanceInfo{Id: id}
+		h.PostRefresh(n, &terraform.InstanceState{ID: "foo"})
+	}
+
+	if h.Refreshed != 3 {
+		t.Fatalf("bad: %d", h.Refreshed)
+	}
+
+	h.Reset()
+	if h.Refreshed != 0 {
+		t.Fatalf("bad: %d", h.Refreshed)
+	}
+}
+
+func TestCountDiff(t *testing.T) {
+	d := &terraform.Diff{
+		Modules: []*terraform.ModuleDiff{
+			&terraform.ModuleDiff{
+				Path: []string{"root"},
+				Resources: map[string]*terraform.InstanceDiff{
+					"aws_instance.foo": &terraform.InstanceDiff{
+						Attributes: map[string]*terraform.ResourceAttrDiff{
+							"ami": &terraform.ResourceAttrDiff{New: "bar"},
+						},
+					},
+					"aws_instance.bar": &terraform.InstanceDiff{Destroy: true},
+					"data.aws_ami.foo": &terraform.InstanceDiff{
+						Attributes: map[string]*terraform.ResourceAttrDiff{
+							"id": &terraform.ResourceAttrDiff{New: "bar"},
+						},
+					},
+				},
+			},
+			&terraform.ModuleDiff{
+				Path: []string{"root", "child"},
+				Resources: map[string]*terraform.InstanceDiff{
+					"aws_instance.foo": &terraform.InstanceDiff{
+						Destroy: true,
+						Attributes: map[string]*terraform.ResourceAttrDiff{
+							"ami": &terraform.ResourceAttrDiff{New: "bar", RequiresNew: true},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	h := countDiff(d)
+	if h.ToAdd != 0 || h.ToChange != 1 || h.ToRemove != 1 || h.ToRemoveAndAdd != 1 {
+		t.Fatalf("bad: %#v", h)
+	}
+
+	if h := countDiff(nil); h.ToAdd != 0 {
+		t.Fatalf("bad: %#v", h)
+	}
+}
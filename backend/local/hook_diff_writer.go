@@ -0,0 +1,92 @@
+package local
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// DiffWriterHook is a hook that writes the diff of each resource to Writer
+// in a human-readable format just before the resource is applied.
+type DiffWriterHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	Writer io.Writer
+}
+
+func (h *DiffWriterHook) PreApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	text := formatInstanceDiff(n.HumanId(), d)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.Writer == nil {
+		return terraform.HookActionContinue, nil
+	}
+
+	// The diffs are informational so failing to write one never halts
+	// the apply.
+	if _, err := io.WriteString(h.Writer, text); err != nil {
+		log.Printf("[WARN] backend/local: failed to write diff for %s: %s",
+			n.HumanId(), err)
+	}
+
+	return terraform.HookActionContinue, nil
+}
+
+// formatInstanceDiff formats the diff for the resource with the given
+// address, with one line for each attribute that changes.
+func formatInstanceDiff(addr string, d *terraform.InstanceDiff) string {
+	var buf bytes.Buffer
+	buf.WriteString(addr)
+	if action := eventStreamAction(d); action != "" {
+		buf.WriteString(": " + action)
+	}
+	buf.WriteString("\n")
+
+	attrs := d.CopyAttributes()
+	keys := make([]string, 0, len(attrs))
+	width := 0
+	for k := range attrs {
+		keys = append(keys, k)
+		if len(k) > width {
+			width = len(k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		attr := attrs[k]
+
+		v := attr.New
+		if attr.NewComputed || v == config.UnknownVariableValue {
+			v = "<computed>"
+		}
+		old := attr.Old
+		if attr.Sensitive {
+			old = "<sensitive>"
+			v = "<sensitive>"
+		}
+
+		var suffix string
+		if attr.RequiresNew {
+			suffix = " (forces new resource)"
+		}
+
+		fmt.Fprintf(&buf, "  %s:%s %q => %q%s\n",
+			k, strings.Repeat(" ", width-len(k)), old, v, suffix)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,57 @@
+package local
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestDiffWriterHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(DiffWriterHook)
+}
+
+func TestDiffWriterHook(t *testing.T) {
+	var buf bytes.Buffer
+	h := &DiffWriterHook{Writer: &buf}
+
+	n := &terraform.InstanceInfo{Id: "test_instance.foo"}
+	d := &terraform.InstanceDiff{
+		Attributes: map[string]*terraform.ResourceAttrDiff{
+			"ami":      &terraform.ResourceAttrDiff{Old: "foo", New: "bar", RequiresNew: true},
+			"id":       &terraform.ResourceAttrDiff{NewComputed: true},
+			"password": &terraform.ResourceAttrDiff{Old: "a", New: "b", Sensitive: true},
+			"ip":       &terraform.ResourceAttrDiff{New: config.UnknownVariableValue},
+		},
+	}
+	action, err := h.PreApply(n, &terraform.InstanceState{ID: "foo"}, d)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if action != terraform.HookActionContinue {
+		t.Fatalf("bad: %v", action)
+	}
+
+	expected := `test_instance.foo: create
+  ami:      "foo" => "bar" (forces new resource)
+  id:       "" => "<computed>"
+  ip:       "" => "<computed>"
+  password: "<sensitive>" => "<sensitive>"
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("bad:\n%s", actual)
+	}
+}
+
+func TestDiffWriterHook_destroy(t *testing.T) {
+	var buf bytes.Buffer
+	h := &DiffWriterHook{Writer: &buf}
+
+	n := &terraform.InstanceInfo{Id: "test_instance.foo"}
+	h.PreApply(n, &terraform.InstanceState{ID: "foo"}, &terraform.InstanceDiff{Destroy: true})
+
+	if actual := buf.String(); actual != "test_instance.foo: destroy\n" {
+		t.Fatalf("bad: %q", actual)
+	}
+}
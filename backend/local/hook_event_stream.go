@@ -0,0 +1,179 @@
+package local
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// EventStreamHook is a hook that writes an event to Writer as a single line
+// of JSON for each hook callback about a resource, such as before and after
+// it is applied or provisioned.
+type EventStreamHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	Writer io.Writer
+}
+
+// StreamEvent is a single event written by EventStreamHook.
+type StreamEvent struct {
+	// Type is the hook callback, such as "pre_apply" or "post_apply".
+	Type string `json:"type"`
+
+	// Address is the address of the resource the event is about.
+	Address string `json:"address,omitempty"`
+
+	// Action is the change being made to the resource for "pre_apply"
+	// events: one of "create", "update", "destroy" or "replace".
+	Action string `json:"action,omitempty"`
+
+	// Provisioner is the type of the provisioner for "pre_provision" and
+	// "post_provision" events.
+	Provisioner string `json:"provisioner,omitempty"`
+
+	// Error is the error, if any, for "post_apply" and "post_provision"
+	// events.
+	Error string `json:"error,omitempty"`
+
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (h *EventStreamHook) PreApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	h.write(&StreamEvent{
+		Type:    "pre_apply",
+		Address: n.HumanId(),
+		Action:  eventStreamAction(d),
+	})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PostApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	e error) (terraform.HookAction, error) {
+	h.write(&StreamEvent{
+		Type:    "post_apply",
+		Address: n.HumanId(),
+		Error:   eventStreamError(e),
+	})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PreDiff(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState) (terraform.HookAction, error) {
+	h.write(&StreamEvent{Type: "pre_diff", Address: n.HumanId()})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PostDiff(
+	n *terraform.InstanceInfo,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	h.write(&StreamEvent{Type: "post_diff", Address: n.HumanId()})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PreProvisionResource(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState) (terraform.HookAction, error) {
+	h.write(&StreamEvent{Type: "pre_provision_resource", Address: n.HumanId()})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PostProvisionResource(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState) (terraform.HookAction, error) {
+	h.write(&StreamEvent{Type: "post_provision_resource", Address: n.HumanId()})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PreProvision(
+	n *terraform.InstanceInfo,
+	provId string) (terraform.HookAction, error) {
+	h.write(&StreamEvent{
+		Type:        "pre_provision",
+		Address:     n.HumanId(),
+		Provisioner: provId,
+	})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PostProvision(
+	n *terraform.InstanceInfo,
+	provId string,
+	e error) (terraform.HookAction, error) {
+	h.write(&StreamEvent{
+		Type:        "post_provision",
+		Address:     n.HumanId(),
+		Provisioner: provId,
+		Error:       eventStreamError(e),
+	})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PreRefresh(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState) (terraform.HookAction, error) {
+	h.write(&StreamEvent{Type: "pre_refresh", Address: n.HumanId()})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) PostRefresh(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState) (terraform.HookAction, error) {
+	h.write(&StreamEvent{Type: "post_refresh", Address: n.HumanId()})
+	return terraform.HookActionContinue, nil
+}
+
+func (h *EventStreamHook) Stopping() {
+	h.write(&StreamEvent{Type: "stopping"})
+}
+
+func (h *EventStreamHook) write(e *StreamEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.Writer == nil {
+		return
+	}
+
+	e.Timestamp = time.Now().UTC()
+
+	// Events are informational so failing to write one never halts
+	// the operation.
+	if err := json.NewEncoder(h.Writer).Encode(e); err != nil {
+		log.Printf("[WARN] backend/local: failed to write %s event: %s", e.Type, err)
+	}
+}
+
+// eventStreamAction returns the action for a pre_apply event.
+func eventStreamAction(d *terraform.InstanceDiff) string {
+	switch d.ChangeType() {
+	case terraform.DiffCreate:
+		return "create"
+	case terraform.DiffUpdate:
+		return "update"
+	case terraform.DiffDestroy:
+		return "destroy"
+	case terraform.DiffDestroyCreate:
+		return "replace"
+	default:
+		return ""
+	}
+}
+
+func eventStreamError(e error) string {
+	if e == nil {
+		return ""
+	}
+
+	return e.Error()
+}
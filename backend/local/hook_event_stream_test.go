@@ -0,0 +1,63 @@
+package local
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestEventStreamHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(EventStreamHook)
+}
+
+func TestEventStreamHook(t *testing.T) {
+	var buf bytes.Buffer
+	h := &EventStreamHook{Writer: &buf}
+
+	n := &terraform.InstanceInfo{Id: "test_instance.foo"}
+	d := &terraform.InstanceDiff{
+		Attributes: map[string]*terraform.ResourceAttrDiff{
+			"ami": &terraform.ResourceAttrDiff{New: "bar"},
+		},
+	}
+	h.PreApply(n, &terraform.InstanceState{}, d)
+	h.PreProvision(n, "local-exec")
+	h.PostProvision(n, "local-exec", errors.New("failed"))
+	h.PostApply(n, nil, errors.New("failed"))
+
+	expected := []StreamEvent{
+		{Type: "pre_apply", Address: "test_instance.foo", Action: "update"},
+		{Type: "pre_provision", Address: "test_instance.foo", Provisioner: "local-exec"},
+		{Type: "post_provision", Address: "test_instance.foo", Provisioner: "local-exec", Error: "failed"},
+		{Type: "post_apply", Address: "test_instance.foo", Error: "failed"},
+	}
+
+	actual := testReadEventStream(t, &buf)
+	for i := range actual {
+		if actual[i].Timestamp.IsZero() {
+			t.Fatalf("%d: timestamp should be set", i)
+		}
+		actual[i].Timestamp = expected[i].Timestamp
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func testReadEventStream(t *testing.T, buf *bytes.Buffer) []StreamEvent {
+	var events []StreamEvent
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e StreamEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
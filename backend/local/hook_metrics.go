@@ -0,0 +1,51 @@
+package local
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform/backend"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// MetricsHook is a hook that reports each resource that is applied to a
+// backend.MetricsCollector.
+type MetricsHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	Collector backend.MetricsCollector
+
+	started map[string]time.Time
+}
+
+func (h *MetricsHook) PreApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.started == nil {
+		h.started = make(map[string]time.Time)
+	}
+	h.started[n.HumanId()] = time.Now()
+
+	return terraform.HookActionContinue, nil
+}
+
+func (h *MetricsHook) PostApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	e error) (terraform.HookAction, error) {
+	h.Lock()
+	start, ok := h.started[n.HumanId()]
+	delete(h.started, n.HumanId())
+	h.Unlock()
+
+	if ok && h.Collector != nil {
+		h.Collector.ResourceApplied(n.HumanId(), time.Since(start), e)
+	}
+
+	return terraform.HookActionContinue, nil
+}
@@ -0,0 +1,38 @@
+package local
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestMetricsHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(MetricsHook)
+}
+
+func TestMetricsHook(t *testing.T) {
+	c := new(testMetricsCollector)
+	h := &MetricsHook{Collector: c}
+
+	err := errors.New("failed")
+	foo := &terraform.InstanceInfo{Id: "aws_instance.foo"}
+	bar := &terraform.InstanceInfo{Id: "aws_instance.bar"}
+	h.PreApply(foo, nil, nil)
+	h.PreApply(bar, nil, nil)
+	h.PostApply(foo, nil, nil)
+	h.PostApply(bar, nil, err)
+
+	// Resources that didn't start applying aren't reported
+	h.PostApply(&terraform.InstanceInfo{Id: "aws_instance.baz"}, nil, nil)
+
+	if len(c.resources) != 2 {
+		t.Fatalf("bad: %#v", c.resources)
+	}
+	if r := c.resources[0]; r.addr != "aws_instance.foo" || r.err != nil || r.dur < 0 {
+		t.Fatalf("bad: %#v", r)
+	}
+	if r := c.resources[1]; r.addr != "aws_instance.bar" || r.err != err || r.dur < 0 {
+		t.Fatalf("bad: %#v", r)
+	}
+}
@@ -0,0 +1,56 @@
+package local
+
+import (
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// ParallelismHook is a hook that tracks the peak number of resources
+// being applied concurrently. PostApply isn't called for a resource that a
+// hook halts or fails in PreApply, so this must come after any such hook.
+type ParallelismHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	current int
+	peak    int
+}
+
+func (h *ParallelismHook) PreApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.current++
+	if h.current > h.peak {
+		h.peak = h.current
+	}
+
+	return terraform.HookActionContinue, nil
+}
+
+func (h *ParallelismHook) PostApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	e error) (terraform.HookAction, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.current > 0 {
+		h.current--
+	}
+
+	return terraform.HookActionContinue, nil
+}
+
+// Peak returns the largest number of resources that were being applied
+// at the same time.
+func (h *ParallelismHook) Peak() int {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.peak
+}
@@ -0,0 +1,56 @@
+package local
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestParallelismHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(ParallelismHook)
+}
+
+func TestParallelismHook(t *testing.T) {
+	h := new(ParallelismHook)
+
+	n := &terraform.InstanceInfo{Id: "test_instance.foo"}
+
+	// Two overlapping spans, followed by one on its own
+	h.PreApply(n, nil, nil)
+	h.PreApply(n, nil, nil)
+	h.PostApply(n, nil, nil)
+	h.PostApply(n, nil, nil)
+	h.PreApply(n, nil, nil)
+	h.PostApply(n, nil, nil)
+
+	if actual := h.Peak(); actual != 2 {
+		t.Fatalf("bad: %d", actual)
+	}
+}
+
+func TestParallelismHook_concurrent(t *testing.T) {
+	h := new(ParallelismHook)
+
+	n := &terraform.InstanceInfo{Id: "test_instance.foo"}
+
+	// All of the spans overlap since none end until all have started
+	const count = 10
+	var started, done sync.WaitGroup
+	started.Add(count)
+	done.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			defer done.Done()
+			h.PreApply(n, nil, nil)
+			started.Done()
+			started.Wait()
+			h.PostApply(n, nil, nil)
+		}()
+	}
+	done.Wait()
+
+	if actual := h.Peak(); actual != count {
+		t.Fatalf("bad: %d", actual)
+	}
+}
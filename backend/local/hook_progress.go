@@ -0,0 +1,69 @@
+package local
+
+import (
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// ProgressHook is a hook that reports progress through an apply by calling
+// Func each time a resource finishes applying.
+type ProgressHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	// Total is the number of resources that are planned to be applied.
+	Total int
+
+	// Func is called with the number of resources that have been applied
+	// so far and Total. Calls are never concurrent and done only ever
+	// increases, up to at most Total.
+	Func func(done, total int)
+
+	done map[string]struct{}
+}
+
+func (h *ProgressHook) PostApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	e error) (terraform.HookAction, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.done == nil {
+		h.done = make(map[string]struct{})
+	}
+
+	// Resources can be applied more than once, such as when they're
+	// replaced, so only count each the first time.
+	id := n.HumanId()
+	if _, ok := h.done[id]; ok || len(h.done) >= h.Total {
+		return terraform.HookActionContinue, nil
+	}
+	h.done[id] = struct{}{}
+
+	if h.Func != nil {
+		h.Func(len(h.done), h.Total)
+	}
+
+	return terraform.HookActionContinue, nil
+}
+
+// countPlannedResources returns the number of resources with changes in
+// the diff.
+func countPlannedResources(d *terraform.Diff) int {
+	if d == nil {
+		return 0
+	}
+
+	count := 0
+	for _, m := range d.Modules {
+		for _, rd := range m.Resources {
+			if !rd.Empty() {
+				count++
+			}
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,66 @@
+package local
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestProgressHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(ProgressHook)
+}
+
+func TestProgressHook(t *testing.T) {
+	var actual [][2]int
+	h := &ProgressHook{
+		Total: 2,
+		Func: func(done, total int) {
+			actual = append(actual, [2]int{done, total})
+		},
+	}
+
+	foo := &terraform.InstanceInfo{Id: "aws_instance.foo"}
+	bar := &terraform.InstanceInfo{Id: "aws_instance.bar"}
+	baz := &terraform.InstanceInfo{Id: "aws_instance.baz"}
+	h.PostApply(foo, nil, nil)
+	h.PostApply(foo, nil, nil) // replaced resources are applied twice
+	h.PostApply(bar, nil, nil)
+	h.PostApply(baz, nil, nil) // more than the total is never reported
+
+	expected := [][2]int{{1, 2}, {2, 2}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestCountPlannedResources(t *testing.T) {
+	d := &terraform.Diff{
+		Modules: []*terraform.ModuleDiff{
+			&terraform.ModuleDiff{
+				Path: []string{"root"},
+				Resources: map[string]*terraform.InstanceDiff{
+					"aws_instance.foo": &terraform.InstanceDiff{Destroy: true},
+					"aws_instance.bar": &terraform.InstanceDiff{},
+				},
+			},
+			&terraform.ModuleDiff{
+				Path: []string{"root", "child"},
+				Resources: map[string]*terraform.InstanceDiff{
+					"aws_instance.foo": &terraform.InstanceDiff{
+						Attributes: map[string]*terraform.ResourceAttrDiff{
+							"ami": &terraform.ResourceAttrDiff{New: "bar"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if actual := countPlannedResources(d); actual != 2 {
+		t.Fatalf("bad: %d", actual)
+	}
+	if actual := countPlannedResources(nil); actual != 0 {
+		t.Fatalf("bad: %d", actual)
+	}
+}
@@ -0,0 +1,55 @@
+package local
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// ProvisionerOutputHook is a hook that captures the output of the
+// provisioners of each resource so that it's available after the apply,
+// rather than only as it's output.
+type ProvisionerOutputHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	output map[string]*bytes.Buffer
+}
+
+func (h *ProvisionerOutputHook) ProvisionOutput(
+	n *terraform.InstanceInfo, provId string, msg string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.output == nil {
+		h.output = make(map[string]*bytes.Buffer)
+	}
+
+	buf, ok := h.output[n.HumanId()]
+	if !ok {
+		buf = new(bytes.Buffer)
+		h.output[n.HumanId()] = buf
+	}
+
+	buf.WriteString(msg)
+	if !strings.HasSuffix(msg, "\n") {
+		buf.WriteByte('\n')
+	}
+}
+
+// Output returns the output of the provisioners of each resource, keyed by
+// the resource address, with each message on its own line. The returned
+// map is a copy.
+func (h *ProvisionerOutputHook) Output() map[string]string {
+	h.Lock()
+	defer h.Unlock()
+
+	result := make(map[string]string, len(h.output))
+	for k, v := range h.output {
+		result[k] = v.String()
+	}
+
+	return result
+}
@@ -0,0 +1,52 @@
+package local
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestProvisionerOutputHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(ProvisionerOutputHook)
+}
+
+func TestProvisionerOutputHook(t *testing.T) {
+	h := new(ProvisionerOutputHook)
+
+	foo := &terraform.InstanceInfo{Id: "aws_instance.foo"}
+	h.ProvisionOutput(foo, "remote-exec", "Connecting...")
+	h.ProvisionOutput(foo, "remote-exec", "Connected!\n")
+
+	bar := &terraform.InstanceInfo{Id: "aws_instance.bar", ModulePath: []string{"root", "child"}}
+	h.ProvisionOutput(bar, "local-exec", "hello")
+
+	expected := map[string]string{
+		"aws_instance.foo":              "Connecting...\nConnected!\n",
+		"module.child.aws_instance.bar": "hello\n",
+	}
+	if actual := h.Output(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestProvisionerOutputHook_concurrent(t *testing.T) {
+	h := new(ProvisionerOutputHook)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n := &terraform.InstanceInfo{Id: fmt.Sprintf("aws_instance.foo.%d", i)}
+			h.ProvisionOutput(n, "local-exec", "hello")
+		}(i)
+	}
+	wg.Wait()
+
+	if actual := h.Output(); len(actual) != 10 {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
@@ -0,0 +1,90 @@
+package local
+
+import (
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// ResultsHook is a hook that records the outcome of applying each
+// resource.
+type ResultsHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	results map[string]error
+	addrs   map[string]string
+}
+
+func (h *ResultsHook) PostApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	e error) (terraform.HookAction, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.results == nil {
+		h.results = make(map[string]error)
+		h.addrs = make(map[string]string)
+	}
+	h.results[n.HumanId()] = e
+	h.addrs[n.HumanId()] = instanceAddress(n)
+
+	return terraform.HookActionContinue, nil
+}
+
+// Results returns the error from applying each resource, keyed by the
+// resource address. Resources that applied successfully have a nil error.
+// The returned map is a copy.
+func (h *ResultsHook) Results() map[string]error {
+	h.Lock()
+	defer h.Unlock()
+
+	result := make(map[string]error, len(h.results))
+	for k, v := range h.results {
+		result[k] = v
+	}
+
+	return result
+}
+
+// Addresses returns the address of each resource as the apply graph names
+// it, such as "module.child.test_instance.foo[0]", keyed by the same
+// address as Results. Unlike those, these tell apart resources in nested
+// modules and match the addresses the apply's errors are reported for.
+// The returned map is a copy.
+func (h *ResultsHook) Addresses() map[string]string {
+	h.Lock()
+	defer h.Unlock()
+
+	result := make(map[string]string, len(h.addrs))
+	for k, v := range h.addrs {
+		result[k] = v
+	}
+
+	return result
+}
+
+// instanceAddress returns the address of the resource instance as the
+// apply graph names it. If the instance ID can't be parsed, its human ID
+// is returned instead.
+func instanceAddress(n *terraform.InstanceInfo) string {
+	key, err := terraform.ParseResourceStateKey(n.Id)
+	if err != nil {
+		return n.HumanId()
+	}
+
+	var path []string
+	if len(n.ModulePath) > 1 {
+		path = n.ModulePath[1:]
+	}
+
+	addr := &terraform.ResourceAddress{
+		Path:  path,
+		Mode:  key.Mode,
+		Type:  key.Type,
+		Name:  key.Name,
+		Index: key.Index,
+	}
+	return addr.String()
+}
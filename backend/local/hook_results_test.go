@@ -0,0 +1,73 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResultsHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(ResultsHook)
+}
+
+func TestResultsHook(t *testing.T) {
+	h := new(ResultsHook)
+
+	err := errors.New("failed")
+	h.PostApply(&terraform.InstanceInfo{Id: "aws_instance.foo"}, nil, nil)
+	h.PostApply(&terraform.InstanceInfo{Id: "aws_instance.bar"}, nil, err)
+	h.PostApply(&terraform.InstanceInfo{
+		Id:         "aws_instance.baz",
+		ModulePath: []string{"root", "child"},
+	}, nil, nil)
+
+	expected := map[string]error{
+		"aws_instance.foo":              nil,
+		"aws_instance.bar":              err,
+		"module.child.aws_instance.baz": nil,
+	}
+	if actual := h.Results(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestResultsHook_addresses(t *testing.T) {
+	h := new(ResultsHook)
+
+	h.PostApply(&terraform.InstanceInfo{Id: "aws_instance.foo.1"}, nil, nil)
+	h.PostApply(&terraform.InstanceInfo{
+		Id:         "aws_instance.bar",
+		ModulePath: []string{"root", "a", "b"},
+	}, nil, nil)
+
+	expected := map[string]string{
+		"aws_instance.foo.1":          "aws_instance.foo[1]",
+		"module.a.b.aws_instance.bar": "module.a.module.b.aws_instance.bar",
+	}
+	if actual := h.Addresses(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestResultsHook_concurrent(t *testing.T) {
+	h := new(ResultsHook)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n := &terraform.InstanceInfo{Id: fmt.Sprintf("aws_instance.foo.%d", i)}
+			h.PostApply(n, nil, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	if actual := h.Results(); len(actual) != 10 {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
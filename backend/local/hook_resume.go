@@ -0,0 +1,46 @@
+package local
+
+import (
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// ResumeHook is a hook that skips applying the resources that an earlier,
+// interrupted apply already completed. This is only safe if applying
+// those resources again would be a no-op, since they're skipped even if
+// they have changes planned.
+type ResumeHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	// Completed are the addresses of the resources to skip.
+	Completed map[string]bool
+
+	skipped int
+}
+
+func (h *ResumeHook) PreApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	if !h.Completed[n.HumanId()] {
+		return terraform.HookActionContinue, nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.skipped++
+
+	// Halting here skips applying just this resource
+	return terraform.HookActionHalt, nil
+}
+
+// Skipped returns the number of resources that were skipped.
+func (h *ResumeHook) Skipped() int {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.skipped
+}
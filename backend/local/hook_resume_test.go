@@ -0,0 +1,37 @@
+package local
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResumeHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(ResumeHook)
+}
+
+func TestResumeHook(t *testing.T) {
+	h := &ResumeHook{
+		Completed: map[string]bool{"test_instance.foo": true},
+	}
+
+	cases := map[string]terraform.HookAction{
+		"test_instance.foo": terraform.HookActionHalt,
+		"test_instance.bar": terraform.HookActionContinue,
+	}
+
+	for id, expected := range cases {
+		n := &terraform.InstanceInfo{Id: id}
+		action, err := h.PreApply(n, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: err: %s", id, err)
+		}
+		if action != expected {
+			t.Fatalf("%s: expected %v, got %v", id, expected, action)
+		}
+	}
+
+	if actual := h.Skipped(); actual != 1 {
+		t.Fatalf("bad: %d", actual)
+	}
+}
@@ -1,7 +1,9 @@
 package local
 
 import (
+	"log"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/terraform/state"
 	"github.com/hashicorp/terraform/terraform"
@@ -14,6 +16,17 @@ type StateHook struct {
 	sync.Mutex
 
 	State state.State
+
+	// PersistInterval, if non-zero, is the minimum interval between calls
+	// to PersistState on State as the state is updated, so that progress
+	// is regularly saved to durable storage during long operations.
+	PersistInterval time.Duration
+
+	lastPersist time.Time
+	detached    bool
+
+	// now returns the current time. This is only overridden for tests.
+	now func() time.Time
 }
 
 func (h *StateHook) PostStateUpdate(
@@ -21,13 +34,49 @@ func (h *StateHook) PostStateUpdate(
 	h.Lock()
 	defer h.Unlock()
 
-	if h.State != nil {
+	if h.State != nil && !h.detached {
 		// Write the new state
 		if err := h.State.WriteState(s); err != nil {
 			return terraform.HookActionHalt, err
 		}
+
+		// Persist it if it's been long enough since we last did
+		if h.PersistInterval > 0 {
+			now := time.Now()
+			if h.now != nil {
+				now = h.now()
+			}
+
+			if h.lastPersist.IsZero() {
+				h.lastPersist = now
+			} else if now.Sub(h.lastPersist) >= h.PersistInterval {
+				// This is only to regularly save progress, so if it fails
+				// we carry on and try again on the next update. The state
+				// is still persisted once the operation completes.
+				if err := h.State.PersistState(); err != nil {
+					log.Printf("[WARN] backend/local: failed to persist state: %s", err)
+				} else {
+					h.lastPersist = now
+				}
+			}
+		}
 	}
 
 	// Continue forth
 	return terraform.HookActionContinue, nil
 }
+
+// PersistAndDetach persists the last state written to State and then stops
+// writing any further updates to it. This is used when the operation
+// calling the hook is abandoned before it completes.
+func (h *StateHook) PersistAndDetach() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.State == nil || h.detached {
+		return nil
+	}
+
+	h.detached = true
+	return h.State.PersistState()
+}
@@ -1,7 +1,10 @@
 package local
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/terraform/state"
 	"github.com/hashicorp/terraform/terraform"
@@ -27,3 +30,150 @@ func TestStateHook(t *testing.T) {
 		t.Fatalf("bad state: %#v", is.State())
 	}
 }
+
+func TestStateHook_persistAndDetach(t *testing.T) {
+	is := new(testPersistCountState)
+	h := &StateHook{State: is}
+
+	s := state.TestStateInitial()
+	if _, err := h.PostStateUpdate(s); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := h.PersistAndDetach(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if is.persists != 1 {
+		t.Fatalf("bad: %d", is.persists)
+	}
+
+	// Updates after detaching shouldn't be written
+	if _, err := h.PostStateUpdate(terraform.NewState()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !is.State().Equal(s) {
+		t.Fatalf("bad state: %#v", is.State())
+	}
+
+	// Detaching again does nothing
+	if err := h.PersistAndDetach(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if is.persists != 1 {
+		t.Fatalf("bad: %d", is.persists)
+	}
+}
+
+func TestStateHook_persistInterval(t *testing.T) {
+	is := new(testPersistCountState)
+	now := time.Now()
+	hook := &StateHook{
+		State:           is,
+		PersistInterval: 10 * time.Second,
+		now:             func() time.Time { return now },
+	}
+
+	s := state.TestStateInitial()
+	steps := []struct {
+		Advance  time.Duration
+		Persists int
+	}{
+		{0, 0},
+		{5 * time.Second, 0},
+		{5 * time.Second, 1},
+		{time.Second, 1},
+		{20 * time.Second, 2},
+		{10 * time.Second, 3},
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.Advance)
+		if _, err := hook.PostStateUpdate(s); err != nil {
+			t.Fatalf("%d: err: %s", i, err)
+		}
+
+		if is.persists != step.Persists {
+			t.Fatalf("%d: expected %d persists, got %d", i, step.Persists, is.persists)
+		}
+	}
+}
+
+func TestStateHook_persistIntervalError(t *testing.T) {
+	is := &testPersistFailState{failures: 1}
+	now := time.Now()
+	hook := &StateHook{
+		State:           is,
+		PersistInterval: 10 * time.Second,
+		now:             func() time.Time { return now },
+	}
+
+	s := state.TestStateInitial()
+	if _, err := hook.PostStateUpdate(s); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Failing to persist doesn't halt the operation
+	now = now.Add(10 * time.Second)
+	action, err := hook.PostStateUpdate(s)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if action != terraform.HookActionContinue {
+		t.Fatalf("bad: %v", action)
+	}
+	if is.calls != 1 {
+		t.Fatalf("expected 1 persist call, got %d", is.calls)
+	}
+
+	// The next update tries again, without waiting for the interval
+	now = now.Add(time.Second)
+	if _, err := hook.PostStateUpdate(s); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if is.calls != 2 {
+		t.Fatalf("expected 2 persist calls, got %d", is.calls)
+	}
+}
+
+func TestStateHook_persistIntervalConcurrent(t *testing.T) {
+	is := new(testPersistCountState)
+	hook := &StateHook{
+		State:           is,
+		PersistInterval: time.Nanosecond,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hook.PostStateUpdate(state.TestStateInitial())
+		}()
+	}
+	wg.Wait()
+
+	if is.overlapped {
+		t.Fatal("persists should not overlap")
+	}
+}
+
+// testPersistCountState is a state.State that counts calls to PersistState.
+type testPersistCountState struct {
+	state.InmemState
+
+	persists   int
+	inPersist  int32
+	overlapped bool
+}
+
+func (s *testPersistCountState) PersistState() error {
+	if !atomic.CompareAndSwapInt32(&s.inPersist, 0, 1) {
+		s.overlapped = true
+		return nil
+	}
+	defer atomic.StoreInt32(&s.inPersist, 0)
+
+	s.persists++
+	time.Sleep(time.Millisecond)
+	return nil
+}
@@ -0,0 +1,11 @@
+package local
+
+// StoppingHook is implemented by hooks, such as those in
+// Operation.ExtraHooks, that want to know when an apply is being gracefully
+// stopped, such as when it's interrupted or reaches Operation.MaxDuration.
+// Stopping is called once, just before the providers and provisioners are
+// asked to stop. The apply may still take some time to actually stop and
+// the hook can't prevent it.
+type StoppingHook interface {
+	Stopping()
+}
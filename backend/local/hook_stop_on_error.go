@@ -0,0 +1,53 @@
+package local
+
+import (
+	"sync"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// StopOnErrorHook is a hook that stops an apply the first time a resource
+// fails to apply. Resources that have already started applying will still
+// run to completion.
+type StopOnErrorHook struct {
+	terraform.NilHook
+	sync.Mutex
+
+	// Stop is called the first time a resource fails to apply. It is
+	// called in a new goroutine since stopping waits for the apply to
+	// complete.
+	Stop func()
+
+	// NonFatal, if non-nil, is called with each resource error. Errors for
+	// which it returns true don't stop the apply.
+	NonFatal func(addr string, err error) bool
+
+	stopped bool
+}
+
+func (h *StopOnErrorHook) PostApply(
+	n *terraform.InstanceInfo,
+	s *terraform.InstanceState,
+	e error) (terraform.HookAction, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if e != nil && h.NonFatal != nil && h.NonFatal(n.HumanId(), e) {
+		return terraform.HookActionContinue, nil
+	}
+
+	if e != nil && !h.stopped && h.Stop != nil {
+		h.stopped = true
+		go h.Stop()
+	}
+
+	return terraform.HookActionContinue, nil
+}
+
+// Stopped returns true if the hook has stopped the apply.
+func (h *StopOnErrorHook) Stopped() bool {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.stopped
+}
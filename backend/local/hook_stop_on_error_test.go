@@ -0,0 +1,55 @@
+package local
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestStopOnErrorHook_impl(t *testing.T) {
+	var _ terraform.Hook = new(StopOnErrorHook)
+}
+
+func TestStopOnErrorHook(t *testing.T) {
+	stopCh := make(chan struct{}, 2)
+	h := &StopOnErrorHook{Stop: func() { stopCh <- struct{}{} }}
+
+	n := &terraform.InstanceInfo{Id: "test_instance.foo"}
+	h.PostApply(n, nil, nil)
+	if h.Stopped() {
+		t.Fatal("should not stop without an error")
+	}
+
+	h.PostApply(n, nil, errors.New("error"))
+	h.PostApply(n, nil, errors.New("error"))
+	if !h.Stopped() {
+		t.Fatal("should stop")
+	}
+
+	<-stopCh
+	select {
+	case <-stopCh:
+		t.Fatal("Stop should only be called once")
+	default:
+	}
+}
+
+func TestStopOnErrorHook_nonFatal(t *testing.T) {
+	h := &StopOnErrorHook{
+		Stop: func() {},
+		NonFatal: func(addr string, err error) bool {
+			return addr == "test_instance.foo"
+		},
+	}
+
+	h.PostApply(&terraform.InstanceInfo{Id: "test_instance.foo"}, nil, errors.New("error"))
+	if h.Stopped() {
+		t.Fatal("should not stop for a non-fatal error")
+	}
+
+	h.PostApply(&terraform.InstanceInfo{Id: "test_instance.bar"}, nil, errors.New("error"))
+	if !h.Stopped() {
+		t.Fatal("should stop")
+	}
+}
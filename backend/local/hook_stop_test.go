@@ -0,0 +1,9 @@
+package local
+
+import (
+	"testing"
+)
+
+func TestStoppingHook_impl(t *testing.T) {
+	var _ StoppingHook = new(testStoppingHook)
+}
@@ -0,0 +1,111 @@
+package local
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// PlanHash returns a stable hash of the changes in the plan, hex encoded.
+// This is what Operation.ApprovedPlanHash is compared with, so that only
+// the plan that was approved is applied.
+//
+// The hash covers the diff and the targets of the plan. It is the same for
+// a plan after it has been written and read back, and for a new plan of
+// the same changes.
+func PlanHash(plan *terraform.Plan) string {
+	var buf bytes.Buffer
+
+	targets := make([]string, len(plan.Targets))
+	copy(targets, plan.Targets)
+	sort.Strings(targets)
+	for _, t := range targets {
+		fmt.Fprintf(&buf, "target %q\n", t)
+	}
+
+	var modules []*terraform.ModuleDiff
+	if plan.Diff != nil {
+		modules = make([]*terraform.ModuleDiff, len(plan.Diff.Modules))
+		copy(modules, plan.Diff.Modules)
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		return strings.Join(modules[i].Path, ".") < strings.Join(modules[j].Path, ".")
+	})
+
+	for _, m := range modules {
+		if m.Empty() {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "module %q destroy=%t\n", strings.Join(m.Path, "."), m.Destroy)
+
+		keys := make([]string, 0, len(m.Resources))
+		for k := range m.Resources {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			rd := m.Resources[k]
+			if rd.Empty() {
+				continue
+			}
+
+			fmt.Fprintf(&buf, "resource %q destroy=%t deposed=%t tainted=%t\n",
+				k, rd.Destroy, rd.DestroyDeposed, rd.DestroyTainted)
+
+			attrs := make([]string, 0, len(rd.Attributes))
+			for attr := range rd.Attributes {
+				attrs = append(attrs, attr)
+			}
+			sort.Strings(attrs)
+
+			for _, attr := range attrs {
+				ad := rd.Attributes[attr]
+				fmt.Fprintf(&buf,
+					"attr %q old=%q new=%q computed=%t removed=%t requires_new=%t sensitive=%t type=%d\n",
+					attr, ad.Old, ad.New, ad.NewComputed, ad.NewRemoved,
+					ad.RequiresNew, ad.Sensitive, ad.Type)
+			}
+		}
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// planApprovalTokenVersion is the current version of the plan approval
+// token format.
+const planApprovalTokenVersion = 1
+
+// planApprovalTokenJSON is what a plan approval token encodes.
+type planApprovalTokenJSON struct {
+	Version  int    `json:"version"`
+	PlanHash string `json:"plan_hash"`
+
+	// Time is when the token was created, in RFC 3339 format.
+	Time string `json:"time"`
+}
+
+// planApprovalToken returns the approval token for the plan created at
+// t: the base64 URL encoding of the JSON of its hash and the time.
+func planApprovalToken(plan *terraform.Plan, t time.Time) (string, error) {
+	js, err := json.Marshal(&planApprovalTokenJSON{
+		Version:  planApprovalTokenVersion,
+		PlanHash: PlanHash(plan),
+		Time:     t.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js), nil
+}
@@ -0,0 +1,138 @@
+package local
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/config/module"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestPlanHash(t *testing.T) {
+	plan := testPlanHashPlan()
+	hash := PlanHash(plan)
+	if hash != PlanHash(testPlanHashPlan()) {
+		t.Fatal("hash should be stable")
+	}
+
+	// Writing and reading the plan shouldn't change its hash
+	var buf bytes.Buffer
+	if err := terraform.WritePlan(plan, &buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	read, err := terraform.ReadPlan(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if actual := PlanHash(read); actual != hash {
+		t.Fatalf("bad: %s != %s", actual, hash)
+	}
+
+	// Nor should the order of the targets
+	plan.Targets = []string{"test_instance.foo", "test_instance.bar"}
+	reordered := testPlanHashPlan()
+	reordered.Targets = []string{"test_instance.bar", "test_instance.foo"}
+	if PlanHash(plan) != PlanHash(reordered) {
+		t.Fatal("target order shouldn't change the hash")
+	}
+}
+
+func TestPlanHash_changes(t *testing.T) {
+	hash := PlanHash(testPlanHashPlan())
+
+	cases := map[string]func(*terraform.Plan){
+		"new value": func(p *terraform.Plan) {
+			p.Diff.RootModule().Resources["test_instance.foo"].Attributes["ami"].New = "baz"
+		},
+		"requires new": func(p *terraform.Plan) {
+			p.Diff.RootModule().Resources["test_instance.foo"].Attributes["ami"].RequiresNew = true
+		},
+		"destroy": func(p *terraform.Plan) {
+			p.Diff.RootModule().Resources["test_instance.foo"].Destroy = true
+		},
+		"resource": func(p *terraform.Plan) {
+			p.Diff.RootModule().Resources["test_instance.bar"] = &terraform.InstanceDiff{
+				Destroy: true,
+			}
+		},
+		"targets": func(p *terraform.Plan) {
+			p.Targets = []string{"test_instance.foo"}
+		},
+	}
+
+	for name, f := range cases {
+		plan := testPlanHashPlan()
+		f(plan)
+		if PlanHash(plan) == hash {
+			t.Fatalf("%s: hash should change", name)
+		}
+	}
+}
+
+func TestPlanApprovalToken(t *testing.T) {
+	plan := testPlanHashPlan()
+	created := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	token, err := planApprovalToken(plan, created)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	other, err := planApprovalToken(testPlanHashPlan(), created)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if token != other {
+		t.Fatalf("token should be deterministic: %s != %s", token, other)
+	}
+
+	actual := testDecodePlanApprovalToken(t, token)
+	expected := &planApprovalTokenJSON{
+		Version:  planApprovalTokenVersion,
+		PlanHash: PlanHash(plan),
+		Time:     "2017-05-01T12:00:00Z",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func testDecodePlanApprovalToken(t *testing.T, token string) *planApprovalTokenJSON {
+	js, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var result planApprovalTokenJSON
+	if err := json.Unmarshal(js, &result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return &result
+}
+
+func testPlanHashPlan() *terraform.Plan {
+	return &terraform.Plan{
+		Module: module.NewEmptyTree(),
+		Diff: &terraform.Diff{
+			Modules: []*terraform.ModuleDiff{
+				&terraform.ModuleDiff{
+					Path: []string{"root"},
+					Resources: map[string]*terraform.InstanceDiff{
+						"test_instance.foo": &terraform.InstanceDiff{
+							Attributes: map[string]*terraform.ResourceAttrDiff{
+								"ami": &terraform.ResourceAttrDiff{
+									Old: "foo",
+									New: "bar",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,70 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// resumeTokenVersion is the current version of the resume token format.
+const resumeTokenVersion = 1
+
+// resumeToken records the resources that an interrupted apply completed,
+// so that applying again can skip them with a ResumeHook. It is written to
+// Operation.ResumeTokenOut and read from Operation.ResumeToken.
+type resumeToken struct {
+	Version int `json:"version"`
+
+	// Lineage is the lineage of the state that was being applied to. A
+	// token can only be used with a state of the same lineage.
+	Lineage string `json:"lineage,omitempty"`
+
+	// Completed are the sorted addresses of the resources that were
+	// successfully applied.
+	Completed []string `json:"completed"`
+}
+
+// readResumeToken reads a resume token from the file at path.
+func readResumeToken(path string) (*resumeToken, error) {
+	js, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading resume token: %s", err)
+	}
+
+	var t resumeToken
+	if err := json.Unmarshal(js, &t); err != nil {
+		return nil, fmt.Errorf("Error parsing resume token %s: %s", path, err)
+	}
+	if t.Version != resumeTokenVersion {
+		return nil, fmt.Errorf(
+			"Resume token %s has unsupported version %d", path, t.Version)
+	}
+
+	return &t, nil
+}
+
+// writeResumeToken writes a resume token for the completed resources to
+// the file at path.
+func writeResumeToken(path, lineage string, completed map[string]bool) error {
+	t := &resumeToken{
+		Version:   resumeTokenVersion,
+		Lineage:   lineage,
+		Completed: make([]string, 0, len(completed)),
+	}
+	for addr := range completed {
+		t.Completed = append(t.Completed, addr)
+	}
+	sort.Strings(t.Completed)
+
+	js, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(js)
+		return err
+	})
+}
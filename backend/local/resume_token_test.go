@@ -0,0 +1,45 @@
+package local
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResumeToken_roundTrip(t *testing.T) {
+	path := filepath.Join(testTempDir(t), "resume.json")
+
+	completed := map[string]bool{
+		"test_instance.foo": true,
+		"test_instance.bar": true,
+	}
+	if err := writeResumeToken(path, "lineage", completed); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	token, err := readResumeToken(path)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	expected := &resumeToken{
+		Version:   resumeTokenVersion,
+		Lineage:   "lineage",
+		Completed: []string{"test_instance.bar", "test_instance.foo"},
+	}
+	if !reflect.DeepEqual(token, expected) {
+		t.Fatalf("bad: %#v", token)
+	}
+}
+
+func TestResumeToken_badVersion(t *testing.T) {
+	path := filepath.Join(testTempDir(t), "resume.json")
+	if err := ioutil.WriteFile(path, []byte(`{"version": 99}`), 0644); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if _, err := readResumeToken(path); err == nil {
+		t.Fatal("should error")
+	}
+}
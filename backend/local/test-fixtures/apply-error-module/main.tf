@@ -0,0 +1,7 @@
+resource "test_instance" "bar" {
+    error = "true"
+}
+
+module "child" {
+    source = "./child"
+}
@@ -0,0 +1,8 @@
+resource "test_instance" "foo" {
+    count = 5
+    ami = "bar"
+}
+
+resource "test_instance" "bar" {
+    ami = "bar"
+}
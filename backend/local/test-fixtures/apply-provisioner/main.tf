@@ -0,0 +1,5 @@
+resource "test_instance" "foo" {
+    ami = "bar"
+
+    provisioner "shell" {}
+}
@@ -0,0 +1,51 @@
+package local
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// renameFile is used to move a fully written temporary file into place. It
+// can be overridden in tests to simulate failing before the rename.
+var renameFile = os.Rename
+
+// writeFileAtomic writes a file at path with the contents written by the
+// given function. The contents are written to a temporary file in the same
+// directory which is then renamed to path, so that readers never see a
+// partially written file. If anything fails then path is left untouched.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// TempFile creates the file readable only by the owner, but these
+		// should have the same permissions as any other file we write
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = renameFile(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
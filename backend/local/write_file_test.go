@@ -0,0 +1,109 @@
+package local
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(testTempDir(t), "foo")
+
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "hello")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	actual, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if string(actual) != "hello" {
+		t.Fatalf("bad: %q", actual)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("bad: %s", fi.Mode())
+	}
+
+	testWriteFileAtomicNoTemp(t, filepath.Dir(path))
+}
+
+func TestWriteFileAtomic_writeError(t *testing.T) {
+	td := testTempDir(t)
+	path := filepath.Join(td, "foo")
+	if err := ioutil.WriteFile(path, []byte("original"), 0644); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("write failed")
+	})
+	if err == nil {
+		t.Fatal("should error")
+	}
+
+	testWriteFileAtomicContents(t, path, "original")
+	testWriteFileAtomicNoTemp(t, td)
+}
+
+func TestWriteFileAtomic_renameError(t *testing.T) {
+	td := testTempDir(t)
+	path := filepath.Join(td, "foo")
+	if err := ioutil.WriteFile(path, []byte("original"), 0644); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Simulate dying between writing the temporary file and renaming it
+	defer func(f func(string, string) error) { renameFile = f }(renameFile)
+	renameFile = func(from, to string) error {
+		testWriteFileAtomicContents(t, from, "new")
+		testWriteFileAtomicContents(t, to, "original")
+		return errors.New("rename failed")
+	}
+
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "new")
+		return err
+	})
+	if err == nil {
+		t.Fatal("should error")
+	}
+
+	testWriteFileAtomicContents(t, path, "original")
+	testWriteFileAtomicNoTemp(t, td)
+}
+
+func testWriteFileAtomicContents(t *testing.T, path, expected string) {
+	actual, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if string(actual) != expected {
+		t.Fatalf("%s: bad: %q", path, actual)
+	}
+}
+
+func testWriteFileAtomicNoTemp(t *testing.T, dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	for _, fi := range infos {
+		if strings.Contains(fi.Name(), ".tmp") {
+			t.Fatalf("temporary file should be removed: %s", fi.Name())
+		}
+	}
+}
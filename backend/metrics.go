@@ -0,0 +1,20 @@
+package backend
+
+import (
+	"time"
+)
+
+// MetricsCollector collects metrics about an operation, such as for
+// exporting to Prometheus or statsd. Its methods may be called
+// concurrently.
+type MetricsCollector interface {
+	// ResourceApplied is called when a resource finishes applying, with
+	// the address of the resource, how long it took and the error if it
+	// failed.
+	ResourceApplied(addr string, dur time.Duration, err error)
+
+	// ApplyFinished is called when an apply finishes, with the number of
+	// resources that were added, changed and removed and how long the
+	// apply took.
+	ApplyFinished(added, changed, removed int, dur time.Duration)
+}
@@ -0,0 +1,21 @@
+package backend
+
+import (
+	"context"
+)
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a context carrying the given request ID.
+// Backends include this ID in their logs for an operation so that the logs
+// of concurrent operations can be correlated.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID in the context, or an empty string if
+// there isn't one.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
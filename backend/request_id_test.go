@@ -0,0 +1,18 @@
+package backend
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+	if id := RequestID(ctx); id != "" {
+		t.Fatalf("bad: %q", id)
+	}
+
+	ctx = ContextWithRequestID(ctx, "abc123")
+	if id := RequestID(ctx); id != "abc123" {
+		t.Fatalf("bad: %q", id)
+	}
+}
@@ -0,0 +1,51 @@
+package backend
+
+import (
+	"context"
+)
+
+// Tracer creates spans that trace the phases of an operation, such as
+// refreshing, planning and applying. This is a minimal interface so that
+// any tracing system, such as OpenTelemetry, can be adapted to it.
+//
+// A Tracer is supplied to an operation through its context with
+// ContextWithTracer. If there is no Tracer then no spans are created.
+type Tracer interface {
+	// StartSpan starts a span with the given name, returning a context
+	// containing the span for any child spans.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced phase of an operation. The duration of the span
+// is from when it was started until End is called.
+type Span interface {
+	// SetError records that the phase failed with the given error.
+	SetError(err error)
+
+	// End ends the span.
+	End()
+}
+
+type tracerKey struct{}
+
+// ContextWithTracer returns a context that traces operations using t.
+func ContextWithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// StartSpan starts a span using the Tracer in the context. If there is no
+// Tracer then this returns the context as-is and a Span that does nothing.
+func StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	t, ok := ctx.Value(tracerKey{}).(Tracer)
+	if !ok || t == nil {
+		return ctx, nilSpan{}
+	}
+
+	return t.StartSpan(ctx, name)
+}
+
+// nilSpan is a Span that does nothing.
+type nilSpan struct{}
+
+func (nilSpan) SetError(error) {}
+func (nilSpan) End()           {}
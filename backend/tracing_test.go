@@ -0,0 +1,17 @@
+package backend
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStartSpan_noTracer(t *testing.T) {
+	ctx := context.Background()
+	spanCtx, span := StartSpan(ctx, "foo")
+	if spanCtx != ctx {
+		t.Fatal("context should not change")
+	}
+
+	// This should do nothing
+	span.End()
+}
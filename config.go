@@ -257,18 +257,51 @@ func (c *Config) discoverSingle(glob string, m *map[string]string) error {
 // ResourceProviderFactory that can be used to instantiate a
 // binary-based plugin.
 func (c *Config) ProviderFactories() map[string]terraform.ResourceProviderFactory {
-	result := make(map[string]terraform.ResourceProviderFactory)
+	result, _ := c.ProviderPlugins()
+	return result
+}
+
+// ProviderPaths returns the mapping of prefixes to the path of the binary
+// that the ResourceProviderFactory from ProviderFactories runs. For an
+// internal plugin this is the Terraform executable itself.
+func (c *Config) ProviderPaths() map[string]string {
+	result := make(map[string]string)
+	for k, cmd := range c.providerCmds() {
+		result[k] = cmd.Path
+	}
+
+	return result
+}
+
+// ProviderPlugins returns both ProviderFactories and ProviderPaths. The
+// command for each plugin is only looked up once, so that each path is
+// that of the binary its factory runs.
+func (c *Config) ProviderPlugins() (map[string]terraform.ResourceProviderFactory, map[string]string) {
+	factories := make(map[string]terraform.ResourceProviderFactory)
+	paths := make(map[string]string)
+	for k, cmd := range c.providerCmds() {
+		factories[k] = c.providerFactory(cmd)
+		paths[k] = cmd.Path
+	}
+
+	return factories, paths
+}
+
+// providerCmds returns the mapping of prefixes to the command that runs
+// each provider plugin.
+func (c *Config) providerCmds() map[string]*exec.Cmd {
+	result := make(map[string]*exec.Cmd)
 	for k, v := range c.Providers {
-		result[k] = c.providerFactory(v)
+		result[k] = pluginCmd(v)
 	}
 
 	return result
 }
 
-func (c *Config) providerFactory(path string) terraform.ResourceProviderFactory {
+func (c *Config) providerFactory(cmd *exec.Cmd) terraform.ResourceProviderFactory {
 	// Build the plugin client configuration and init the plugin
 	var config plugin.ClientConfig
-	config.Cmd = pluginCmd(path)
+	config.Cmd = cmd
 	config.HandshakeConfig = tfplugin.Handshake
 	config.Managed = true
 	config.Plugins = tfplugin.PluginMap
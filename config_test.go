@@ -5,6 +5,9 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/hashicorp/terraform/command"
+	"github.com/kardianos/osext"
 )
 
 // This is the directory where our test fixtures are.
@@ -129,3 +132,67 @@ func TestConfig_Merge_disableCheckpointSignature(t *testing.T) {
 		t.Fatalf("bad: %#v", actual)
 	}
 }
+
+func TestConfig_ProviderPaths(t *testing.T) {
+	internal, err := command.BuildPluginCommandString("provider", "test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	exe, err := osext.Executable()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &Config{
+		Providers: map[string]string{
+			"aws":  filepath.Join(fixtureDir, "terraform-provider-aws"),
+			"test": internal,
+		},
+	}
+
+	// The paths are those of the binaries the provider factories run
+	expected := map[string]string{
+		"aws":  filepath.Join(fixtureDir, "terraform-provider-aws"),
+		"test": exe,
+	}
+	actual := c.ProviderPaths()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: %#v", actual)
+	}
+}
+
+func TestConfig_ProviderPlugins(t *testing.T) {
+	internal, err := command.BuildPluginCommandString("provider", "test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	exe, err := osext.Executable()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &Config{
+		Providers: map[string]string{
+			"aws":  filepath.Join(fixtureDir, "terraform-provider-aws"),
+			"test": internal,
+		},
+	}
+
+	factories, paths := c.ProviderPlugins()
+	if len(factories) != len(c.Providers) {
+		t.Fatalf("bad: %#v", factories)
+	}
+	for k := range c.Providers {
+		if factories[k] == nil {
+			t.Fatalf("%s: no factory", k)
+		}
+	}
+
+	expected := map[string]string{
+		"aws":  filepath.Join(fixtureDir, "terraform-provider-aws"),
+		"test": exe,
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("bad: %#v", paths)
+	}
+}
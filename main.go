@@ -186,7 +186,7 @@ func wrappedMain() int {
 	}
 
 	// Initialize the TFConfig settings for the commands...
-	ContextOpts.Providers = config.ProviderFactories()
+	ContextOpts.Providers, ContextOpts.ProviderPaths = config.ProviderPlugins()
 	ContextOpts.Provisioners = config.ProvisionerFactories()
 
 	exitCode, err := cliRunner.Run()
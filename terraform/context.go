@@ -64,6 +64,10 @@ type ContextOpts struct {
 	Variables          map[string]interface{}
 
 	UIInput UIInput
+
+	// ProviderPaths is the path of the plugin binary that each of the
+	// Providers runs, if known, so that the binaries can be verified.
+	ProviderPaths map[string]string
 }
 
 // ContextMeta is metadata about the running context. This is information
@@ -107,6 +111,7 @@ type Context struct {
 	runContext          context.Context
 	runContextCancel    context.CancelFunc
 	shadowErr           error
+	stopErr             error
 }
 
 // NewContext creates a new Context structure.
@@ -310,6 +315,15 @@ func (c *Context) ShadowError() error {
 	return c.shadowErr
 }
 
+// StopError returns any errors the providers and provisioners returned
+// from their Stop calls while the last operation was being stopped.
+//
+// Stopping is advisory, so these errors never affect the result of the
+// operation. This must be called only when no other operation is running.
+func (c *Context) StopError() error {
+	return c.stopErr
+}
+
 // State returns a copy of the current state associated with this context.
 //
 // This cannot safely be called in parallel with any other Context function.
@@ -735,8 +749,9 @@ func (c *Context) acquireRun(phase string) func() {
 	// Reset the stop hook so we're not stopped
 	c.sh.Reset()
 
-	// Reset the shadow errors
+	// Reset the shadow and stop errors
 	c.shadowErr = nil
+	c.stopErr = nil
 
 	return c.releaseRun
 }
@@ -940,10 +955,13 @@ func (c *Context) watchStop(walker *ContextGraphWalker) (chan struct{}, <-chan s
 			defer walker.providerLock.Unlock()
 
 			for _, p := range ps {
-				// We ignore the error for now since there isn't any reasonable
-				// action to take if there is an error here, since the stop is still
-				// advisory: Terraform will exit once the graph node completes.
-				p.Stop()
+				// The stop is still advisory: Terraform will exit once the
+				// graph node completes. We record the error so callers can
+				// report it, but there is no other action to take here.
+				if err := p.Stop(); err != nil {
+					c.stopErr = multierror.Append(c.stopErr, fmt.Errorf(
+						"provider: %s", err))
+				}
 			}
 		}
 
@@ -957,10 +975,13 @@ func (c *Context) watchStop(walker *ContextGraphWalker) (chan struct{}, <-chan s
 			defer walker.provisionerLock.Unlock()
 
 			for _, p := range ps {
-				// We ignore the error for now since there isn't any reasonable
-				// action to take if there is an error here, since the stop is still
-				// advisory: Terraform will exit once the graph node completes.
-				p.Stop()
+				// The stop is still advisory: Terraform will exit once the
+				// graph node completes. We record the error so callers can
+				// report it, but there is no other action to take here.
+				if err := p.Stop(); err != nil {
+					c.stopErr = multierror.Append(c.stopErr, fmt.Errorf(
+						"provisioner: %s", err))
+				}
 			}
 		}
 	}()
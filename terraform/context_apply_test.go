@@ -1876,6 +1876,54 @@ aws_instance.foo:
 	`)
 }
 
+func TestContext2Apply_cancelStopError(t *testing.T) {
+	m := testModule(t, "apply-cancel-block")
+	p := testProvider("aws")
+	ctx := testContext2(t, &ContextOpts{
+		Module: m,
+		Providers: map[string]ResourceProviderFactory{
+			"aws": testProviderFuncFixed(p),
+		},
+	})
+
+	applyCh := make(chan struct{})
+	stopCh := make(chan struct{})
+	p.StopFn = func() error {
+		close(stopCh)
+		return fmt.Errorf("stop failed")
+	}
+	p.DiffFn = testDiffFn
+	p.ApplyFn = func(*InstanceInfo, *InstanceState, *InstanceDiff) (*InstanceState, error) {
+		close(applyCh)
+		<-stopCh
+
+		return &InstanceState{
+			ID: "foo",
+		}, nil
+	}
+
+	if _, err := ctx.Plan(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	go func() {
+		<-applyCh
+		ctx.Stop()
+	}()
+
+	if _, err := ctx.Apply(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err := ctx.StopError()
+	if err == nil {
+		t.Fatal("should have a stop error")
+	}
+	if !strings.Contains(err.Error(), "stop failed") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
 func TestContext2Apply_cancelProvisioner(t *testing.T) {
 	m := testModule(t, "apply-cancel-provisioner")
 	p := testProvider("aws")
@@ -84,6 +84,10 @@ type State struct {
 	// configuration.
 	Backend *BackendState `json:"backend,omitempty"`
 
+	// Provenance records who or what last applied this state and when. It
+	// is informational only and isn't considered when comparing states.
+	Provenance *ProvenanceState `json:"provenance,omitempty"`
+
 	// Modules contains all the modules in a breadth-first order
 	Modules []*ModuleState `json:"modules"`
 
@@ -821,6 +825,18 @@ func (s *BackendState) Rehash() uint64 {
 	return cfg.Rehash()
 }
 
+// ProvenanceState records the apply that last wrote a state, for auditing.
+type ProvenanceState struct {
+	// Meta is arbitrary metadata about who or what ran the apply.
+	Meta map[string]string `json:"meta,omitempty"`
+
+	// Time is when the apply ran, in RFC 3339 format.
+	Time string `json:"time"`
+
+	// TFVersion is the version of Terraform that ran the apply.
+	TFVersion string `json:"terraform_version"`
+}
+
 // RemoteState is used to track the information about a remote
 // state store that we push/pull state to.
 type RemoteState struct {
@@ -1592,6 +1592,44 @@ func TestReadWriteState(t *testing.T) {
 	}
 }
 
+func TestReadWriteStateProvenance(t *testing.T) {
+	state := &State{
+		Provenance: &ProvenanceState{
+			Meta: map[string]string{
+				"user": "alice",
+			},
+			Time:      "2017-05-01T12:00:00Z",
+			TFVersion: "0.9.6",
+		},
+	}
+	state.init()
+
+	buf := new(bytes.Buffer)
+	if err := WriteState(state, buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	actual, err := ReadState(buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !reflect.DeepEqual(actual.Provenance, state.Provenance) {
+		t.Fatalf("bad: %#v", actual.Provenance)
+	}
+}
+
+func TestStateEqual_provenance(t *testing.T) {
+	one := &State{Provenance: &ProvenanceState{Time: "2017-05-01T12:00:00Z"}}
+	one.init()
+	two := one.DeepCopy()
+	two.Provenance.Time = "2017-05-02T12:00:00Z"
+
+	if !one.Equal(two) {
+		t.Fatal("provenance should be ignored when comparing states")
+	}
+}
+
 func TestReadStateNewVersion(t *testing.T) {
 	type out struct {
 		Version int